@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/XiaoweiQian/ovs-driver/drivers"
+	"github.com/codegangsta/cli"
+)
+
+// commands are the operator subcommands, they query the admin api of the
+// running plugin or ovsdb and the local store directly
+func commands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:   "serve",
+			Usage:  "serve the network plugin",
+			Action: Run,
+		},
+		{
+			Name:   "networks",
+			Usage:  "list the networks of the running plugin",
+			Action: listNetworks,
+		},
+		{
+			Name:      "endpoints",
+			Usage:     "list the endpoints of a network of the running plugin",
+			ArgsUsage: "<network>",
+			Action:    listEndpoints,
+		},
+		{
+			Name:   "ports",
+			Usage:  "list the ports of all bridges from ovsdb",
+			Action: listPorts,
+		},
+		{
+			Name:  "cleanup",
+			Usage: "remove orphaned links, ovs ports and stored endpoints",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only list the orphans found",
+				},
+			},
+			Action: cleanup,
+		},
+		{
+			Name:   "bonds",
+			Usage:  "show the bond uplinks of the networks of the running plugin with their ovs status",
+			Action: showBonds,
+		},
+		{
+			Name:      "ipam",
+			Usage:     "list the pools of the ovs ipam driver, or the addresses of one pool",
+			ArgsUsage: "[pool]",
+			Action:    listIpam,
+		},
+		{
+			Name:      "inspect",
+			Usage:     "show an endpoint of the running plugin with its ovs port and interface",
+			ArgsUsage: "<endpoint>",
+			Action:    inspectEndpoint,
+		},
+		{
+			Name:  "mirror",
+			Usage: "manage the port mirrors of the running plugin",
+			Subcommands: []cli.Command{
+				{
+					Name:   "ls",
+					Usage:  "list the mirrors",
+					Action: listMirrors,
+				},
+				{
+					Name:      "add",
+					Usage:     "mirror an endpoint, a network vlan or all ports to a port",
+					ArgsUsage: "<name>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "endpoint",
+							Usage: "mirror the traffic of the endpoint",
+						},
+						cli.StringFlag{
+							Name:  "network",
+							Usage: "mirror the traffic of the vlan of the network",
+						},
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "mirror all traffic of the bridge",
+						},
+						cli.StringFlag{
+							Name:  "bridge",
+							Usage: "bridge of --all, the default bridge if empty",
+						},
+						cli.StringFlag{
+							Name:  "output",
+							Usage: "existing port receiving the traffic",
+						},
+						cli.StringFlag{
+							Name:  "tap",
+							Usage: "internal port created to receive the traffic",
+						},
+					},
+					Action: addMirror,
+				},
+				{
+					Name:      "rm",
+					Usage:     "delete a mirror and its tap",
+					ArgsUsage: "<name>",
+					Action:    removeMirror,
+				},
+			},
+		},
+	}
+}
+
+// adminClient returns the client of the admin socket set by the config
+func adminClient(ctx *cli.Context) (*drivers.AdminClient, error) {
+	cfg, err := loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AdminSocket == "" {
+		return nil, fmt.Errorf("admin socket is disabled")
+	}
+	return drivers.NewAdminClient(cfg.AdminSocket), nil
+}
+
+func listNetworks(ctx *cli.Context) error {
+	c, err := adminClient(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	networks, err := c.Networks(false)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NETWORK ID\tBRIDGE\tVLAN\tBANDWIDTH\tATTACH\tSUBNETS\tENDPOINTS")
+	for _, n := range networks {
+		subnets := []string{}
+		for _, s := range n.Subnets {
+			subnets = append(subnets, s.Subnet)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%d\n", shortID(n.ID), n.Bridge, n.Vlan, n.Bandwidth, n.Attach,
+			strings.Join(subnets, ","), n.Endpoints)
+	}
+	return w.Flush()
+}
+
+func listEndpoints(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("endpoints needs exactly one network", 1)
+	}
+	c, err := adminClient(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	endpoints, err := c.Endpoints(ctx.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT ID\tCONTAINER ID\tINTERFACE\tOVS PORT\tMAC ADDRESS\tIPV4 ADDRESS\tIPV6 ADDRESS")
+	for _, ep := range endpoints {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", shortID(ep.ID), shortID(ep.ContainerID), ep.InterfaceName,
+			ep.OvsPortName, ep.MacAddress, ep.Address, ep.AddressIPv6)
+	}
+	return w.Flush()
+}
+
+func listPorts(ctx *cli.Context) error {
+	cfg, err := loadConfig(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	ovsdb, err := drivers.ConnectOvsdb(cfg)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer ovsdb.Close()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BRIDGE\tPORT\tTYPE\tTAG\tOFPORT\tENDPOINT ID\tCONTAINER ID")
+	for _, p := range ovsdb.Ports() {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", p.Bridge, p.Name, p.Type, p.Tag, p.Ofport,
+			shortID(p.EndpointID()), shortID(p.ContainerID()))
+	}
+	return w.Flush()
+}
+
+func cleanup(ctx *cli.Context) error {
+	cfg, err := loadConfig(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	items, err := drivers.Cleanup(cfg, ctx.Bool("dry-run"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME\tACTION")
+	for _, item := range items {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", item.Kind, item.Name, item.Action)
+	}
+	return w.Flush()
+}
+
+// showBonds prints the bond/show status of each bond once, networks on the
+// same bridge share it
+func showBonds(ctx *cli.Context) error {
+	c, err := adminClient(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	networks, err := c.Networks(true)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	shown := map[string]bool{}
+	for _, n := range networks {
+		b := n.Bond
+		if b == nil || shown[n.Bridge+"/"+b.Name] {
+			continue
+		}
+		shown[n.Bridge+"/"+b.Name] = true
+		fmt.Printf("%s on %s: %s, lacp %s, interfaces %s\n", b.Name, n.Bridge, b.Mode, b.LACP, strings.Join(b.Interfaces, ","))
+		if b.Error != "" {
+			fmt.Printf("status unavailable: %s\n\n", b.Error)
+			continue
+		}
+		fmt.Println(b.Status)
+	}
+	return nil
+}
+
+func listIpam(ctx *cli.Context) error {
+	c, err := adminClient(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	pools, err := c.IpamPools()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if ctx.NArg() == 0 {
+		fmt.Fprintln(w, "POOL ID\tADDRESS SPACE\tPOOL\tSUB POOL\tGATEWAY\tADDRESSES")
+		for _, p := range pools {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", p.ID, p.AddressSpace, p.Pool, p.SubPool, p.Gateway, len(p.Addresses))
+		}
+		return w.Flush()
+	}
+	for _, p := range pools {
+		if p.ID != ctx.Args().First() {
+			continue
+		}
+		fmt.Fprintln(w, "ADDRESS\tKIND\tENDPOINT ID")
+		for _, a := range p.Addresses {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", a.Address, a.Kind, shortID(a.EndpointID))
+		}
+		return w.Flush()
+	}
+	return cli.NewExitError(fmt.Sprintf("ipam pool %q not found", ctx.Args().First()), 1)
+}
+
+func inspectEndpoint(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("inspect needs exactly one endpoint", 1)
+	}
+	c, err := adminClient(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	ep, err := c.Endpoint(ctx.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	ovsdb, err := c.Ovsdb()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	res := map[string]interface{}{"Endpoint": ep}
+	for _, table := range []string{"Port", "Interface"} {
+		for _, row := range ovsdb.Tables[table] {
+			if row["name"] == ep.OvsPortName {
+				res[table] = row
+			}
+		}
+	}
+	b, err := json.MarshalIndent(res, "", "    ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func listMirrors(ctx *cli.Context) error {
+	c, err := adminClient(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	mirrors, err := c.Mirrors()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tBRIDGE\tSOURCE\tOUTPUT\tTX PACKETS")
+	for _, m := range mirrors {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", m.Name, m.Bridge, mirrorSource(m), m.OutputPort, m.Statistics["tx_packets"])
+	}
+	return w.Flush()
+}
+
+// mirrorSource describes the traffic selected by a mirror
+func mirrorSource(m drivers.MirrorInfo) string {
+	switch {
+	case m.SelectAll:
+		return "all"
+	case len(m.SelectVlans) != 0:
+		vlans := []string{}
+		for _, vlan := range m.SelectVlans {
+			vlans = append(vlans, strconv.Itoa(vlan))
+		}
+		return "vlan " + strings.Join(vlans, ",")
+	}
+	return strings.Join(m.SelectPorts, ",")
+}
+
+func addMirror(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("mirror add needs exactly one name", 1)
+	}
+	c, err := adminClient(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	m, err := c.CreateMirror(&drivers.MirrorRequest{
+		Name:       ctx.Args().First(),
+		Endpoint:   ctx.String("endpoint"),
+		Network:    ctx.String("network"),
+		All:        ctx.Bool("all"),
+		Bridge:     ctx.String("bridge"),
+		OutputPort: ctx.String("output"),
+		Tap:        ctx.String("tap"),
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Printf("%s on %s to %s\n", m.Name, m.Bridge, m.OutputPort)
+	return nil
+}
+
+func removeMirror(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("mirror rm needs exactly one name", 1)
+	}
+	c, err := adminClient(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err := c.DeleteMirror(ctx.Args().First()); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+// shortID truncates docker ids like the docker cli
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
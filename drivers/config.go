@@ -0,0 +1,232 @@
+package drivers
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	defaultPluginName   = "ovs"
+	defaultPluginGroup  = "root"
+	defaultStorePath    = "/var/lib/docker/network/files/local-kv.db"
+	defaultStoreBucket  = "libnetwork"
+	defaultAdminSocket  = "/var/run/ovs-driver/admin.sock"
+	defaultFlowSampling = 64
+	defaultFlowPolling  = 10
+	defaultIpamPool     = "10.200.0.0/16"
+)
+
+// Config holds the driver settings read from the config file and flags
+type Config struct {
+	// OvsdbSocket is the unix socket of the local ovsdb-server, used when
+	// no ovsdb endpoint is set
+	OvsdbSocket string `toml:"ovsdb_socket"`
+	// OvsdbEndpoints are tried in order, each one like unix:/path,
+	// tcp:host:port or ssl:host:port
+	OvsdbEndpoints []string `toml:"ovsdb_endpoints"`
+	// OvsdbSSLKey, OvsdbSSLCert and OvsdbSSLCA are the client private key,
+	// client certificate and CA certificate of ssl endpoints
+	OvsdbSSLKey  string `toml:"ovsdb_ssl_key"`
+	OvsdbSSLCert string `toml:"ovsdb_ssl_cert"`
+	OvsdbSSLCA   string `toml:"ovsdb_ssl_ca"`
+	// Bridge is used by networks created without the bridge option
+	Bridge string `toml:"bridge"`
+	// SwarmEndpoint is asked for networks missing from the local store,
+	// leave empty to disable the lookup
+	SwarmEndpoint string `toml:"swarm_endpoint"`
+	// PluginName is the name of the plugin socket under /run/docker/plugins
+	PluginName string `toml:"plugin_name"`
+	// PluginGroup owns the plugin socket
+	PluginGroup string `toml:"plugin_group"`
+	// VethPrefix is the name prefix of the container side interfaces
+	VethPrefix string `toml:"veth_prefix"`
+	// StorePath is the boltdb file of the local store
+	StorePath string `toml:"store_path"`
+	// ReconcileInterval is the period of the orphan cleanup like 5m, empty
+	// or 0 disables it
+	ReconcileInterval string `toml:"reconcile_interval"`
+	// ReconcileDryRun only logs the orphans found
+	ReconcileDryRun bool `toml:"reconcile_dry_run"`
+	// MetricsAddress is the host:port serving prometheus metrics, leave
+	// empty to disable the listener
+	MetricsAddress string `toml:"metrics_address"`
+	// AdminSocket is the unix socket of the admin api, leave
+	// empty to disable it
+	AdminSocket string `toml:"admin_socket"`
+	// SflowTargets, NetflowTargets and IpfixTargets are the host:port of
+	// the flow collectors of the bridges, leave empty to disable the export
+	SflowTargets   []string `toml:"sflow_targets"`
+	NetflowTargets []string `toml:"netflow_targets"`
+	IpfixTargets   []string `toml:"ipfix_targets"`
+	// FlowSampling exports one of FlowSampling packets with sFlow and IPFIX
+	FlowSampling int `toml:"flow_sampling"`
+	// FlowPolling is the sFlow counter polling interval and the NetFlow and
+	// IPFIX active timeout in seconds
+	FlowPolling int `toml:"flow_polling"`
+	// SflowAgent is the interface of the sFlow agent address
+	SflowAgent string `toml:"sflow_agent"`
+	// IpamDefaultPool is split into /24 pools for networks using the ovs
+	// ipam driver without a subnet
+	IpamDefaultPool string `toml:"ipam_default_pool"`
+	Debug           bool   `toml:"debug"`
+}
+
+// DefaultConfig returns the settings the driver used before it was configurable
+func DefaultConfig() *Config {
+	return &Config{
+		OvsdbSocket:     socketFile,
+		Bridge:          ovsBridgeName,
+		SwarmEndpoint:   swarmEndpoint,
+		PluginName:      defaultPluginName,
+		PluginGroup:     defaultPluginGroup,
+		VethPrefix:      intfPrefix,
+		StorePath:       defaultStorePath,
+		AdminSocket:     defaultAdminSocket,
+		FlowSampling:    defaultFlowSampling,
+		FlowPolling:     defaultFlowPolling,
+		IpamDefaultPool: defaultIpamPool,
+	}
+}
+
+// LoadConfig reads a toml config file on top of the default settings
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	if _, err := toml.DecodeFile(path, cfg); err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the settings
+func (c *Config) Validate() error {
+	if c.OvsdbSocket == "" && len(c.OvsdbEndpoints) == 0 {
+		return fmt.Errorf("ovsdb socket or endpoints must be set")
+	}
+	ssl := false
+	for _, endpoint := range c.OvsdbEndpoints {
+		proto, _, err := parseOvsdbEndpoint(endpoint)
+		if err != nil {
+			return err
+		}
+		ssl = ssl || proto == sslProto
+	}
+	if ssl && (c.OvsdbSSLKey == "" || c.OvsdbSSLCert == "" || c.OvsdbSSLCA == "") {
+		return fmt.Errorf("ovsdb ssl key, certificate and ca must be set for ssl endpoints")
+	}
+	if c.Bridge == "" {
+		return fmt.Errorf("bridge must be set")
+	}
+	if c.PluginName == "" {
+		return fmt.Errorf("plugin name must be set")
+	}
+	if c.StorePath == "" {
+		return fmt.Errorf("store path must be set")
+	}
+	if c.ReconcileInterval != "" {
+		if _, err := time.ParseDuration(c.ReconcileInterval); err != nil {
+			return fmt.Errorf("invalid reconcile interval %q: %v", c.ReconcileInterval, err)
+		}
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			return fmt.Errorf("invalid metrics address %q: %v", c.MetricsAddress, err)
+		}
+	}
+	for _, targets := range [][]string{c.SflowTargets, c.NetflowTargets, c.IpfixTargets} {
+		for _, target := range targets {
+			if _, port, err := net.SplitHostPort(target); err != nil || port == "" {
+				return fmt.Errorf("invalid flow collector %q, must be host:port", target)
+			}
+		}
+	}
+	if c.FlowSampling < 1 {
+		return fmt.Errorf("flow sampling must be at least 1")
+	}
+	if c.FlowPolling < 0 {
+		return fmt.Errorf("flow polling must not be negative")
+	}
+	if _, pool, err := net.ParseCIDR(c.IpamDefaultPool); err != nil || pool.IP.To4() == nil || prefixLen(pool) > ipamPoolPrefix {
+		return fmt.Errorf("invalid ipam default pool %q, must be an ipv4 subnet of at least /%d", c.IpamDefaultPool, ipamPoolPrefix)
+	}
+	// the ovs side of the veth adds one more character, interface
+	// names must fit into IFNAMSIZ
+	if c.VethPrefix == "" || len(c.VethPrefix)+intfLen+1 > 15 {
+		return fmt.Errorf("veth prefix %q must be 1 to %d characters", c.VethPrefix, 15-intfLen-1)
+	}
+	return nil
+}
+
+// reconcileInterval returns the period of the orphan cleanup, 0 if disabled
+func (c *Config) reconcileInterval() time.Duration {
+	interval, _ := time.ParseDuration(c.ReconcileInterval)
+	return interval
+}
+
+// flowExports returns the flow export settings by table
+func (c *Config) flowExports() map[string]FlowExport {
+	return map[string]FlowExport{
+		sflowTable:   {Targets: c.SflowTargets, Sampling: c.FlowSampling, Polling: c.FlowPolling, Agent: c.SflowAgent},
+		netflowTable: {Targets: c.NetflowTargets, Polling: c.FlowPolling},
+		ipfixTable:   {Targets: c.IpfixTargets, Sampling: c.FlowSampling, Polling: c.FlowPolling},
+	}
+}
+
+// reload copies the settings that are safe to change while running from o
+func (c *Config) reload(o *Config) {
+	c.Debug = o.Debug
+	c.SwarmEndpoint = o.SwarmEndpoint
+	c.ReconcileDryRun = o.ReconcileDryRun
+	c.SflowTargets = o.SflowTargets
+	c.NetflowTargets = o.NetflowTargets
+	c.IpfixTargets = o.IpfixTargets
+	c.FlowSampling = o.FlowSampling
+	c.FlowPolling = o.FlowPolling
+	c.SflowAgent = o.SflowAgent
+}
+
+// ovsdbEndpoints returns the ovsdb endpoints to try in order
+func (c *Config) ovsdbEndpoints() []string {
+	if len(c.OvsdbEndpoints) != 0 {
+		return c.OvsdbEndpoints
+	}
+	return []string{unixProto + ":" + c.OvsdbSocket}
+}
+
+// localOvsdb reports whether every ovsdb endpoint is on this host. Flows
+// are installed with ovs-ofctl, which only reaches the local switch.
+func (c *Config) localOvsdb() bool {
+	for _, endpoint := range c.ovsdbEndpoints() {
+		// invalid endpoints are refused by Validate
+		proto, addr, err := parseOvsdbEndpoint(endpoint)
+		if err != nil || proto == unixProto {
+			continue
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return false
+		}
+	}
+	return true
+}
+
+// ovsdbTLSConfig returns the tls settings of ssl endpoints, nil if unset
+func (c *Config) ovsdbTLSConfig() (*tls.Config, error) {
+	if c.OvsdbSSLKey == "" && c.OvsdbSSLCert == "" && c.OvsdbSSLCA == "" {
+		return nil, nil
+	}
+	return newOvsdbTLSConfig(c.OvsdbSSLKey, c.OvsdbSSLCert, c.OvsdbSSLCA)
+}
+
+// ovsdbChanged reports whether the ovsdb connection settings differ
+func (c *Config) ovsdbChanged(o *Config) bool {
+	return c.OvsdbSocket != o.OvsdbSocket || !reflect.DeepEqual(c.OvsdbEndpoints, o.OvsdbEndpoints) ||
+		c.OvsdbSSLKey != o.OvsdbSSLKey || c.OvsdbSSLCert != o.OvsdbSSLCert || c.OvsdbSSLCA != o.OvsdbSSLCA
+}
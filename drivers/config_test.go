@@ -0,0 +1,90 @@
+package drivers
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig("")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultConfig(), cfg)
+	assert.Nil(t, cfg.Validate())
+
+	f, err := ioutil.TempFile("", "ovs-driver")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("bridge = \"ovs-br1\"\nswarm_endpoint = \"\"\ndebug = true\n")
+	f.Close()
+
+	cfg, err = LoadConfig(f.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, "ovs-br1", cfg.Bridge)
+	assert.Equal(t, "", cfg.SwarmEndpoint)
+	assert.True(t, cfg.Debug)
+	assert.Equal(t, socketFile, cfg.OvsdbSocket)
+
+	_, err = LoadConfig("/nonexistent/ovs-driver.toml")
+	assert.NotNil(t, err)
+}
+
+func TestValidateConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.VethPrefix = "longprefix"
+	assert.NotNil(t, cfg.Validate())
+	cfg = DefaultConfig()
+	cfg.Bridge = ""
+	assert.NotNil(t, cfg.Validate())
+	for _, pool := range []string{"10.200.0.0/25", "fd00::/48", "bogus"} {
+		cfg = DefaultConfig()
+		cfg.IpamDefaultPool = pool
+		assert.NotNil(t, cfg.Validate(), pool)
+	}
+}
+
+func TestOvsdbEndpointsConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.Equal(t, []string{"unix:" + socketFile}, cfg.ovsdbEndpoints())
+	tlsConfig, err := cfg.ovsdbTLSConfig()
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig)
+	assert.True(t, cfg.localOvsdb())
+
+	cfg.OvsdbEndpoints = []string{"tcp:127.0.0.1:6640", "ssl:localhost:6640"}
+	assert.True(t, cfg.localOvsdb())
+	cfg.OvsdbEndpoints = []string{"tcp:10.0.0.1:6640", "ssl:10.0.0.2:6640"}
+	assert.False(t, cfg.localOvsdb())
+	assert.Equal(t, cfg.OvsdbEndpoints, cfg.ovsdbEndpoints())
+	assert.NotNil(t, cfg.Validate())
+	cfg.OvsdbSSLKey = "/etc/openvswitch/key.pem"
+	cfg.OvsdbSSLCert = "/etc/openvswitch/cert.pem"
+	cfg.OvsdbSSLCA = "/etc/openvswitch/cacert.pem"
+	assert.Nil(t, cfg.Validate())
+	assert.True(t, cfg.ovsdbChanged(DefaultConfig()))
+
+	cfg.OvsdbEndpoints = []string{"http:10.0.0.1:6640"}
+	assert.NotNil(t, cfg.Validate())
+}
+
+func TestReloadConfig(t *testing.T) {
+	d := &Driver{config: DefaultConfig(), ovsdb: &OvsdbDriver{}}
+	cfg := DefaultConfig()
+	cfg.SwarmEndpoint = ""
+	cfg.ReconcileDryRun = true
+	cfg.SflowTargets = []string{"10.0.0.1:6343"}
+	cfg.Bridge = "ovs-br1"
+	cfg.VethPrefix = "eth"
+	cfg.IpamDefaultPool = "10.100.0.0/16"
+	assert.Nil(t, d.Reload(cfg))
+
+	assert.True(t, d.reconcileDryRun())
+	assert.Equal(t, []string{"10.0.0.1:6343"}, d.config.SflowTargets)
+	assert.Equal(t, "", d.config.SwarmEndpoint)
+	// restart only settings keep their running value
+	assert.Equal(t, ovsBridgeName, d.bridgeName())
+	assert.Equal(t, intfPrefix, d.vethPrefix())
+	assert.Equal(t, defaultIpamPool, d.ipamDefaultPool())
+}
@@ -0,0 +1,256 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	aclOption        = "acl"
+	aclDefaultOption = "acl_default"
+	// aclLabel holds the rules of a container, checked before the rules
+	// of its networks
+	aclLabel = "ovs-driver.acl"
+
+	aclAllow = "allow"
+	aclDeny  = "deny"
+
+	// aclPriority is the priority of the first rule, the following rules
+	// get lower ones. The default action is below all rules and above the
+	// NORMAL flow of the acl table.
+	aclPriority        = 30000
+	aclDefaultPriority = 20000
+	aclMaxRules        = aclPriority - aclDefaultPriority - 1
+
+	aclCookie = "acl"
+)
+
+// aclRule allows or denies traffic towards an endpoint. Unset fields match
+// any traffic.
+type aclRule struct {
+	action  string
+	proto   string
+	port    int
+	cidr    *net.IPNet
+	network string
+}
+
+// parseACL parses rules separated by ";", each one an action followed by
+// comma separated conditions, like
+// allow,proto=tcp,port=80;allow,network=ba98;deny,cidr=10.0.0.0/8
+func parseACL(acl string) ([]aclRule, error) {
+	rules := []aclRule{}
+	for _, r := range strings.Split(acl, ";") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		fields := strings.Split(r, ",")
+		rule := aclRule{action: strings.TrimSpace(fields[0])}
+		if rule.action != aclAllow && rule.action != aclDeny {
+			return nil, fmt.Errorf("invalid acl rule %q, must start with %s or %s", r, aclAllow, aclDeny)
+		}
+		for _, f := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+			if len(kv) != 2 || kv[1] == "" {
+				return nil, fmt.Errorf("invalid acl rule %q, conditions must be key=value", r)
+			}
+			switch kv[0] {
+			case "proto":
+				switch kv[1] {
+				case "tcp", "udp", "sctp", "icmp":
+				default:
+					return nil, fmt.Errorf("invalid acl rule %q, proto must be tcp, udp, sctp or icmp", r)
+				}
+				rule.proto = kv[1]
+			case "port":
+				port, err := strconv.Atoi(kv[1])
+				if err != nil || port < 1 || port > 65535 {
+					return nil, fmt.Errorf("invalid acl rule %q, port must be between 1 and 65535", r)
+				}
+				rule.port = port
+			case "cidr":
+				_, cidr, err := net.ParseCIDR(kv[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid acl rule %q: %v", r, err)
+				}
+				rule.cidr = cidr
+			case "network":
+				rule.network = kv[1]
+			default:
+				return nil, fmt.Errorf("invalid acl rule %q, unknown condition %s", r, kv[0])
+			}
+		}
+		if rule.port != 0 && (rule.proto == "" || rule.proto == "icmp") {
+			return nil, fmt.Errorf("invalid acl rule %q, port needs proto tcp, udp or sctp", r)
+		}
+		if rule.cidr != nil && rule.network != "" {
+			return nil, fmt.Errorf("invalid acl rule %q, cidr and network are exclusive", r)
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) > aclMaxRules {
+		return nil, fmt.Errorf("too many acl rules, at most %d are supported", aclMaxRules)
+	}
+	return rules, nil
+}
+
+// getACLDefault returns the action of traffic matching no rule, allow by
+// default
+func getACLDefault(opts map[string]string) (string, error) {
+	switch def := opts[aclDefaultOption]; def {
+	case "":
+		return aclAllow, nil
+	case aclAllow, aclDeny:
+		return def, nil
+	default:
+		return "", fmt.Errorf("invalid %s option %q, must be %s or %s", aclDefaultOption, def, aclAllow, aclDeny)
+	}
+}
+
+// aclFlows compiles the container rules of the endpoint and the rules of its
+// network into flows matching the traffic towards the endpoint
+func (d *Driver) aclFlows(n *network, ep *endpoint) ([]string, error) {
+	rules, err := parseACL(ep.acl)
+	if err != nil {
+		return nil, err
+	}
+	netRules, err := parseACL(n.acl)
+	if err != nil {
+		return nil, err
+	}
+	rules = append(rules, netRules...)
+	if len(rules) == 0 && n.aclDefault != aclDeny {
+		return nil, nil
+	}
+
+	cookie := flowCookie(ep.id, aclCookie)
+	flows := []string{}
+	for _, addr := range []*net.IPNet{ep.addr, ep.addrv6} {
+		if addr == nil {
+			continue
+		}
+		ipv6 := addr.IP.To4() == nil
+		dst := fmt.Sprintf("ip,dl_dst=%s,nw_dst=%s", ep.mac, addr.IP)
+		if ipv6 {
+			dst = fmt.Sprintf("ipv6,dl_dst=%s,ipv6_dst=%s", ep.mac, addr.IP)
+		}
+		for i, rule := range rules {
+			sources, ok := d.aclSources(rule, ipv6)
+			if !ok {
+				continue
+			}
+			action := "NORMAL"
+			if rule.action == aclDeny {
+				action = "drop"
+			}
+			for _, match := range rule.matches(dst, sources, ipv6) {
+				flows = append(flows, fmt.Sprintf("cookie=%#x,table=%d,priority=%d,%s,actions=%s", cookie, aclTable, aclPriority-i, match, action))
+			}
+		}
+		if n.aclDefault == aclDeny {
+			flows = append(flows, fmt.Sprintf("cookie=%#x,table=%d,priority=%d,%s,actions=drop", cookie, aclTable, aclDefaultPriority, dst))
+		}
+	}
+	return flows, nil
+}
+
+// aclSources returns the source subnets of the rule in the address family,
+// nil for any source. It is false if the rule cannot match the family.
+func (d *Driver) aclSources(rule aclRule, ipv6 bool) ([]*net.IPNet, bool) {
+	if rule.cidr != nil {
+		return []*net.IPNet{rule.cidr}, (rule.cidr.IP.To4() == nil) == ipv6
+	}
+	if rule.network == "" {
+		return nil, true
+	}
+	src, err := d.findNetwork(rule.network)
+	if err != nil {
+		logrus.Warnf("Skipping acl rule of unknown source network: %v", err)
+		return nil, false
+	}
+	sources := []*net.IPNet{}
+	for _, s := range src.subnets {
+		if (s.subnetIP.IP.To4() == nil) == ipv6 {
+			sources = append(sources, s.subnetIP)
+		}
+	}
+	return sources, len(sources) != 0
+}
+
+// matches returns the flow matches of the rule towards dst, one per source
+func (rule aclRule) matches(dst string, sources []*net.IPNet, ipv6 bool) []string {
+	match := dst
+	if rule.proto != "" {
+		proto := rule.proto
+		if ipv6 {
+			proto += "6"
+		}
+		match = proto + "," + strings.SplitN(dst, ",", 2)[1]
+	}
+	if rule.port != 0 {
+		match += fmt.Sprintf(",tp_dst=%d", rule.port)
+	}
+	if sources == nil {
+		return []string{match}
+	}
+	srcField := "nw_src"
+	if ipv6 {
+		srcField = "ipv6_src"
+	}
+	matches := []string{}
+	for _, src := range sources {
+		matches = append(matches, fmt.Sprintf("%s,%s=%s", match, srcField, src))
+	}
+	return matches
+}
+
+// hasACL checks if the endpoint traffic is filtered
+func (n *network) hasACL(ep *endpoint) bool {
+	return n.acl != "" || n.aclDefault == aclDeny || ep.acl != ""
+}
+
+// installACL replaces the acl flows of the endpoint on the network bridge
+func (d *Driver) installACL(n *network, ep *endpoint) error {
+	flows, err := d.aclFlows(n, ep)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("ovs install acl flows of endpoint %s on bridge %s: %v", ep.id[0:7], n.bridge, flows)
+	if err := replaceFlows(n.bridge, flowCookie(ep.id, aclCookie), flows); err != nil {
+		return fmt.Errorf("ovs install acl flows of endpoint %s failed: %v", ep.id[0:7], err)
+	}
+	return nil
+}
+
+// removeACL removes the acl flows of the endpoint
+func (d *Driver) removeACL(n *network, ep *endpoint) error {
+	if !n.hasACL(ep) {
+		return nil
+	}
+	if err := delFlowsByCookie(n.bridge, flowCookie(ep.id, aclCookie)); err != nil {
+		return fmt.Errorf("ovs delete acl flows of endpoint %s failed: %v", ep.id[0:7], err)
+	}
+	return nil
+}
+
+// setContainerACL sets the rules of the acl label of the endpoint container
+// and reinstalls the flows when they changed
+func (d *Driver) setContainerACL(n *network, ep *endpoint, labels map[string]string) error {
+	acl := labels[aclLabel]
+	if _, err := parseACL(acl); err != nil {
+		return fmt.Errorf("invalid %s label of container %s: %v", aclLabel, ep.containerID, err)
+	}
+	n.Lock()
+	old := ep.acl
+	ep.acl = acl
+	n.Unlock()
+	if old == acl {
+		return nil
+	}
+	return d.installACL(n, ep)
+}
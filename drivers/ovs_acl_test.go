@@ -0,0 +1,109 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseACL(t *testing.T) {
+	rules, err := parseACL("allow,proto=tcp,port=80; deny,cidr=10.2.0.0/16;allow,network=ba98")
+	assert.Nil(t, err)
+	if assert.Len(t, rules, 3) {
+		assert.Equal(t, aclRule{action: aclAllow, proto: "tcp", port: 80}, rules[0])
+		assert.Equal(t, "10.2.0.0/16", rules[1].cidr.String())
+		assert.Equal(t, "ba98", rules[2].network)
+	}
+
+	rules, err = parseACL("")
+	assert.Nil(t, err)
+	assert.Len(t, rules, 0)
+
+	for _, acl := range []string{
+		"permit",
+		"allow,port=80",
+		"allow,proto=icmp,port=80",
+		"allow,proto=gre",
+		"allow,port=0,proto=tcp",
+		"deny,cidr=10.0.0.0",
+		"deny,cidr=10.0.0.0/8,network=ba98",
+		"deny,vlan=10",
+		"deny,proto",
+	} {
+		_, err := parseACL(acl)
+		assert.NotNil(t, err, acl)
+	}
+}
+
+func TestACLFlows(t *testing.T) {
+	d, n, _ := newTestEndpointDriver()
+	src := &network{id: "dc0123456789", endpoints: endpointTable{}}
+	src.addSubnet("10.3.0.0/24", "")
+	src.addSubnet("fd00:3::/64", "")
+	d.networks[src.id] = src
+
+	ep := &endpoint{id: "0000000000001", nid: n.id, acl: "allow,proto=tcp,port=80"}
+	ep.mac, _ = net.ParseMAC("02:42:0a:01:00:05")
+	ep.addr, _ = netutils.ParseCIDR("10.1.0.5/24")
+	ep.addrv6, _ = netutils.ParseCIDR("fd00:1::5/64")
+	n.acl = "allow,network=dc01;deny,cidr=10.0.0.0/8"
+	n.aclDefault = aclDeny
+
+	flows, err := d.aclFlows(n, ep)
+	assert.Nil(t, err)
+	cookie := fmt.Sprintf("cookie=%#x", flowCookie(ep.id, aclCookie))
+	assert.Equal(t, []string{
+		cookie + ",table=1,priority=30000,tcp,dl_dst=02:42:0a:01:00:05,nw_dst=10.1.0.5,tp_dst=80,actions=NORMAL",
+		cookie + ",table=1,priority=29999,ip,dl_dst=02:42:0a:01:00:05,nw_dst=10.1.0.5,nw_src=10.3.0.0/24,actions=NORMAL",
+		cookie + ",table=1,priority=29998,ip,dl_dst=02:42:0a:01:00:05,nw_dst=10.1.0.5,nw_src=10.0.0.0/8,actions=drop",
+		cookie + ",table=1,priority=20000,ip,dl_dst=02:42:0a:01:00:05,nw_dst=10.1.0.5,actions=drop",
+		cookie + ",table=1,priority=30000,tcp6,dl_dst=02:42:0a:01:00:05,ipv6_dst=fd00:1::5,tp_dst=80,actions=NORMAL",
+		cookie + ",table=1,priority=29999,ipv6,dl_dst=02:42:0a:01:00:05,ipv6_dst=fd00:1::5,ipv6_src=fd00:3::/64,actions=NORMAL",
+		cookie + ",table=1,priority=20000,ipv6,dl_dst=02:42:0a:01:00:05,ipv6_dst=fd00:1::5,actions=drop",
+	}, flows)
+
+	n.acl, n.aclDefault, ep.acl = "", aclAllow, ""
+	flows, err = d.aclFlows(n, ep)
+	assert.Nil(t, err)
+	assert.Len(t, flows, 0)
+	assert.False(t, n.hasACL(ep))
+}
+
+func TestSetContainerACL(t *testing.T) {
+	installed := map[uint64]int{}
+	defer func(add func(string, []string) error, del func(string, uint64) error) {
+		addFlows, delFlowsByCookie = add, del
+	}(addFlows, delFlowsByCookie)
+	addFlows = func(bridge string, flows []string) error {
+		for _, f := range flows {
+			var cookie uint64
+			fmt.Sscanf(f, "cookie=%v", &cookie)
+			installed[cookie]++
+		}
+		return nil
+	}
+	delFlowsByCookie = func(bridge string, cookie uint64) error {
+		delete(installed, cookie)
+		return nil
+	}
+
+	d, n, _ := newTestEndpointDriver()
+	ep := &endpoint{id: "0000000000001", nid: n.id}
+	ep.addr, _ = netutils.ParseCIDR("10.1.0.5/24")
+	cookie := flowCookie(ep.id, aclCookie)
+
+	assert.Nil(t, d.setContainerACL(n, ep, map[string]string{aclLabel: "deny,proto=udp"}))
+	assert.Equal(t, 1, installed[cookie])
+	assert.NotNil(t, d.setContainerACL(n, ep, map[string]string{aclLabel: "deny,proto=gre"}))
+	assert.Equal(t, "deny,proto=udp", ep.acl)
+
+	// removing the label removes the flows
+	assert.Nil(t, d.setContainerACL(n, ep, map[string]string{}))
+	assert.Equal(t, 0, installed[cookie])
+	// and keeps the pipeline
+	assert.Equal(t, 2, installed[flowCookie(n.bridge, pipelineCookie)])
+	assert.Nil(t, d.removeACL(n, ep))
+}
@@ -0,0 +1,472 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	adminNetworksPath  = "/networks"
+	adminEndpointsPath = "/endpoints"
+	adminOvsdbPath     = "/ovsdb"
+	adminMirrorsPath   = "/mirrors"
+	adminIpamPath      = "/ipam"
+
+	// adminBondStatusQuery asks the network listing for the bond/show
+	// status of the bonds, which runs ovs-appctl once per bond
+	adminBondStatusQuery = "bond_status"
+)
+
+// NetworkInfo describes a network in the admin api
+type NetworkInfo struct {
+	ID        string
+	Bridge    string
+	Vlan      int
+	Bandwidth int
+	Brust     int
+	Encap     string
+	VNI       int
+	Attach    string
+	Parent    string
+	MacMode   string
+	Bond      *BondInfo
+	Internal  bool
+	Subnets   []SubnetInfo
+	Endpoints int
+}
+
+// BondInfo describes the bond uplink of a network, Status is the output of
+// ovs-appctl bond/show or Error why it failed
+type BondInfo struct {
+	Name       string
+	Interfaces []string
+	Mode       string
+	LACP       string
+	Status     string
+	Error      string
+}
+
+// SubnetInfo describes a pool of a network and its gateway
+type SubnetInfo struct {
+	Subnet  string
+	Gateway string
+}
+
+// EndpointInfo describes an endpoint in the admin api
+type EndpointInfo struct {
+	ID            string
+	NetworkID     string
+	ContainerID   string
+	InterfaceName string
+	OvsPortName   string
+	Attach        string
+	MacAddress    string
+	Address       string
+	AddressIPv6   string
+}
+
+// OvsdbInfo is the ovsdb connection and the cached rows of the tables used
+// by the driver, by uuid
+type OvsdbInfo struct {
+	Status OvsdbStatus
+	Tables map[string]map[string]map[string]interface{}
+}
+
+// adminError is the body of failed admin requests, like plugin responses
+type adminError struct {
+	Err string
+}
+
+// startAdmin serves the admin api on a unix socket
+func (d *Driver) startAdmin(sockPath string) error {
+	if err := os.MkdirAll(filepath.Dir(sockPath), 0755); err != nil {
+		return fmt.Errorf("failed to create admin socket directory: %v", err)
+	}
+	if err := os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove admin socket %s: %v", sockPath, err)
+	}
+	l, err := net.Listen(unixProto, sockPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin socket %s: %v", sockPath, err)
+	}
+	if err := os.Chmod(sockPath, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to set mode of admin socket %s: %v", sockPath, err)
+	}
+	logrus.Infof("Serving ovs driver admin api on %s", sockPath)
+	go func() {
+		if err := http.Serve(l, d.adminHandler()); err != nil {
+			logrus.Errorf("Error serving admin api. Err: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (d *Driver) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminNetworksPath, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminResponse(w, r, d.NetworkInfos(r.URL.Query().Get(adminBondStatusQuery) == "true"), nil)
+	})
+	mux.HandleFunc(adminNetworksPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminNetworksPath+"/"), "/")
+		switch {
+		case len(parts) == 1:
+			info, err := d.NetworkInfo(parts[0])
+			writeAdminResponse(w, r, info, err)
+		case len(parts) == 2 && parts[1] == "endpoints":
+			infos, err := d.EndpointInfos(parts[0])
+			writeAdminResponse(w, r, infos, err)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc(adminEndpointsPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		info, err := d.EndpointInfoByID(strings.TrimPrefix(r.URL.Path, adminEndpointsPath+"/"))
+		writeAdminResponse(w, r, info, err)
+	})
+	mux.HandleFunc(adminOvsdbPath, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminResponse(w, r, d.OvsdbInfo(), nil)
+	})
+	mux.HandleFunc(adminIpamPath, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminResponse(w, r, d.ipam.PoolInfos(), nil)
+	})
+	mux.HandleFunc(adminMirrorsPath, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeAdminJSON(w, http.StatusOK, d.MirrorInfos())
+		case "POST":
+			req := &MirrorRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				writeAdminJSON(w, http.StatusBadRequest, adminError{Err: fmt.Sprintf("invalid mirror request: %v", err)})
+				return
+			}
+			info, err := d.CreateMirror(req)
+			if err != nil {
+				writeAdminJSON(w, http.StatusBadRequest, adminError{Err: err.Error()})
+				return
+			}
+			writeAdminJSON(w, http.StatusCreated, info)
+		default:
+			writeAdminJSON(w, http.StatusMethodNotAllowed, adminError{Err: "mirrors can only be listed or created"})
+		}
+	})
+	mux.HandleFunc(adminMirrorsPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			writeAdminJSON(w, http.StatusMethodNotAllowed, adminError{Err: "a mirror can only be deleted"})
+			return
+		}
+		if err := d.DeleteMirror(strings.TrimPrefix(r.URL.Path, adminMirrorsPath+"/")); err != nil {
+			writeAdminJSON(w, http.StatusNotFound, adminError{Err: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// writeAdminResponse answers the read-only requests
+func writeAdminResponse(w http.ResponseWriter, r *http.Request, res interface{}, err error) {
+	if r.Method != "GET" {
+		writeAdminJSON(w, http.StatusMethodNotAllowed, adminError{Err: "resource is read-only"})
+		return
+	}
+	if err != nil {
+		writeAdminJSON(w, http.StatusNotFound, adminError{Err: err.Error()})
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, res)
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, res interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
+// NetworkInfos lists the networks sorted by id, with the bond/show status
+// of their bonds if bondStatus is set
+func (d *Driver) NetworkInfos(bondStatus bool) []NetworkInfo {
+	infos := []NetworkInfo{}
+	for _, n := range d.getNetworks() {
+		info := n.info()
+		info.Bond = n.bondInfo(bondStatus)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// NetworkInfo returns the network with the id or a unique id prefix
+func (d *Driver) NetworkInfo(nid string) (*NetworkInfo, error) {
+	n, err := d.findNetwork(nid)
+	if err != nil {
+		return nil, err
+	}
+	info := n.info()
+	info.Bond = n.bondInfo(true)
+	return &info, nil
+}
+
+// EndpointInfos lists the endpoints of the network sorted by id
+func (d *Driver) EndpointInfos(nid string) ([]EndpointInfo, error) {
+	n, err := d.findNetwork(nid)
+	if err != nil {
+		return nil, err
+	}
+	infos := []EndpointInfo{}
+	n.Lock()
+	for _, ep := range n.endpoints {
+		infos = append(infos, ep.info())
+	}
+	n.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
+
+// EndpointInfoByID returns the endpoint with the id or a unique id prefix
+// in any network
+func (d *Driver) EndpointInfoByID(eid string) (*EndpointInfo, error) {
+	n, ep, err := d.findEndpoint(eid)
+	if err != nil {
+		return nil, err
+	}
+	n.Lock()
+	info := ep.info()
+	n.Unlock()
+	return &info, nil
+}
+
+// OvsdbInfo returns the ovsdb connection and the cached bridge, port and
+// interface rows
+func (d *Driver) OvsdbInfo() *OvsdbInfo {
+	info := &OvsdbInfo{
+		Status: d.ovsdb.Status(),
+		Tables: map[string]map[string]map[string]interface{}{},
+	}
+	for _, table := range []string{bridgeTable, portTable, intfTable} {
+		info.Tables[table] = d.ovsdb.Rows(table)
+	}
+	return info
+}
+
+// findNetwork returns the network with the id or a unique id prefix
+func (d *Driver) findNetwork(nid string) (*network, error) {
+	var found []*network
+	for _, n := range d.getNetworks() {
+		if n.id == nid {
+			return n, nil
+		}
+		if nid != "" && strings.HasPrefix(n.id, nid) {
+			found = append(found, n)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("network %q not found", nid)
+	case 1:
+		return found[0], nil
+	}
+	return nil, fmt.Errorf("network id %q is ambiguous", nid)
+}
+
+// findEndpoint returns the endpoint with the id or a unique id prefix and
+// its network
+func (d *Driver) findEndpoint(eid string) (*network, *endpoint, error) {
+	var (
+		found   []*endpoint
+		network *network
+	)
+	for _, n := range d.getNetworks() {
+		n.Lock()
+		for id, ep := range n.endpoints {
+			if eid != "" && strings.HasPrefix(id, eid) {
+				found = append(found, ep)
+				network = n
+			}
+		}
+		n.Unlock()
+	}
+	switch len(found) {
+	case 0:
+		return nil, nil, fmt.Errorf("endpoint %q not found", eid)
+	case 1:
+		return network, found[0], nil
+	}
+	return nil, nil, fmt.Errorf("endpoint id %q is ambiguous", eid)
+}
+
+func (n *network) info() NetworkInfo {
+	n.Lock()
+	defer n.Unlock()
+	info := NetworkInfo{
+		ID:        n.id,
+		Bridge:    n.bridge,
+		Vlan:      n.vlan,
+		Bandwidth: n.bandwidth,
+		Brust:     n.brust,
+		Encap:     n.encap,
+		VNI:       n.vni,
+		Attach:    n.attach,
+		Parent:    n.parent,
+		MacMode:   n.macMode,
+		Internal:  n.internal,
+		Subnets:   []SubnetInfo{},
+		Endpoints: len(n.endpoints),
+	}
+	for _, s := range n.subnets {
+		si := SubnetInfo{Subnet: s.subnetIP.String()}
+		if s.gwIP != nil {
+			si.Gateway = s.gwIP.String()
+		}
+		info.Subnets = append(info.Subnets, si)
+	}
+	return info
+}
+
+// info must be called with the network lock held, the container lookup of
+// Join updates the endpoint under it
+func (ep *endpoint) info() EndpointInfo {
+	info := EndpointInfo{
+		ID:            ep.id,
+		NetworkID:     ep.nid,
+		ContainerID:   ep.containerID,
+		InterfaceName: ep.intfName,
+		OvsPortName:   ep.ovsPortName(),
+		Attach:        ep.attach,
+	}
+	if len(ep.mac) != 0 {
+		info.MacAddress = ep.mac.String()
+	}
+	if ep.addr != nil {
+		info.Address = ep.addr.String()
+	}
+	if ep.addrv6 != nil {
+		info.AddressIPv6 = ep.addrv6.String()
+	}
+	return info
+}
+
+// AdminClient queries the admin api of a running plugin
+type AdminClient struct {
+	client *http.Client
+}
+
+// NewAdminClient returns a client of the admin api listening on sockPath
+func NewAdminClient(sockPath string) *AdminClient {
+	return &AdminClient{client: &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial(unixProto, sockPath)
+			},
+		},
+	}}
+}
+
+// Networks lists the networks of the plugin, with the bond/show status of
+// their bonds if bondStatus is set
+func (c *AdminClient) Networks(bondStatus bool) ([]NetworkInfo, error) {
+	var infos []NetworkInfo
+	path := adminNetworksPath
+	if bondStatus {
+		path += "?" + adminBondStatusQuery + "=true"
+	}
+	err := c.get(path, &infos)
+	return infos, err
+}
+
+// Endpoints lists the endpoints of a network
+func (c *AdminClient) Endpoints(nid string) ([]EndpointInfo, error) {
+	var infos []EndpointInfo
+	err := c.get(adminNetworksPath+"/"+url.PathEscape(nid)+"/endpoints", &infos)
+	return infos, err
+}
+
+// Endpoint returns an endpoint of any network
+func (c *AdminClient) Endpoint(eid string) (*EndpointInfo, error) {
+	info := &EndpointInfo{}
+	if err := c.get(adminEndpointsPath+"/"+url.PathEscape(eid), info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Ovsdb returns the ovsdb connection and cached rows of the plugin
+func (c *AdminClient) Ovsdb() (*OvsdbInfo, error) {
+	info := &OvsdbInfo{}
+	if err := c.get(adminOvsdbPath, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// IpamPools lists the pools of the ipam driver with their addresses
+func (c *AdminClient) IpamPools() ([]IpamPoolInfo, error) {
+	var infos []IpamPoolInfo
+	err := c.get(adminIpamPath, &infos)
+	return infos, err
+}
+
+// Mirrors lists the mirrors created by the plugin
+func (c *AdminClient) Mirrors() ([]MirrorInfo, error) {
+	var infos []MirrorInfo
+	err := c.get(adminMirrorsPath, &infos)
+	return infos, err
+}
+
+// CreateMirror creates a mirror
+func (c *AdminClient) CreateMirror(r *MirrorRequest) (*MirrorInfo, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	info := &MirrorInfo{}
+	if err := c.do("POST", adminMirrorsPath, bytes.NewReader(body), info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// DeleteMirror deletes a mirror created by the plugin
+func (c *AdminClient) DeleteMirror(name string) error {
+	return c.do("DELETE", adminMirrorsPath+"/"+url.PathEscape(name), nil, nil)
+}
+
+func (c *AdminClient) get(path string, v interface{}) error {
+	return c.do("GET", path, nil, v)
+}
+
+func (c *AdminClient) do(method, path string, body io.Reader, v interface{}) error {
+	// the host is ignored by the unix socket dialer
+	req, err := http.NewRequest(method, "http://ovs-driver"+path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to query ovs driver admin api: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		apiErr := adminError{}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Err == "" {
+			return fmt.Errorf("ovs driver admin api returned %s", resp.Status)
+		}
+		return errors.New(apiErr.Err)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
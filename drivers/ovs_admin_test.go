@@ -0,0 +1,143 @@
+package drivers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+	"github.com/socketplane/libovsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminHandler(t *testing.T) {
+	d, n, _ := newTestEndpointDriver()
+	ports := map[libovsdb.UUID]libovsdb.Row{
+		{GoUUID: "1"}: {Fields: map[string]interface{}{"name": "vport0000001", "tag": float64(10)}},
+	}
+	d.ovsdb = &OvsdbDriver{cache: map[string]map[libovsdb.UUID]libovsdb.Row{portTable: ports}}
+	ep := &endpoint{id: "0000000000001", nid: n.id, intfName: "port0000001", attach: attachVeth, mac: netutils.GenerateMACFromIP(nil)}
+	ep.addr, _ = netutils.ParseCIDR("10.1.0.5/24")
+	n.endpoints[ep.id] = ep
+	h := d.adminHandler()
+
+	get := func(path string, v interface{}) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), v), path)
+		return w.Code
+	}
+
+	var networks []NetworkInfo
+	assert.Equal(t, http.StatusOK, get("/networks", &networks))
+	if assert.Len(t, networks, 1) {
+		assert.Equal(t, n.id, networks[0].ID)
+		assert.Equal(t, []SubnetInfo{{Subnet: "10.1.0.0/24", Gateway: "10.1.0.1/24"}}, networks[0].Subnets)
+		assert.Equal(t, 1, networks[0].Endpoints)
+	}
+
+	var endpoints []EndpointInfo
+	assert.Equal(t, http.StatusOK, get("/networks/ba98/endpoints", &endpoints))
+	if assert.Len(t, endpoints, 1) {
+		assert.Equal(t, "vport0000001", endpoints[0].OvsPortName)
+		assert.Equal(t, "10.1.0.5/24", endpoints[0].Address)
+		assert.Equal(t, ep.mac.String(), endpoints[0].MacAddress)
+	}
+
+	var info EndpointInfo
+	assert.Equal(t, http.StatusOK, get("/endpoints/00000", &info))
+	assert.Equal(t, ep.id, info.ID)
+
+	var apiErr adminError
+	assert.Equal(t, http.StatusNotFound, get("/endpoints/ffff", &apiErr))
+	assert.Contains(t, apiErr.Err, "not found")
+
+	var ovsdb map[string]interface{}
+	assert.Equal(t, http.StatusOK, get("/ovsdb", &ovsdb))
+	tables := ovsdb["Tables"].(map[string]interface{})
+	assert.Len(t, tables[portTable], 1)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/networks", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestAdminClient(t *testing.T) {
+	d, n, _ := newTestEndpointDriver()
+	d.ovsdb = &OvsdbDriver{cache: map[string]map[libovsdb.UUID]libovsdb.Row{}}
+	ep := &endpoint{id: "0000000000001", nid: n.id, intfName: "port0000001", attach: attachInternal}
+	n.endpoints[ep.id] = ep
+
+	dir, err := ioutil.TempDir("", "ovs-driver")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "admin", "admin.sock")
+	assert.Nil(t, d.startAdmin(sockPath))
+
+	c := NewAdminClient(sockPath)
+	networks, err := c.Networks(false)
+	assert.Nil(t, err)
+	assert.Len(t, networks, 1)
+	info, err := c.Endpoint("0000")
+	assert.Nil(t, err)
+	assert.Equal(t, "port0000001", info.OvsPortName)
+	_, err = c.Endpoints("ffff")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not found")
+}
+
+func TestEndpointInfoDuringContainerLookup(t *testing.T) {
+	d, n, _ := newTestEndpointDriver()
+	ep := &endpoint{id: "0000000000001", nid: n.id, intfName: "port0000001", attach: attachVeth}
+	n.endpoints[ep.id] = ep
+
+	// like the container lookup of Join, run with -race
+	done := make(chan struct{})
+	go func() {
+		n.Lock()
+		ep.containerID = "c0ffee"
+		n.Unlock()
+		close(done)
+	}()
+	info, err := d.EndpointInfoByID(ep.id)
+	assert.Nil(t, err)
+	<-done
+	info, err = d.EndpointInfoByID(ep.id)
+	assert.Nil(t, err)
+	assert.Equal(t, "c0ffee", info.ContainerID)
+}
+
+func TestAdminNetworksBondStatus(t *testing.T) {
+	defer func(f func(string) (string, error)) { bondShow = f }(bondShow)
+	shows := 0
+	bondShow = func(port string) (string, error) {
+		shows++
+		return "---- bond0 ----", nil
+	}
+	d, n, _ := newTestEndpointDriver()
+	n.bond = "bond0"
+	h := d.adminHandler()
+	get := func(path string, v interface{}) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), v), path)
+	}
+
+	var networks []NetworkInfo
+	get("/networks", &networks)
+	assert.Equal(t, 0, shows)
+	if assert.Len(t, networks, 1) && assert.NotNil(t, networks[0].Bond) {
+		assert.Equal(t, "", networks[0].Bond.Status)
+	}
+	get("/networks?bond_status=true", &networks)
+	assert.Equal(t, 1, shows)
+	assert.Equal(t, "---- bond0 ----", networks[0].Bond.Status)
+
+	var info NetworkInfo
+	get("/networks/ba98", &info)
+	assert.Equal(t, 2, shows)
+}
@@ -0,0 +1,165 @@
+package drivers
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/XiaoweiQian/ovs-driver/utils/appctl"
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+)
+
+const (
+	bondOption           = "bond"
+	bondInterfacesOption = "bond_interfaces"
+	bondModeOption       = "bond_mode"
+	lacpOption           = "lacp"
+
+	bondActiveBackup = "active-backup"
+	bondBalanceSLB   = "balance-slb"
+	bondBalanceTCP   = "balance-tcp"
+
+	lacpActive  = "active"
+	lacpPassive = "passive"
+	lacpOff     = "off"
+)
+
+// bondShow returns the bond/show status of a bond port, replaced in tests
+var bondShow = appctl.BondShow
+
+// getBond returns the name and options of the bond uplink of the network,
+// an empty name if it has none
+func getBond(opts map[string]string) (string, BondOptions, error) {
+	name := opts[bondOption]
+	bond := BondOptions{Mode: opts[bondModeOption], LACP: opts[lacpOption]}
+	for _, intf := range strings.Split(opts[bondInterfacesOption], ",") {
+		if intf = strings.TrimSpace(intf); intf != "" {
+			bond.Interfaces = append(bond.Interfaces, intf)
+		}
+	}
+	if name == "" {
+		if len(bond.Interfaces) != 0 || bond.Mode != "" || bond.LACP != "" {
+			return "", BondOptions{}, fmt.Errorf("%s, %s and %s options need the %s option", bondInterfacesOption, bondModeOption, lacpOption, bondOption)
+		}
+		return "", BondOptions{}, nil
+	}
+	if len(name) > maxPortNameLen {
+		return "", BondOptions{}, fmt.Errorf("invalid %s option %q, longer than %d characters", bondOption, name, maxPortNameLen)
+	}
+	if len(bond.Interfaces) < 2 {
+		return "", BondOptions{}, fmt.Errorf("invalid %s option %q, a bond needs at least two interfaces", bondInterfacesOption, opts[bondInterfacesOption])
+	}
+	seen := map[string]bool{}
+	for _, intf := range bond.Interfaces {
+		if intf == name || seen[intf] {
+			return "", BondOptions{}, fmt.Errorf("invalid %s option, interface %s is used twice", bondInterfacesOption, intf)
+		}
+		seen[intf] = true
+	}
+	switch bond.Mode {
+	case "":
+		bond.Mode = bondActiveBackup
+	case bondActiveBackup, bondBalanceSLB, bondBalanceTCP:
+	default:
+		return "", BondOptions{}, fmt.Errorf("invalid %s option %q, must be %s, %s or %s", bondModeOption, bond.Mode, bondActiveBackup, bondBalanceSLB, bondBalanceTCP)
+	}
+	switch bond.LACP {
+	case "":
+		bond.LACP = lacpOff
+	case lacpActive, lacpPassive, lacpOff:
+	default:
+		return "", BondOptions{}, fmt.Errorf("invalid %s option %q, must be %s, %s or %s", lacpOption, bond.LACP, lacpActive, lacpPassive, lacpOff)
+	}
+	if bond.Mode == bondBalanceTCP && bond.LACP == lacpOff {
+		return "", BondOptions{}, fmt.Errorf("%s option %s needs lacp %s or %s", bondModeOption, bondBalanceTCP, lacpActive, lacpPassive)
+	}
+	return name, bond, nil
+}
+
+// getBondUser returns another network attached to the same bond
+func (d *Driver) getBondUser(n *network) *network {
+	d.Lock()
+	defer d.Unlock()
+	for _, other := range d.networks {
+		if other.id != n.id && other.bridge == n.bridge && other.bond == n.bond {
+			return other
+		}
+	}
+	return nil
+}
+
+// addBond attaches the bond uplink of the network to its bridge as a trunk
+// port. Later networks using the bond share it and must use the same
+// settings.
+func (d *Driver) addBond(n *network) error {
+	if n.bond == "" {
+		return nil
+	}
+	if other := d.getBondUser(n); other != nil {
+		if !reflect.DeepEqual(other.bondOpts, n.bondOpts) {
+			return fmt.Errorf("bond %s is attached to bridge %s with other settings by network %s", n.bond, n.bridge, other.id)
+		}
+		n.bondAttached = other.bondAttached
+		return nil
+	}
+	for _, intf := range n.bondOpts.Interfaces {
+		if !netutils.LinkExists(intf) {
+			return fmt.Errorf("bond interface %s does not exist", intf)
+		}
+		if err := netutils.SetLinkUp(intf); err != nil {
+			return err
+		}
+	}
+	if br := d.ovsdb.PortBridge(n.bond); br != "" {
+		if br != n.bridge {
+			return fmt.Errorf("bond %s of network %s is attached to bridge %s instead of %s", n.bond, n.id, br, n.bridge)
+		}
+		logrus.Debugf("ovs bond port %s already attached", n.bond)
+		return nil
+	}
+	if err := d.ovsdb.AddBond(n.bridge, n.bond, n.bondOpts); err != nil {
+		return fmt.Errorf("ovs attach bond %s failed for network %s: %v", n.bond, n.id, err)
+	}
+	n.bondAttached = true
+	return nil
+}
+
+// deleteBond detaches the bond once no other network uses it, ovsdb
+// deletes its interfaces with the port
+func (d *Driver) deleteBond(n *network) {
+	if n.bond == "" || !n.bondAttached || d.getBondUser(n) != nil {
+		return
+	}
+	logrus.Debugf("ovs detach bond port=%s from bridge=%s", n.bond, n.bridge)
+	if err := d.ovsdb.DelPort(n.bond); err != nil {
+		logrus.Errorf("Error detaching bond %s of network %s. Err: %v", n.bond, n.id, err)
+	}
+}
+
+// bondInfo describes the bond of the network from the cached options, with
+// its bond/show status if status is set
+func (n *network) bondInfo(status bool) *BondInfo {
+	n.Lock()
+	info := &BondInfo{
+		Name:       n.bond,
+		Interfaces: n.bondOpts.Interfaces,
+		Mode:       n.bondOpts.Mode,
+		LACP:       n.bondOpts.LACP,
+	}
+	n.Unlock()
+	if info.Name == "" {
+		return nil
+	}
+	if !status {
+		return info
+	}
+	out, err := bondShow(info.Name)
+	if err != nil {
+		logrus.Debugf("Failed to show ovs bond %s: %v", info.Name, err)
+		info.Error = err.Error()
+		return info
+	}
+	info.Status = out
+	return info
+}
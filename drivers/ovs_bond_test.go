@@ -0,0 +1,103 @@
+package drivers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/socketplane/libovsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBond(t *testing.T) {
+	name, bond, err := getBond(map[string]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, "", name)
+
+	name, bond, err = getBond(map[string]string{bondOption: "bond0", bondInterfacesOption: "eth1, eth2"})
+	assert.Nil(t, err)
+	assert.Equal(t, "bond0", name)
+	assert.Equal(t, BondOptions{Interfaces: []string{"eth1", "eth2"}, Mode: bondActiveBackup, LACP: lacpOff}, bond)
+
+	_, bond, err = getBond(map[string]string{bondOption: "bond0", bondInterfacesOption: "eth1,eth2", bondModeOption: bondBalanceTCP, lacpOption: lacpActive})
+	assert.Nil(t, err)
+	assert.Equal(t, bondBalanceTCP, bond.Mode)
+	assert.Equal(t, lacpActive, bond.LACP)
+
+	for _, opts := range []map[string]string{
+		{bondInterfacesOption: "eth1,eth2"},
+		{bondOption: "bond0", bondInterfacesOption: "eth1"},
+		{bondOption: "bond0", bondInterfacesOption: "eth1,eth1"},
+		{bondOption: "bond0-too-long-name", bondInterfacesOption: "eth1,eth2"},
+		{bondOption: "bond0", bondInterfacesOption: "eth1,eth2", bondModeOption: "balance-rr"},
+		{bondOption: "bond0", bondInterfacesOption: "eth1,eth2", lacpOption: "fast"},
+		{bondOption: "bond0", bondInterfacesOption: "eth1,eth2", bondModeOption: bondBalanceTCP},
+	} {
+		_, _, err := getBond(opts)
+		assert.NotNil(t, err, opts[bondOption]+" "+opts[bondInterfacesOption])
+	}
+
+	n := &network{id: "ba9876543210"}
+	err = n.parseOptions(map[string]string{bridgeOption: ovsBridgeName, parentOption: "eth0", bondOption: "bond0", bondInterfacesOption: "eth1,eth2"})
+	assert.NotNil(t, err)
+}
+
+func TestBondOperations(t *testing.T) {
+	d := &OvsdbDriver{cache: map[string]map[libovsdb.UUID]libovsdb.Row{
+		bridgeTable: {{GoUUID: "b1"}: {Fields: map[string]interface{}{"name": ovsBridgeName}}},
+	}}
+	opts := BondOptions{Interfaces: []string{"eth1", "eth2"}, Mode: bondBalanceSLB, LACP: lacpOff}
+	ops, err := d.bondOperations(ovsBridgeName, "bond0", opts)
+	assert.Nil(t, err)
+	if assert.Len(t, ops, 4) {
+		assert.Equal(t, intfTable, ops[0].Table)
+		assert.Equal(t, "eth1", ops[0].Row["name"])
+		assert.Equal(t, "eth2", ops[1].Row["name"])
+		assert.Equal(t, portTable, ops[2].Table)
+		intfs, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUUID: "intf0"}, {GoUUID: "intf1"}})
+		assert.Equal(t, intfs, ops[2].Row["interfaces"])
+		assert.Equal(t, bondBalanceSLB, ops[2].Row["bond_mode"])
+		assert.Equal(t, lacpOff, ops[2].Row["lacp"])
+		assert.Equal(t, bridgeTable, ops[3].Table)
+	}
+
+	_, err = d.bondOperations("ovs-br1", "bond0", opts)
+	assert.NotNil(t, err)
+	_, err = d.bondOperations(ovsBridgeName, "bond0", BondOptions{Interfaces: []string{"eth1"}})
+	assert.NotNil(t, err)
+}
+
+func TestBondInfo(t *testing.T) {
+	defer func(f func(string) (string, error)) { bondShow = f }(bondShow)
+	shown := ""
+	bondShow = func(port string) (string, error) {
+		shown = port
+		return "---- bond0 ----\nbond_mode: active-backup\n", nil
+	}
+
+	n := &network{id: "ba9876543210"}
+	assert.Nil(t, n.bondInfo(true))
+	assert.Equal(t, "", shown)
+
+	n.bond = "bond0"
+	n.bondOpts = BondOptions{Interfaces: []string{"eth1", "eth2"}, Mode: bondActiveBackup, LACP: lacpOff}
+	// the listing sticks to the cached options
+	info := n.bondInfo(false)
+	assert.Equal(t, "", shown)
+	assert.Equal(t, []string{"eth1", "eth2"}, info.Interfaces)
+	assert.Equal(t, "", info.Status)
+
+	info = n.bondInfo(true)
+	assert.Equal(t, "bond0", shown)
+	if assert.NotNil(t, info) {
+		assert.Equal(t, []string{"eth1", "eth2"}, info.Interfaces)
+		assert.Contains(t, info.Status, "bond_mode: active-backup")
+		assert.Equal(t, "", info.Error)
+	}
+
+	bondShow = func(port string) (string, error) {
+		return "no such bond", errors.New("ovs-appctl failed")
+	}
+	info = n.bondInfo(true)
+	assert.Equal(t, "", info.Status)
+	assert.Equal(t, "ovs-appctl failed", info.Error)
+}
@@ -3,7 +3,10 @@ package drivers
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
@@ -18,11 +21,41 @@ type endpoint struct {
 	intfName string
 	mac      net.HardwareAddr
 	addr     *net.IPNet
-	dbExists bool
-	dbIndex  uint64
+	addrv6   *net.IPNet
+	// attach is the attachment mode of the network when the endpoint was created
+	attach string
+	// containerID is looked up in swarm after the join, empty if unknown
+	containerID string
+	// acl holds the rules of the acl label of the container
+	acl string
+	// exposedPorts and portMapping are programmed by ProgramExternalConnectivity
+	exposedPorts []transportPort
+	portMapping  []portBinding
+	// hostPorts hold the allocated host ports of portMapping while the
+	// plugin runs
+	hostPorts []io.Closer
+	dbExists  bool
+	dbIndex   uint64
 }
 
-const ovsEndpointPrefix = "ovs/endpoint"
+const (
+	ovsEndpointPrefix      = "ovs/endpoint"
+	containerLookupRetries = 5
+	containerLookupDelay   = time.Second
+)
+
+// external_ids of the endpoint ovs port and interface, enough to rebuild the
+// endpoint without the local store
+const (
+	extIDNetwork   = "ovs-driver.network-id"
+	extIDEndpoint  = "ovs-driver.endpoint-id"
+	extIDContainer = "ovs-driver.container-id"
+	extIDAddr      = "ovs-driver.ip-address"
+	extIDAddrv6    = "ovs-driver.ipv6-address"
+	extIDAttach    = "ovs-driver.attach"
+	extIDMac       = "attached-mac"
+	extIDIface     = "iface-id"
+)
 
 // CreateEndpoint ...
 func (d *Driver) CreateEndpoint(r *pluginNet.CreateEndpointRequest) (*pluginNet.CreateEndpointResponse, error) {
@@ -43,9 +76,10 @@ func (d *Driver) CreateEndpoint(r *pluginNet.CreateEndpointRequest) (*pluginNet.
 	if !ok {
 		return nil, fmt.Errorf("ovs network with id %s not found", networkID)
 	}
-	_, addr, _ := net.ParseCIDR(intf.Address)
+	addr, _ := netutils.ParseCIDR(intf.Address)
+	addrv6, _ := netutils.ParseCIDR(intf.AddressIPv6)
 	mac, _ := net.ParseMAC(intf.MacAddress)
-	intfName, err := netutils.GenerateIfaceName(intfPrefix, intfLen)
+	intfName, err := netutils.GenerateIfaceName(d.vethPrefix(), intfLen)
 	if err != nil {
 		return nil, fmt.Errorf("ovs generate interface name err=%s", err)
 	}
@@ -54,7 +88,9 @@ func (d *Driver) CreateEndpoint(r *pluginNet.CreateEndpointRequest) (*pluginNet.
 		nid:      networkID,
 		intfName: intfName,
 		addr:     addr,
+		addrv6:   addrv6,
 		mac:      mac,
+		attach:   n.attach,
 	}
 	if ep.addr == nil {
 		return nil, fmt.Errorf("create endpoint was not passed interface IP address")
@@ -64,36 +100,21 @@ func (d *Driver) CreateEndpoint(r *pluginNet.CreateEndpointRequest) (*pluginNet.
 		return nil, fmt.Errorf("no matching subnet for IP %q in network %q", ep.addr, ep.nid)
 	}
 
-	if ep.mac == nil {
-		ep.mac = netutils.GenerateRandomMAC()
-		intf.MacAddress = ep.mac.String()
+	if ep.addrv6 != nil {
+		if s := n.getSubnetforIP(ep.addrv6); s == nil {
+			return nil, fmt.Errorf("no matching subnet for IPv6 %q in network %q", ep.addrv6, ep.nid)
+		}
 	}
 
-	portType := internalPort
-	ovsPortName := intfName
-	if useVeth {
-		portType = vethPort
-		// Get OVS port name
-		ovsPortName = getOvsPortName(intfName)
-		// Create a Veth pair
-		err = netutils.CreateVethPair(intfName, ovsPortName)
-		if err != nil {
-			logrus.Errorf("Error creating veth pairs. Err: %v", err)
+	if ep.mac == nil {
+		if ep.mac, err = n.generateMAC(ep); err != nil {
 			return nil, err
 		}
+		intf.MacAddress = ep.mac.String()
 	}
 
-	logrus.Debugf("ovs create endpoint with addr=%s,mac=%s,intfName=%s,vlan=%d,brust=%d,bandwidth=%d,err=%s", ep.addr.String(), ep.mac.String(), ovsPortName, n.vlan, n.brust, n.bandwidth, err)
-	err = d.ovsdb.AddPort(ovsPortName, portType, n.vlan, n.brust, n.bandwidth)
-	if err != nil {
-		return nil, fmt.Errorf("ovs create endpoint error with addr=%s,mac=%s,intfName=%s,vlan=%d,brust=%d,bandwidth=%d,err=%s", ep.addr.String(), ep.mac.String(), ovsPortName, n.vlan, n.brust, n.bandwidth, err)
-	}
-	n.Lock()
-	n.endpoints[ep.id] = ep
-	n.Unlock()
-
-	if err := d.writeEndpointToStore(ep); err != nil {
-		return nil, fmt.Errorf("failed to update ovs endpoint %s to local store: %v", ep.id[0:7], err)
+	if err := runSteps(d.createEndpointSteps(n, ep)); err != nil {
+		return nil, err
 	}
 	epResponse := &pluginNet.CreateEndpointResponse{Interface: &pluginNet.EndpointInterface{"", "", intf.MacAddress}}
 	return epResponse, nil
@@ -126,26 +147,329 @@ func (d *Driver) DeleteEndpoint(r *pluginNet.DeleteEndpointRequest) error {
 }
 
 func (d *Driver) deleteEndpoint(n *network, ep *endpoint) error {
-	intfName := ep.intfName
-	if intfName == "" {
+	if ep.intfName == "" {
 		return nil
 	}
-	ovsPortName := intfName
-	if useVeth {
-		// Get OVS port name
-		ovsPortName = getOvsPortName(intfName)
-		if err := netutils.DeleteVethPair(intfName, ovsPortName); err != nil {
-			return fmt.Errorf("delete veth pair failed with InterfaceName=%s,peer=%s,err=%s", intfName, ovsPortName, err)
+	return runSteps(d.deleteEndpointSteps(n, ep))
+}
+
+// createEndpointSteps plugs the endpoint into the bridge and persists it
+func (d *Driver) createEndpointSteps(n *network, ep *endpoint) []step {
+	portType := internalPort
+	ovsPortName := ep.ovsPortName()
+	steps := []step{
+		{
+			// the endpoint is added first to hold its mac address
+			name: "add endpoint " + ep.id,
+			do:   func() error { return n.reserveMAC(ep) },
+			undo: func() error {
+				n.Lock()
+				delete(n.endpoints, ep.id)
+				n.Unlock()
+				return nil
+			},
+		},
+	}
+	if ep.attach == attachVeth {
+		portType = vethPort
+		steps = append(steps, step{
+			name: "create veth pair " + ep.intfName,
+			do: func() error {
+				if err := createVethPair(ep.intfName, ovsPortName); err != nil {
+					logrus.Errorf("Error creating veth pairs. Err: %v", err)
+					return err
+				}
+				return nil
+			},
+			undo: func() error { return deleteVethPair(ep.intfName, ovsPortName) },
+		})
+	}
+	return append(steps,
+		step{
+			name: "add ovs port " + ovsPortName,
+			do: func() error {
+				logrus.Debugf("ovs create endpoint on bridge=%s with addr=%s,mac=%s,intfName=%s,vlan=%d,brust=%d,bandwidth=%d", n.bridge, ep.addr.String(), ep.mac.String(), ovsPortName, n.vlan, n.brust, n.bandwidth)
+				if err := addOvsPort(d.ovsdb, n.bridge, ovsPortName, portType, n.vlan, n.brust, n.bandwidth, ep.externalIDs()); err != nil {
+					return fmt.Errorf("ovs create endpoint error with addr=%s,mac=%s,intfName=%s,vlan=%d,brust=%d,bandwidth=%d,err=%s", ep.addr.String(), ep.mac.String(), ovsPortName, n.vlan, n.brust, n.bandwidth, err)
+				}
+				return nil
+			},
+			undo: func() error { return delOvsPort(d.ovsdb, ovsPortName) },
+		},
+		step{
+			name: "install acl flows " + ep.id,
+			do: func() error {
+				if !n.hasACL(ep) {
+					return nil
+				}
+				return d.installACL(n, ep)
+			},
+			undo: func() error { return d.removeACL(n, ep) },
+		},
+		step{
+			name: "write endpoint " + ep.id,
+			do: func() error {
+				if err := d.writeEndpointToStore(ep); err != nil {
+					return fmt.Errorf("failed to update ovs endpoint %s to local store: %v", ep.id[0:7], err)
+				}
+				return nil
+			},
+		},
+	)
+}
+
+// deleteEndpointSteps unplugs the endpoint from the bridge and forgets it
+func (d *Driver) deleteEndpointSteps(n *network, ep *endpoint) []step {
+	ovsPortName := ep.ovsPortName()
+	// Leave normally removed the ovs port already
+	portExisted := false
+	steps := []step{
+		{
+			name: "revoke port mapping " + ep.id,
+			do: func() error {
+				if err := ep.revokePortMapping(); err != nil {
+					logrus.Warnf("Failed to revoke port mapping of ovs endpoint %s: %v", ep.id[0:7], err)
+				}
+				return nil
+			},
+			undo: ep.programPortMapping,
+		},
+		{
+			name: "remove port security flows " + ep.id,
+			do:   func() error { return d.removePortSecurity(n, ep) },
+			undo: func() error {
+				if !n.portSecurity {
+					return nil
+				}
+				if ofport := d.ovsdb.Ofport(ovsPortName); ofport > 0 {
+					return d.installPortSecurity(n, ep, ofport)
+				}
+				return nil
+			},
+		},
+		{
+			name: "remove acl flows " + ep.id,
+			do:   func() error { return d.removeACL(n, ep) },
+			undo: func() error {
+				if !n.hasACL(ep) {
+					return nil
+				}
+				return d.installACL(n, ep)
+			},
+		},
+		{
+			name: "delete ovs port " + ovsPortName,
+			do: func() error {
+				portExisted = ovsPortExists(d.ovsdb, ovsPortName)
+				if !portExisted {
+					return nil
+				}
+				if err := delOvsPort(d.ovsdb, ovsPortName); err != nil {
+					return fmt.Errorf("ovs delete endpoint port failed with name=%s,err=%s", ovsPortName, err)
+				}
+				return nil
+			},
+			undo: func() error {
+				if !portExisted {
+					return nil
+				}
+				portType := vethPort
+				if ep.attach == attachInternal {
+					portType = internalPort
+				}
+				return addOvsPort(d.ovsdb, n.bridge, ovsPortName, portType, n.vlan, n.brust, n.bandwidth, ep.externalIDs())
+			},
+		},
+	}
+	if ep.attach == attachVeth {
+		steps = append(steps, step{
+			name: "delete veth pair " + ep.intfName,
+			do: func() error {
+				if err := deleteVethPair(ep.intfName, ovsPortName); err != nil {
+					return fmt.Errorf("delete veth pair failed with InterfaceName=%s,peer=%s,err=%s", ep.intfName, ovsPortName, err)
+				}
+				return nil
+			},
+			undo: func() error { return createVethPair(ep.intfName, ovsPortName) },
+		})
+	}
+	return append(steps,
+		step{
+			name: "delete endpoint " + ep.id,
+			do: func() error {
+				err := d.deleteEndpointFromStore(ep)
+				if err != nil && err != datastore.ErrKeyNotFound {
+					return fmt.Errorf("failed to delete ovs endpoint %s from local store: %v", ep.id[0:7], err)
+				}
+				n.Lock()
+				delete(n.endpoints, ep.id)
+				n.Unlock()
+				return nil
+			},
+		},
+		step{
+			// last as a deleted mirror cannot be restored, the port it
+			// selected is gone already so a leftover one copies nothing
+			name: "delete mirrors of " + ep.id,
+			do: func() error {
+				if err := d.deleteMirrorsOf(extIDMirrorEndpoint, ep.id); err != nil {
+					logrus.Warnf("Failed to delete mirrors of ovs endpoint %s: %v", ep.id[0:7], err)
+				}
+				return nil
+			},
+		},
+	)
+}
+
+// ovsPortName returns the name of the endpoint port on the bridge, the veth
+// peer of the container interface or the internal port itself
+func (ep *endpoint) ovsPortName() string {
+	if ep.attach == attachInternal {
+		return ep.intfName
+	}
+	return getOvsPortName(ep.intfName)
+}
+
+// externalIDs returns the external_ids of the endpoint ovs port
+func (ep *endpoint) externalIDs() map[string]string {
+	ids := map[string]string{
+		extIDNetwork:  ep.nid,
+		extIDEndpoint: ep.id,
+		extIDIface:    ep.id,
+		extIDAttach:   ep.attach,
+	}
+	if ep.containerID != "" {
+		ids[extIDContainer] = ep.containerID
+	}
+	if len(ep.mac) != 0 {
+		ids[extIDMac] = ep.mac.String()
+	}
+	if ep.addr != nil {
+		ids[extIDAddr] = ep.addr.String()
+	}
+	if ep.addrv6 != nil {
+		ids[extIDAddrv6] = ep.addrv6.String()
+	}
+	return ids
+}
+
+// EndpointID returns the endpoint of a port created by the driver, empty for
+// other ports
+func (p PortInfo) EndpointID() string {
+	return p.ExternalIDs[extIDEndpoint]
+}
+
+// ContainerID returns the container of an endpoint port if known
+func (p PortInfo) ContainerID() string {
+	return p.ExternalIDs[extIDContainer]
+}
+
+// endpointFromExternalIDs rebuilds an endpoint from the external_ids of its
+// ovs interface. Port mappings are not kept in ovsdb and are lost.
+func endpointFromExternalIDs(intfName string, ids map[string]string) (*endpoint, error) {
+	var err error
+	ep := &endpoint{
+		id:          ids[extIDEndpoint],
+		nid:         ids[extIDNetwork],
+		containerID: ids[extIDContainer],
+		attach:      ids[extIDAttach],
+	}
+	if ep.id == "" || ep.nid == "" {
+		return nil, fmt.Errorf("ovs interface %s has no endpoint or network id", intfName)
+	}
+	ep.intfName = intfName
+	switch ep.attach {
+	case attachInternal:
+	case "", attachVeth:
+		ep.attach = attachVeth
+		ep.intfName = strings.TrimPrefix(intfName, "v")
+	default:
+		return nil, fmt.Errorf("ovs interface %s has invalid attach mode %q", intfName, ep.attach)
+	}
+	if v, ok := ids[extIDMac]; ok {
+		if ep.mac, err = net.ParseMAC(v); err != nil {
+			return nil, fmt.Errorf("ovs interface %s has invalid mac address %q", intfName, v)
 		}
 	}
-	n.Lock()
-	delete(n.endpoints, ep.id)
-	n.Unlock()
+	if ep.addr, err = netutils.ParseCIDR(ids[extIDAddr]); err != nil {
+		return nil, fmt.Errorf("ovs interface %s has invalid ip address: %v", intfName, err)
+	}
+	if v, ok := ids[extIDAddrv6]; ok {
+		if ep.addrv6, err = netutils.ParseCIDR(v); err != nil {
+			return nil, fmt.Errorf("ovs interface %s has invalid ipv6 address: %v", intfName, err)
+		}
+	}
+	return ep, nil
+}
 
-	if err := d.deleteEndpointFromStore(ep); err != nil {
-		logrus.Debugf("Failed to delete ovs endpoint %s from local store: %v", ep.id[0:7], err)
+// restoreEndpointsFromOvsdb rebuilds the endpoints missing from the local
+// store, like after the store file was lost, from the ovs external_ids
+func (d *Driver) restoreEndpointsFromOvsdb() {
+	for intfName, ids := range d.ovsdb.InterfaceExternalIDs(extIDEndpoint) {
+		ep, err := endpointFromExternalIDs(intfName, ids)
+		if err != nil {
+			logrus.Warnf("Failed to restore ovs endpoint from ovsdb: %v", err)
+			continue
+		}
+		n := d.network(ep.nid)
+		if n == nil {
+			logrus.Debugf("Network (%s) not found for ovs interface %s", ep.nid[0:7], intfName)
+			continue
+		}
+		if n.endpoint(ep.id) != nil {
+			continue
+		}
+		n.Lock()
+		n.endpoints[ep.id] = ep
+		n.Unlock()
+		if err := d.writeEndpointToStore(ep); err != nil {
+			logrus.Warnf("Failed to write ovs endpoint %s restored from ovsdb to local store: %v", ep.id[0:7], err)
+		}
+		logrus.Infof("Restored ovs endpoint %s from ovsdb interface %s", ep.id[0:7], intfName)
 	}
-	return nil
+}
+
+// tagEndpointContainer looks up the container of the endpoint in swarm, adds
+// it to the external_ids of the ovs port and applies its acl label. Docker lists the container in
+// the network only once the join completed, so the lookup is retried.
+func (d *Driver) tagEndpointContainer(n *network, ep *endpoint) {
+	d.Lock()
+	client := d.client
+	d.Unlock()
+	if client == nil {
+		return
+	}
+	for i := 0; i < containerLookupRetries; i++ {
+		time.Sleep(containerLookupDelay)
+		nw, err := client.NetworkInfo(n.id)
+		if err != nil {
+			logrus.Debugf("Failed to get network %s from swarm: %v", n.id[0:7], err)
+			continue
+		}
+		for cid, cep := range nw.Containers {
+			if cep.ID != ep.id {
+				continue
+			}
+			n.Lock()
+			ep.containerID = cid
+			n.Unlock()
+			if err := d.ovsdb.SetExternalIDs(ep.ovsPortName(), ep.externalIDs()); err != nil {
+				logrus.Warnf("Failed to set container of ovs port %s: %v", ep.ovsPortName(), err)
+			}
+			if c, err := client.InspectContainer(cid); err != nil {
+				logrus.Warnf("Failed to inspect container %s of ovs endpoint %s: %v", cid, ep.id[0:7], err)
+			} else if c.Config != nil {
+				if err := d.setContainerACL(n, ep, c.Config.Labels); err != nil {
+					logrus.Errorf("Error setting acl of ovs endpoint %s. Err: %v", ep.id[0:7], err)
+				}
+			}
+			if err := d.writeEndpointToStore(ep); err != nil {
+				logrus.Warnf("Failed to update ovs endpoint %s to local store: %v", ep.id[0:7], err)
+			}
+			return
+		}
+	}
+	logrus.Debugf("Container of ovs endpoint %s not found in swarm", ep.id[0:7])
 }
 
 // EndpointInfo ...
@@ -242,9 +566,25 @@ func (ep *endpoint) MarshalJSON() ([]byte, error) {
 	if ep.addr != nil {
 		epMap["addr"] = ep.addr.String()
 	}
+	if ep.addrv6 != nil {
+		epMap["addrv6"] = ep.addrv6.String()
+	}
 	if len(ep.mac) != 0 {
 		epMap["mac"] = ep.mac.String()
 	}
+	epMap["attach"] = ep.attach
+	if ep.containerID != "" {
+		epMap["containerID"] = ep.containerID
+	}
+	if ep.acl != "" {
+		epMap["acl"] = ep.acl
+	}
+	if len(ep.exposedPorts) != 0 {
+		epMap["exposedPorts"] = ep.exposedPorts
+	}
+	if len(ep.portMapping) != 0 {
+		epMap["portMapping"] = ep.portMapping
+	}
 
 	return json.Marshal(epMap)
 }
@@ -265,13 +605,39 @@ func (ep *endpoint) UnmarshalJSON(value []byte) error {
 		}
 	}
 	if v, ok := epMap["addr"]; ok {
-		if _, ep.addr, err = net.ParseCIDR(v.(string)); err != nil {
+		if ep.addr, err = netutils.ParseCIDR(v.(string)); err != nil {
 			return fmt.Errorf("failed to decode endpoint interface ipv4 address after json unmarshal: %v", err)
 		}
 	}
+	if v, ok := epMap["addrv6"]; ok {
+		if ep.addrv6, err = netutils.ParseCIDR(v.(string)); err != nil {
+			return fmt.Errorf("failed to decode endpoint interface ipv6 address after json unmarshal: %v", err)
+		}
+	}
 	if v, ok := epMap["intfName"]; ok {
 		ep.intfName = v.(string)
 	}
+	if v, ok := epMap["containerID"]; ok {
+		ep.containerID = v.(string)
+	}
+	if v, ok := epMap["acl"]; ok {
+		ep.acl = v.(string)
+	}
+	// endpoints stored before the attach option were all veth
+	ep.attach = attachVeth
+	if v, ok := epMap["attach"]; ok && v.(string) != "" {
+		ep.attach = v.(string)
+	}
+	if v, ok := epMap["exposedPorts"]; ok {
+		if err = decodeOption(epMap, "exposedPorts", &ep.exposedPorts); err != nil {
+			return fmt.Errorf("failed to decode endpoint exposed ports after json unmarshal: %v", v)
+		}
+	}
+	if v, ok := epMap["portMapping"]; ok {
+		if err = decodeOption(epMap, "portMapping", &ep.portMapping); err != nil {
+			return fmt.Errorf("failed to decode endpoint port mapping after json unmarshal: %v", v)
+		}
+	}
 
 	return nil
 }
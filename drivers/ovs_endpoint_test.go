@@ -0,0 +1,278 @@
+package drivers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/datastore"
+	"github.com/socketplane/libovsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointJSONDualStack(t *testing.T) {
+	ep := &endpoint{}
+	err := ep.UnmarshalJSON([]byte(`{"id":"0123456789ab","nid":"ba9876543210","intfName":"port1234567","addr":"10.1.0.5/24","mac":"02:42:0a:01:00:05"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "10.1.0.5/24", ep.addr.String())
+	assert.Nil(t, ep.addrv6)
+
+	err = ep.UnmarshalJSON([]byte(`{"id":"0123456789ab","nid":"ba9876543210","addr":"10.1.0.5/24","addrv6":"fd00::5/64"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "fd00::5/64", ep.addrv6.String())
+
+	b, err := ep.MarshalJSON()
+	assert.Nil(t, err)
+	restored := &endpoint{}
+	assert.Nil(t, restored.UnmarshalJSON(b))
+	assert.Equal(t, ep.addr.String(), restored.addr.String())
+	assert.Equal(t, ep.addrv6.String(), restored.addrv6.String())
+}
+
+func TestGetSubnetforIPDualStack(t *testing.T) {
+	n := &network{id: "ba9876543210"}
+	n.addSubnet("10.1.0.0/24", "10.1.0.1/24")
+	n.addSubnet("fd00::/64", "fd00::1/64")
+
+	ep := &endpoint{}
+	assert.Nil(t, ep.UnmarshalJSON([]byte(`{"id":"0123456789ab","nid":"ba9876543210","addr":"10.1.0.5/24","addrv6":"fd00::5/64"}`)))
+	s := n.getSubnetforIP(ep.addr)
+	assert.NotNil(t, s)
+	assert.Equal(t, "10.1.0.1", s.gwIP.IP.String())
+	s = n.getSubnetforIP(ep.addrv6)
+	assert.NotNil(t, s)
+	assert.Equal(t, "fd00::1", s.gwIP.IP.String())
+}
+
+func TestEndpointAttach(t *testing.T) {
+	ep := &endpoint{}
+	assert.Nil(t, ep.UnmarshalJSON([]byte(`{"id":"0123456789ab","nid":"ba9876543210","intfName":"port1234567"}`)))
+	assert.Equal(t, attachVeth, ep.attach)
+	assert.Equal(t, "vport1234567", ep.ovsPortName())
+
+	ep.attach = attachInternal
+	b, err := ep.MarshalJSON()
+	assert.Nil(t, err)
+	restored := &endpoint{}
+	assert.Nil(t, restored.UnmarshalJSON(b))
+	assert.Equal(t, attachInternal, restored.attach)
+	assert.Equal(t, "port1234567", restored.ovsPortName())
+}
+
+// fakeStore keeps objects in memory and fails writes and deletes with err
+type fakeStore struct {
+	datastore.DataStore
+	err     error
+	objects map[string]datastore.KVObject
+}
+
+func (s *fakeStore) PutObjectAtomic(o datastore.KVObject) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.objects[datastore.Key(o.Key()...)] = o
+	return nil
+}
+
+func (s *fakeStore) DeleteObjectAtomic(o datastore.KVObject) error {
+	if s.err != nil {
+		return s.err
+	}
+	delete(s.objects, datastore.Key(o.Key()...))
+	return nil
+}
+
+func (s *fakeStore) List(key string, kvObject datastore.KVObject) ([]datastore.KVObject, error) {
+	kvol := []datastore.KVObject{}
+	for k, o := range s.objects {
+		if strings.HasPrefix(k, key) {
+			kvol = append(kvol, o)
+		}
+	}
+	if len(kvol) == 0 {
+		return nil, datastore.ErrKeyNotFound
+	}
+	return kvol, nil
+}
+
+// fakeLinks replaces the veth and ovs port changes of the endpoint steps,
+// live holds the links and ports that exist and fail names the change that
+// fails
+type fakeLinks struct {
+	live map[string]bool
+	fail string
+}
+
+func newFakeLinks() (*fakeLinks, func()) {
+	f := &fakeLinks{live: map[string]bool{}}
+	origCreate, origDelete, origAdd, origDel, origExists := createVethPair, deleteVethPair, addOvsPort, delOvsPort, ovsPortExists
+	createVethPair = func(name1, name2 string) error {
+		if f.fail == "createVethPair" {
+			return fmt.Errorf("injected failure")
+		}
+		f.live["veth "+name1] = true
+		return nil
+	}
+	deleteVethPair = func(name1, name2 string) error {
+		if f.fail == "deleteVethPair" {
+			return fmt.Errorf("injected failure")
+		}
+		delete(f.live, "veth "+name1)
+		return nil
+	}
+	addOvsPort = func(_ *OvsdbDriver, bridgeName, intfName, intfType string, tag, burst, bandwidth int, externalIDs map[string]string) error {
+		if f.fail == "addOvsPort" {
+			return fmt.Errorf("injected failure")
+		}
+		f.live["port "+intfName] = true
+		return nil
+	}
+	delOvsPort = func(_ *OvsdbDriver, intfName string) error {
+		if f.fail == "delOvsPort" {
+			return fmt.Errorf("injected failure")
+		}
+		delete(f.live, "port "+intfName)
+		return nil
+	}
+	ovsPortExists = func(_ *OvsdbDriver, intfName string) bool {
+		return f.live["port "+intfName]
+	}
+	return f, func() {
+		createVethPair, deleteVethPair, addOvsPort, delOvsPort, ovsPortExists = origCreate, origDelete, origAdd, origDel, origExists
+	}
+}
+
+func newTestEndpointDriver() (*Driver, *network, *fakeStore) {
+	store := &fakeStore{objects: map[string]datastore.KVObject{}}
+	n := &network{id: "ba9876543210", bridge: ovsBridgeName, attach: attachVeth, endpoints: endpointTable{}}
+	n.addSubnet("10.1.0.0/24", "10.1.0.1/24")
+	d := &Driver{networks: networkTable{n.id: n}, localStore: store, ovsdb: &OvsdbDriver{cache: map[string]map[libovsdb.UUID]libovsdb.Row{}}}
+	d.ipam = newIpam(d)
+	n.driver = d
+	return d, n, store
+}
+
+func TestCreateEndpointRollback(t *testing.T) {
+	links, restore := newFakeLinks()
+	defer restore()
+
+	for _, fail := range []string{"createVethPair", "addOvsPort", "store", ""} {
+		d, n, store := newTestEndpointDriver()
+		links.fail = fail
+		if fail == "store" {
+			store.err = fmt.Errorf("injected failure")
+		}
+		_, err := d.CreateEndpoint(&pluginNet.CreateEndpointRequest{
+			NetworkID:  n.id,
+			EndpointID: "0123456789ab",
+			Interface:  &pluginNet.EndpointInterface{Address: "10.1.0.5/24"},
+		})
+		if fail == "" {
+			assert.Nil(t, err)
+			assert.Len(t, links.live, 2)
+			assert.Len(t, n.endpoints, 1)
+			assert.Len(t, store.objects, 1)
+			continue
+		}
+		assert.NotNil(t, err, fail)
+		assert.Len(t, links.live, 0, fail)
+		assert.Len(t, n.endpoints, 0, fail)
+		assert.Len(t, store.objects, 0, fail)
+	}
+}
+
+func TestDeleteEndpointRollback(t *testing.T) {
+	links, restore := newFakeLinks()
+	defer restore()
+
+	for _, attach := range []string{attachVeth, attachInternal} {
+		for _, fail := range []string{"delOvsPort", "deleteVethPair", "store", ""} {
+			d, n, store := newTestEndpointDriver()
+			n.attach = attach
+			links.fail = ""
+			links.live = map[string]bool{}
+			_, err := d.CreateEndpoint(&pluginNet.CreateEndpointRequest{
+				NetworkID:  n.id,
+				EndpointID: "0123456789ab",
+				Interface:  &pluginNet.EndpointInterface{Address: "10.1.0.5/24"},
+			})
+			assert.Nil(t, err)
+			created := len(links.live)
+
+			links.fail = fail
+			if fail == "store" {
+				store.err = fmt.Errorf("injected failure")
+			}
+			err = d.DeleteEndpoint(&pluginNet.DeleteEndpointRequest{NetworkID: n.id, EndpointID: "0123456789ab"})
+			if fail == "" || (fail == "deleteVethPair" && attach == attachInternal) {
+				assert.Nil(t, err)
+				assert.Len(t, links.live, 0)
+				assert.Len(t, n.endpoints, 0)
+				assert.Len(t, store.objects, 0)
+				continue
+			}
+			assert.NotNil(t, err, fail)
+			assert.Len(t, links.live, created, fail)
+			assert.Len(t, n.endpoints, 1, fail)
+		}
+	}
+}
+
+func TestEndpointExternalIDs(t *testing.T) {
+	ep := &endpoint{}
+	assert.Nil(t, ep.UnmarshalJSON([]byte(`{"id":"0123456789ab","nid":"ba9876543210","intfName":"port1234567","addr":"10.1.0.5/24","addrv6":"fd00::5/64","mac":"02:42:0a:01:00:05","containerID":"c0ffee"}`)))
+	ids := ep.externalIDs()
+	assert.Equal(t, "0123456789ab", ids[extIDIface])
+	assert.Equal(t, "c0ffee", ids[extIDContainer])
+	assert.Equal(t, "02:42:0a:01:00:05", ids[extIDMac])
+
+	restored, err := endpointFromExternalIDs(ep.ovsPortName(), ids)
+	assert.Nil(t, err)
+	assert.Equal(t, ep.id, restored.id)
+	assert.Equal(t, ep.nid, restored.nid)
+	assert.Equal(t, ep.intfName, restored.intfName)
+	assert.Equal(t, ep.containerID, restored.containerID)
+	assert.Equal(t, ep.mac, restored.mac)
+	assert.Equal(t, ep.addr.String(), restored.addr.String())
+	assert.Equal(t, ep.addrv6.String(), restored.addrv6.String())
+
+	delete(ids, extIDNetwork)
+	_, err = endpointFromExternalIDs(ep.ovsPortName(), ids)
+	assert.NotNil(t, err)
+}
+
+func TestRestoreEndpointsFromOvsdb(t *testing.T) {
+	d, n, store := newTestEndpointDriver()
+	known := &endpoint{id: "0000000000001", nid: n.id, intfName: "port0000001", attach: attachVeth}
+	lost := &endpoint{id: "0000000000002", nid: n.id, intfName: "port0000002", attach: attachInternal, mac: netutils.GenerateRandomMAC()}
+	lost.addr, _ = netutils.ParseCIDR("10.1.0.6/24")
+	other := &endpoint{id: "0000000000003", nid: "dead00000000", intfName: "port0000003", attach: attachVeth}
+	n.endpoints[known.id] = known
+
+	intfs := map[libovsdb.UUID]libovsdb.Row{}
+	for _, ep := range []*endpoint{known, lost, other} {
+		ids := map[interface{}]interface{}{}
+		for k, v := range ep.externalIDs() {
+			ids[k] = v
+		}
+		intfs[libovsdb.UUID{GoUUID: ep.id}] = libovsdb.Row{Fields: map[string]interface{}{
+			"name":         ep.ovsPortName(),
+			"external_ids": libovsdb.OvsMap{GoMap: ids},
+		}}
+	}
+	intfs[libovsdb.UUID{GoUUID: "tun"}] = libovsdb.Row{Fields: map[string]interface{}{"name": "tunba980000beef"}}
+	d.ovsdb = &OvsdbDriver{cache: map[string]map[libovsdb.UUID]libovsdb.Row{intfTable: intfs}}
+
+	d.restoreEndpointsFromOvsdb()
+	assert.Len(t, n.endpoints, 2)
+	restored := n.endpoints[lost.id]
+	if assert.NotNil(t, restored) {
+		assert.Equal(t, "port0000002", restored.intfName)
+		assert.Equal(t, attachInternal, restored.attach)
+		assert.Equal(t, lost.mac, restored.mac)
+		assert.Equal(t, "10.1.0.6/24", restored.addr.String())
+	}
+	assert.Len(t, store.objects, 1)
+}
@@ -0,0 +1,41 @@
+package drivers
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// applyFlowExport sets the flow exports of the config on the bridge
+func (d *Driver) applyFlowExport(bridge string) error {
+	d.Lock()
+	if d.config == nil {
+		d.Unlock()
+		return nil
+	}
+	flowExports := d.config.flowExports()
+	d.Unlock()
+	for table, fe := range flowExports {
+		if err := d.ovsdb.SetFlowExport(bridge, table, fe); err != nil {
+			return fmt.Errorf("ovs set %s of bridge %s failed: %v", table, bridge, err)
+		}
+	}
+	return nil
+}
+
+// applyFlowExports sets the flow exports of the config on the default
+// bridge and the bridges of the networks
+func (d *Driver) applyFlowExports() {
+	bridges := map[string]bool{d.bridgeName(): true}
+	for _, n := range d.getNetworks() {
+		bridges[n.bridge] = true
+	}
+	for bridge := range bridges {
+		if !d.ovsdb.BridgeExists(bridge) {
+			continue
+		}
+		if err := d.applyFlowExport(bridge); err != nil {
+			logrus.Errorf("Error setting flow export. Err: %v", err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package drivers
+
+import (
+	"net"
+	"testing"
+
+	"github.com/socketplane/libovsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlowExportConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SflowTargets = []string{"10.0.0.1"}
+	assert.NotNil(t, cfg.Validate())
+	cfg = DefaultConfig()
+	cfg.FlowSampling = 0
+	assert.NotNil(t, cfg.Validate())
+
+	cfg = DefaultConfig()
+	cfg.IpfixTargets = []string{"10.0.0.1:4739"}
+	assert.Nil(t, cfg.Validate())
+	exports := cfg.flowExports()
+	assert.Equal(t, FlowExport{Targets: []string{"10.0.0.1:4739"}, Sampling: 64, Polling: 10}, exports[ipfixTable])
+	assert.Len(t, exports[sflowTable].Targets, 0)
+}
+
+func TestFlowExportOperations(t *testing.T) {
+	// a local collector stands in for the noc one
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer collector.Close()
+	target := collector.LocalAddr().String()
+
+	d := &OvsdbDriver{cache: map[string]map[libovsdb.UUID]libovsdb.Row{
+		bridgeTable: {
+			{GoUUID: "b1"}: {Fields: map[string]interface{}{"name": ovsBridgeName, "sflow": libovsdb.UUID{GoUUID: "s1"}}},
+		},
+		sflowTable: {
+			{GoUUID: "s1"}: {Fields: map[string]interface{}{
+				"targets":      target,
+				"sampling":     float64(64),
+				"polling":      float64(10),
+				"agent":        libovsdb.OvsSet{GoSet: []interface{}{}},
+				"external_ids": libovsdb.OvsMap{GoMap: map[interface{}]interface{}{extIDFlowExport: "true"}},
+			}},
+		},
+	}}
+	fe := FlowExport{Targets: []string{target}, Sampling: 64, Polling: 10}
+
+	// up to date
+	ops, err := d.flowExportOperations(ovsBridgeName, sflowTable, fe)
+	assert.Nil(t, err)
+	assert.Len(t, ops, 0)
+
+	fe.Sampling = 128
+	ops, err = d.flowExportOperations(ovsBridgeName, sflowTable, fe)
+	assert.Nil(t, err)
+	if assert.Len(t, ops, 2) {
+		assert.Equal(t, sflowTable, ops[0].Table)
+		assert.Equal(t, 128, ops[0].Row["sampling"])
+		assert.Equal(t, libovsdb.UUID{GoUUID: "export"}, ops[1].Row["sflow"])
+	}
+
+	ops, err = d.flowExportOperations(ovsBridgeName, netflowTable, FlowExport{Targets: []string{target}, Polling: 30})
+	assert.Nil(t, err)
+	if assert.Len(t, ops, 2) {
+		assert.Equal(t, 30, ops[0].Row["active_timeout"])
+		assert.Nil(t, ops[0].Row["sampling"])
+	}
+
+	// only the rows of the driver are cleared
+	ops, err = d.flowExportOperations(ovsBridgeName, sflowTable, FlowExport{})
+	assert.Nil(t, err)
+	assert.Len(t, ops, 1)
+	d.cache[sflowTable][libovsdb.UUID{GoUUID: "s1"}].Fields["external_ids"] = libovsdb.OvsMap{GoMap: map[interface{}]interface{}{}}
+	ops, err = d.flowExportOperations(ovsBridgeName, sflowTable, FlowExport{})
+	assert.Nil(t, err)
+	assert.Len(t, ops, 0)
+	// and rows set outside the driver are not replaced
+	ops, err = d.flowExportOperations(ovsBridgeName, sflowTable, fe)
+	assert.Nil(t, err)
+	assert.Len(t, ops, 0)
+
+	_, err = d.flowExportOperations(ovsBridgeName, "Mirror", fe)
+	assert.NotNil(t, err)
+}
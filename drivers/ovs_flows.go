@@ -0,0 +1,69 @@
+package drivers
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/XiaoweiQian/ovs-driver/utils/ofctl"
+)
+
+// The endpoint flows form a pipeline of two tables on the bridge. Table 0
+// checks the source of the traffic of secured ports, table 1 filters the
+// traffic towards endpoints with acls. Traffic passing both is switched
+// like by the default NORMAL flow of the bridge.
+const (
+	portSecurityTable = 0
+	aclTable          = 1
+
+	pipelineCookie = "pipeline"
+)
+
+// flow changes of the bridges, replaced in tests
+var (
+	addFlows          = ofctl.AddFlows
+	delFlowsByCookie  = ofctl.DelFlowsByCookie
+	dumpFlowsByCookie = ofctl.DumpFlowsByCookie
+)
+
+// flowCookie returns the cookie of the flows of a kind installed for an
+// endpoint or bridge, so they can be removed without touching other flows
+func flowCookie(id, kind string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id + "/" + kind))
+	return h.Sum64()
+}
+
+// pipelineFlows sends the traffic not handled by the port security flows to
+// the acl table, and the traffic not handled by acls to NORMAL
+func pipelineFlows(bridge string) []string {
+	cookie := flowCookie(bridge, pipelineCookie)
+	return []string{
+		fmt.Sprintf("cookie=%#x,table=%d,priority=1,actions=resubmit(,%d)", cookie, portSecurityTable, aclTable),
+		fmt.Sprintf("cookie=%#x,table=%d,priority=0,actions=NORMAL", cookie, aclTable),
+	}
+}
+
+// replaceFlows replaces the flows having the cookie on the bridge. The
+// pipeline flows are added with them and are kept until the last network
+// of the bridge is deleted.
+func replaceFlows(bridge string, cookie uint64, flows []string) error {
+	if err := delFlowsByCookie(bridge, cookie); err != nil {
+		return err
+	}
+	if len(flows) == 0 {
+		return nil
+	}
+	return addFlows(bridge, append(pipelineFlows(bridge), flows...))
+}
+
+// deletePipelineFlows removes the pipeline flows of a bridge kept after its
+// last network was deleted
+func (d *Driver) deletePipelineFlows(bridge string) {
+	if !d.localOvsdb() {
+		return
+	}
+	if err := delFlowsByCookie(bridge, flowCookie(bridge, pipelineCookie)); err != nil {
+		logrus.Warnf("Failed to delete the pipeline flows of ovs bridge %s: %v", bridge, err)
+	}
+}
@@ -0,0 +1,560 @@
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	pluginIpam "github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/libnetwork/datastore"
+)
+
+const (
+	ovsIpamPrefix = "ovs/ipam"
+
+	// default address spaces, pools of different spaces may overlap
+	ipamLocalSpace  = "ovs-local"
+	ipamGlobalSpace = "ovs-global"
+
+	// requestAddressType marks the gateway request of a network, like
+	// libnetwork's netlabel
+	requestAddressType = "RequestAddressType"
+	gatewayAddressType = "com.docker.network.gateway"
+
+	// kinds of the allocated addresses
+	ipamGateway = "gateway"
+	ipamAddress = "address"
+
+	// ipamPoolPrefix is the size of the pools taken from the default pool
+	ipamPoolPrefix = 24
+)
+
+// Ipam is the ipam driver served with the network driver. Its pools and
+// allocated addresses are kept in the local store and survive restarts.
+type Ipam struct {
+	d     *Driver
+	pools map[string]*ipamPool
+	sync.Mutex
+}
+
+// ipamPool is a pool of an address space, addresses are handed out from
+// the sub pool if it has one
+type ipamPool struct {
+	id        string
+	space     string
+	pool      *net.IPNet
+	subPool   *net.IPNet
+	allocated map[string]string
+	dbIndex   uint64
+	dbExists  bool
+}
+
+func newIpam(d *Driver) *Ipam {
+	return &Ipam{d: d, pools: map[string]*ipamPool{}}
+}
+
+// Ipam returns the ipam driver sharing the local store of the driver
+func (d *Driver) Ipam() *Ipam {
+	return d.ipam
+}
+
+// restorePools loads the pools of the local store
+func (i *Ipam) restorePools() error {
+	if i.d.localStore == nil {
+		logrus.Debugf("Cannot restore ovs ipam pools because local datastore is missing.")
+		return nil
+	}
+	kvol, err := i.d.localStore.List(datastore.Key(ovsIpamPrefix), &ipamPool{})
+	if err == datastore.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read ovs ipam pools from store: %v", err)
+	}
+	i.Lock()
+	defer i.Unlock()
+	for _, kvo := range kvol {
+		p := kvo.(*ipamPool)
+		i.pools[p.id] = p
+		logrus.Debugf("Success restore ipam pool=%s from local store", p.id)
+	}
+	return nil
+}
+
+// GetCapabilities ...
+func (i *Ipam) GetCapabilities() (*pluginIpam.CapabilitiesResponse, error) {
+	return &pluginIpam.CapabilitiesResponse{}, nil
+}
+
+// GetDefaultAddressSpaces ...
+func (i *Ipam) GetDefaultAddressSpaces() (*pluginIpam.AddressSpacesResponse, error) {
+	return &pluginIpam.AddressSpacesResponse{
+		LocalDefaultAddressSpace:  ipamLocalSpace,
+		GlobalDefaultAddressSpace: ipamGlobalSpace,
+	}, nil
+}
+
+// RequestPool registers the pool in its address space, a pool taken from
+// the default pool if none is given
+func (i *Ipam) RequestPool(r *pluginIpam.RequestPoolRequest) (*pluginIpam.RequestPoolResponse, error) {
+	logrus.Debugf("RequestPool ovs ipam space=%s pool=%s subPool=%s v6=%t", r.AddressSpace, r.Pool, r.SubPool, r.V6)
+	if r.AddressSpace == "" {
+		return nil, fmt.Errorf("ovs ipam pool needs an address space")
+	}
+	i.Lock()
+	defer i.Unlock()
+
+	p := &ipamPool{space: r.AddressSpace, allocated: map[string]string{}}
+	if r.Pool == "" {
+		if r.SubPool != "" {
+			return nil, fmt.Errorf("ovs ipam sub pool %s needs a pool", r.SubPool)
+		}
+		if r.V6 {
+			return nil, fmt.Errorf("ovs ipam has no default ipv6 pool, a pool must be given")
+		}
+		pool, err := i.defaultPool(r.AddressSpace)
+		if err != nil {
+			return nil, err
+		}
+		p.pool = pool
+	} else {
+		_, pool, err := net.ParseCIDR(r.Pool)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ovs ipam pool %q: %v", r.Pool, err)
+		}
+		if (pool.IP.To4() == nil) != r.V6 {
+			return nil, fmt.Errorf("ovs ipam pool %s is not of the requested ip version", pool)
+		}
+		p.pool = pool
+	}
+	if r.SubPool != "" {
+		_, subPool, err := net.ParseCIDR(r.SubPool)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ovs ipam sub pool %q: %v", r.SubPool, err)
+		}
+		if !p.pool.Contains(subPool.IP) || prefixLen(subPool) < prefixLen(p.pool) {
+			return nil, fmt.Errorf("ovs ipam sub pool %s is not in pool %s", subPool, p.pool)
+		}
+		p.subPool = subPool
+	}
+	p.id = ipamPoolID(p.space, p.pool, p.subPool)
+	for _, other := range i.pools {
+		if other.space != p.space {
+			continue
+		}
+		if other.id == p.id {
+			return nil, fmt.Errorf("ovs ipam pool %s already exists", p.id)
+		}
+		if overlaps(other.pool, p.pool) {
+			return nil, fmt.Errorf("ovs ipam pool %s overlaps with pool %s", p.pool, other.id)
+		}
+	}
+	if err := i.writePool(p); err != nil {
+		return nil, err
+	}
+	i.pools[p.id] = p
+	logrus.Infof("Created ovs ipam pool %s", p.id)
+	return &pluginIpam.RequestPoolResponse{PoolID: p.id, Pool: p.pool.String(), Data: map[string]string{}}, nil
+}
+
+// defaultPool returns the first pool of the default pool free in the
+// address space
+func (i *Ipam) defaultPool(space string) (*net.IPNet, error) {
+	_, base, err := net.ParseCIDR(i.d.ipamDefaultPool())
+	if err != nil {
+		return nil, fmt.Errorf("invalid ovs ipam default pool: %v", err)
+	}
+	if prefixLen(base) > ipamPoolPrefix {
+		return nil, fmt.Errorf("ovs ipam default pool %s is smaller than /%d", base, ipamPoolPrefix)
+	}
+	mask := net.CIDRMask(ipamPoolPrefix, 8*len(base.IP))
+	for ip := base.IP; base.Contains(ip); ip = nextPool(ip, ipamPoolPrefix) {
+		candidate := &net.IPNet{IP: ip, Mask: mask}
+		free := true
+		for _, other := range i.pools {
+			if other.space == space && overlaps(other.pool, candidate) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("ovs ipam default pool %s is exhausted in address space %s", base, space)
+}
+
+// ReleasePool removes the pool and its allocations
+func (i *Ipam) ReleasePool(r *pluginIpam.ReleasePoolRequest) error {
+	logrus.Debugf("ReleasePool ovs ipam pool=%s", r.PoolID)
+	i.Lock()
+	defer i.Unlock()
+	p, ok := i.pools[r.PoolID]
+	if !ok {
+		return fmt.Errorf("ovs ipam pool %s not found", r.PoolID)
+	}
+	if i.d.localStore == nil {
+		return fmt.Errorf("ovs local store not initialized, ipam pool not deleted")
+	}
+	if err := i.d.localStore.DeleteObjectAtomic(p); err != nil {
+		return fmt.Errorf("failed to delete ovs ipam pool %s from local store: %v", p.id, err)
+	}
+	delete(i.pools, p.id)
+	logrus.Infof("Released ovs ipam pool %s", p.id)
+	return nil
+}
+
+// RequestAddress allocates the requested address or the first free one of
+// the pool. The gateway of a network is recorded as such.
+func (i *Ipam) RequestAddress(r *pluginIpam.RequestAddressRequest) (*pluginIpam.RequestAddressResponse, error) {
+	logrus.Debugf("RequestAddress ovs ipam pool=%s address=%s opts=%v", r.PoolID, r.Address, r.Options)
+	i.Lock()
+	defer i.Unlock()
+	p, ok := i.pools[r.PoolID]
+	if !ok {
+		return nil, fmt.Errorf("ovs ipam pool %s not found", r.PoolID)
+	}
+	kind := ipamAddress
+	if r.Options[requestAddressType] == gatewayAddressType {
+		kind = ipamGateway
+	}
+
+	var ip net.IP
+	if r.Address != "" {
+		if ip = parseAddress(r.Address); ip == nil {
+			return nil, fmt.Errorf("invalid ovs ipam address %q", r.Address)
+		}
+		if !p.pool.Contains(ip) || ip.Equal(p.pool.IP) || (ip.To4() != nil && isBroadcast(ip, p.pool)) {
+			return nil, fmt.Errorf("ovs ipam address %s is not usable in pool %s", ip, p.id)
+		}
+		if _, ok := p.allocated[ip.String()]; ok {
+			return nil, fmt.Errorf("ovs ipam address %s is already allocated in pool %s", ip, p.id)
+		}
+	} else if ip = p.nextFree(); ip == nil {
+		return nil, fmt.Errorf("ovs ipam pool %s has no free address", p.id)
+	}
+
+	updated := p.copy()
+	updated.allocated[ip.String()] = kind
+	if err := i.writePool(updated); err != nil {
+		return nil, err
+	}
+	i.pools[p.id] = updated
+	addr := &net.IPNet{IP: ip, Mask: p.pool.Mask}
+	logrus.Debugf("Allocated ovs ipam %s %s in pool %s", kind, addr, p.id)
+	return &pluginIpam.RequestAddressResponse{Address: addr.String(), Data: map[string]string{}}, nil
+}
+
+// ReleaseAddress frees the address, releasing a free address is not an
+// error
+func (i *Ipam) ReleaseAddress(r *pluginIpam.ReleaseAddressRequest) error {
+	logrus.Debugf("ReleaseAddress ovs ipam pool=%s address=%s", r.PoolID, r.Address)
+	i.Lock()
+	defer i.Unlock()
+	p, ok := i.pools[r.PoolID]
+	if !ok {
+		return fmt.Errorf("ovs ipam pool %s not found", r.PoolID)
+	}
+	ip := parseAddress(r.Address)
+	if ip == nil {
+		return fmt.Errorf("invalid ovs ipam address %q", r.Address)
+	}
+	if _, ok := p.allocated[ip.String()]; !ok {
+		logrus.Debugf("ovs ipam address %s of pool %s already released", ip, p.id)
+		return nil
+	}
+	updated := p.copy()
+	delete(updated.allocated, ip.String())
+	if err := i.writePool(updated); err != nil {
+		return err
+	}
+	i.pools[p.id] = updated
+	return nil
+}
+
+// writePool stores the pool, the in memory pool is only replaced once the
+// store has it
+func (i *Ipam) writePool(p *ipamPool) error {
+	if i.d.localStore == nil {
+		return fmt.Errorf("ovs local store not initialized, ipam pool not saved")
+	}
+	if err := i.d.localStore.PutObjectAtomic(p); err != nil {
+		return fmt.Errorf("failed to update ovs ipam pool %s to local store: %v", p.id, err)
+	}
+	return nil
+}
+
+// nextFree returns the lowest free address of the sub pool or pool, the
+// network and ipv4 broadcast addresses are never handed out
+func (p *ipamPool) nextFree() net.IP {
+	r := p.pool
+	if p.subPool != nil {
+		r = p.subPool
+	}
+	for ip := nextIP(r.IP); r.Contains(ip); ip = nextIP(ip) {
+		if ip.To4() != nil && isBroadcast(ip, p.pool) {
+			break
+		}
+		if _, ok := p.allocated[ip.String()]; !ok && !ip.Equal(p.pool.IP) {
+			return ip
+		}
+	}
+	return nil
+}
+
+func (p *ipamPool) copy() *ipamPool {
+	c := *p
+	c.allocated = map[string]string{}
+	for k, v := range p.allocated {
+		c.allocated[k] = v
+	}
+	return &c
+}
+
+// ipamPoolID names the pool like libnetwork's default ipam,
+// space/pool[/subpool]
+func ipamPoolID(space string, pool, subPool *net.IPNet) string {
+	id := space + "/" + pool.String()
+	if subPool != nil {
+		id += "/" + subPool.String()
+	}
+	return id
+}
+
+// parseAddress accepts an address with or without prefix length
+func parseAddress(addr string) net.IP {
+	if ip, _, err := net.ParseCIDR(addr); err == nil {
+		return normalizeIP(ip)
+	}
+	return normalizeIP(net.ParseIP(addr))
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP{}, normalizeIP(ip)...)
+	for j := len(next) - 1; j >= 0; j-- {
+		next[j]++
+		if next[j] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// nextPool returns the network address following the pool of the prefix
+// length starting at ip
+func nextPool(ip net.IP, prefix int) net.IP {
+	next := append(net.IP{}, normalizeIP(ip)...)
+	bit := len(next)*8 - prefix
+	for j := len(next) - 1 - bit/8; j >= 0; j-- {
+		next[j] += byte(1 << uint(bit%8))
+		if next[j] != 0 {
+			break
+		}
+		bit = 0
+	}
+	return next
+}
+
+func isBroadcast(ip net.IP, pool *net.IPNet) bool {
+	ip4 := ip.To4()
+	for j := range ip4 {
+		if ip4[j]|pool.Mask[j] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+func prefixLen(n *net.IPNet) int {
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// IpamPoolInfo describes a pool of the ipam driver in the admin api
+type IpamPoolInfo struct {
+	ID           string
+	AddressSpace string
+	Pool         string
+	SubPool      string
+	Gateway      string
+	Addresses    []IpamAddressInfo
+}
+
+// IpamAddressInfo is an allocated address, EndpointID is the ovs endpoint
+// having it if any
+type IpamAddressInfo struct {
+	Address    string
+	Kind       string
+	EndpointID string
+}
+
+// PoolInfos lists the pools sorted by id with their addresses sorted
+func (i *Ipam) PoolInfos() []IpamPoolInfo {
+	endpoints := i.d.endpointsByAddress()
+	i.Lock()
+	defer i.Unlock()
+	infos := []IpamPoolInfo{}
+	for _, p := range i.pools {
+		info := IpamPoolInfo{
+			ID:           p.id,
+			AddressSpace: p.space,
+			Pool:         p.pool.String(),
+			Addresses:    []IpamAddressInfo{},
+		}
+		if p.subPool != nil {
+			info.SubPool = p.subPool.String()
+		}
+		for addr, kind := range p.allocated {
+			if kind == ipamGateway {
+				info.Gateway = addr
+			}
+			info.Addresses = append(info.Addresses, IpamAddressInfo{
+				Address:    addr,
+				Kind:       kind,
+				EndpointID: endpoints[p.pool.String()+" "+addr],
+			})
+		}
+		sort.Slice(info.Addresses, func(a, b int) bool {
+			return compareIP(parseAddress(info.Addresses[a].Address), parseAddress(info.Addresses[b].Address)) < 0
+		})
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(a, b int) bool { return infos[a].ID < infos[b].ID })
+	return infos
+}
+
+// endpointsByAddress maps the subnet and address of the endpoints of all
+// networks to their id, the subnet tells overlapping pools apart
+func (d *Driver) endpointsByAddress() map[string]string {
+	res := map[string]string{}
+	for _, n := range d.getNetworks() {
+		n.Lock()
+		for _, ep := range n.endpoints {
+			for _, addr := range []*net.IPNet{ep.addr, ep.addrv6} {
+				if addr == nil {
+					continue
+				}
+				if s := n.getSubnetforIP(addr); s != nil {
+					res[s.subnetIP.String()+" "+normalizeIP(addr.IP).String()] = ep.id
+				}
+			}
+		}
+		n.Unlock()
+	}
+	return res
+}
+
+func compareIP(a, b net.IP) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(string(a), string(b))
+}
+
+func (p *ipamPool) MarshalJSON() ([]byte, error) {
+	pMap := map[string]interface{}{
+		"id":           p.id,
+		"addressSpace": p.space,
+		"pool":         p.pool.String(),
+		"allocated":    p.allocated,
+	}
+	if p.subPool != nil {
+		pMap["subPool"] = p.subPool.String()
+	}
+	return json.Marshal(pMap)
+}
+
+func (p *ipamPool) UnmarshalJSON(value []byte) error {
+	var pMap struct {
+		ID           string            `json:"id"`
+		AddressSpace string            `json:"addressSpace"`
+		Pool         string            `json:"pool"`
+		SubPool      string            `json:"subPool"`
+		Allocated    map[string]string `json:"allocated"`
+	}
+	if err := json.Unmarshal(value, &pMap); err != nil {
+		return err
+	}
+	p.id = pMap.ID
+	p.space = pMap.AddressSpace
+	var err error
+	if _, p.pool, err = net.ParseCIDR(pMap.Pool); err != nil {
+		return fmt.Errorf("invalid ipam pool %q of %s: %v", pMap.Pool, p.id, err)
+	}
+	if pMap.SubPool != "" {
+		if _, p.subPool, err = net.ParseCIDR(pMap.SubPool); err != nil {
+			return fmt.Errorf("invalid ipam sub pool %q of %s: %v", pMap.SubPool, p.id, err)
+		}
+	}
+	p.allocated = pMap.Allocated
+	if p.allocated == nil {
+		p.allocated = map[string]string{}
+	}
+	return nil
+}
+
+func (p *ipamPool) New() datastore.KVObject {
+	return &ipamPool{}
+}
+
+func (p *ipamPool) CopyTo(o datastore.KVObject) error {
+	dstp := o.(*ipamPool)
+	*dstp = *p.copy()
+	return nil
+}
+
+func (p *ipamPool) DataScope() string {
+	return datastore.LocalScope
+}
+
+func (p *ipamPool) Key() []string {
+	return []string{ovsIpamPrefix, p.id}
+}
+
+func (p *ipamPool) KeyPrefix() []string {
+	return []string{ovsIpamPrefix}
+}
+
+func (p *ipamPool) Index() uint64 {
+	return p.dbIndex
+}
+
+func (p *ipamPool) SetIndex(index uint64) {
+	p.dbIndex = index
+	p.dbExists = true
+}
+
+func (p *ipamPool) Exists() bool {
+	return p.dbExists
+}
+
+func (p *ipamPool) Skip() bool {
+	return false
+}
+
+func (p *ipamPool) Value() []byte {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (p *ipamPool) SetValue(value []byte) error {
+	return json.Unmarshal(value, p)
+}
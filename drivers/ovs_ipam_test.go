@@ -0,0 +1,138 @@
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+	pluginIpam "github.com/docker/go-plugins-helpers/ipam"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIpamPools(t *testing.T) {
+	d, _, store := newTestEndpointDriver()
+	i := d.ipam
+
+	res, err := i.RequestPool(&pluginIpam.RequestPoolRequest{AddressSpace: ipamLocalSpace})
+	assert.Nil(t, err)
+	assert.Equal(t, "10.200.0.0/24", res.Pool)
+	assert.Equal(t, "ovs-local/10.200.0.0/24", res.PoolID)
+	res, err = i.RequestPool(&pluginIpam.RequestPoolRequest{AddressSpace: ipamLocalSpace})
+	assert.Nil(t, err)
+	assert.Equal(t, "10.200.1.0/24", res.Pool)
+
+	// pools of other address spaces may overlap
+	res, err = i.RequestPool(&pluginIpam.RequestPoolRequest{AddressSpace: "tenant1", Pool: "10.200.0.0/16", SubPool: "10.200.128.0/17"})
+	assert.Nil(t, err)
+	assert.Equal(t, "tenant1/10.200.0.0/16/10.200.128.0/17", res.PoolID)
+
+	for _, r := range []*pluginIpam.RequestPoolRequest{
+		{AddressSpace: ipamLocalSpace, Pool: "10.200.0.0/16"},
+		{AddressSpace: ipamLocalSpace, Pool: "fd00::/64"},
+		{AddressSpace: ipamLocalSpace, V6: true},
+		{AddressSpace: ipamLocalSpace, Pool: "10.3.0.0/24", SubPool: "10.4.0.0/25"},
+		{AddressSpace: ipamLocalSpace, Pool: "10.3.0.0/33"},
+		{Pool: "10.3.0.0/24"},
+	} {
+		_, err := i.RequestPool(r)
+		assert.NotNil(t, err, r.Pool)
+	}
+
+	assert.Len(t, store.objects, 3)
+	assert.Nil(t, i.ReleasePool(&pluginIpam.ReleasePoolRequest{PoolID: "ovs-local/10.200.0.0/24"}))
+	assert.Len(t, store.objects, 2)
+	assert.NotNil(t, i.ReleasePool(&pluginIpam.ReleasePoolRequest{PoolID: "ovs-local/10.200.0.0/24"}))
+	res, err = i.RequestPool(&pluginIpam.RequestPoolRequest{AddressSpace: ipamLocalSpace})
+	assert.Nil(t, err)
+	assert.Equal(t, "10.200.0.0/24", res.Pool)
+}
+
+func TestIpamAddresses(t *testing.T) {
+	d, _, store := newTestEndpointDriver()
+	i := d.ipam
+	pool, err := i.RequestPool(&pluginIpam.RequestPoolRequest{AddressSpace: ipamLocalSpace, Pool: "10.5.0.0/30"})
+	assert.Nil(t, err)
+
+	request := func(addr string, opts map[string]string) (string, error) {
+		res, err := i.RequestAddress(&pluginIpam.RequestAddressRequest{PoolID: pool.PoolID, Address: addr, Options: opts})
+		if err != nil {
+			return "", err
+		}
+		return res.Address, nil
+	}
+	addr, err := request("", map[string]string{requestAddressType: gatewayAddressType})
+	assert.Nil(t, err)
+	assert.Equal(t, "10.5.0.1/30", addr)
+	addr, err = request("", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.5.0.2/30", addr)
+	// the network and broadcast addresses are never handed out
+	_, err = request("", nil)
+	assert.NotNil(t, err)
+	for _, a := range []string{"10.5.0.0", "10.5.0.3", "10.5.0.2", "10.6.0.1", "bogus"} {
+		_, err := request(a, nil)
+		assert.NotNil(t, err, a)
+	}
+
+	assert.Nil(t, i.ReleaseAddress(&pluginIpam.ReleaseAddressRequest{PoolID: pool.PoolID, Address: "10.5.0.2/30"}))
+	assert.Nil(t, i.ReleaseAddress(&pluginIpam.ReleaseAddressRequest{PoolID: pool.PoolID, Address: "10.5.0.2"}))
+	addr, err = request("10.5.0.2", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.5.0.2/30", addr)
+
+	// allocations survive a restart through the local store
+	restored := newIpam(d)
+	assert.Nil(t, restored.restorePools())
+	if assert.Contains(t, restored.pools, pool.PoolID) {
+		assert.Equal(t, map[string]string{"10.5.0.1": ipamGateway, "10.5.0.2": ipamAddress}, restored.pools[pool.PoolID].allocated)
+	}
+
+	// the in memory allocations are kept when the store fails
+	store.err = fmt.Errorf("injected failure")
+	_, err = request("", nil)
+	assert.NotNil(t, err)
+	assert.NotNil(t, i.ReleaseAddress(&pluginIpam.ReleaseAddressRequest{PoolID: pool.PoolID, Address: "10.5.0.1"}))
+	assert.Len(t, i.pools[pool.PoolID].allocated, 2)
+}
+
+func TestIpamIPv6(t *testing.T) {
+	d, _, _ := newTestEndpointDriver()
+	i := d.ipam
+	pool, err := i.RequestPool(&pluginIpam.RequestPoolRequest{AddressSpace: ipamLocalSpace, Pool: "fd00:1::/64", SubPool: "fd00:1::100/120", V6: true})
+	assert.Nil(t, err)
+	res, err := i.RequestAddress(&pluginIpam.RequestAddressRequest{PoolID: pool.PoolID, Address: "fd00:1::1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "fd00:1::1/64", res.Address)
+	res, err = i.RequestAddress(&pluginIpam.RequestAddressRequest{PoolID: pool.PoolID})
+	assert.Nil(t, err)
+	assert.Equal(t, "fd00:1::101/64", res.Address)
+}
+
+func TestAdminIpam(t *testing.T) {
+	d, n, _ := newTestEndpointDriver()
+	pool, err := d.ipam.RequestPool(&pluginIpam.RequestPoolRequest{AddressSpace: ipamLocalSpace, Pool: "10.1.0.0/24"})
+	assert.Nil(t, err)
+	_, err = d.ipam.RequestAddress(&pluginIpam.RequestAddressRequest{PoolID: pool.PoolID, Options: map[string]string{requestAddressType: gatewayAddressType}})
+	assert.Nil(t, err)
+	_, err = d.ipam.RequestAddress(&pluginIpam.RequestAddressRequest{PoolID: pool.PoolID, Address: "10.1.0.5"})
+	assert.Nil(t, err)
+	ep := &endpoint{id: "0000000000001", nid: n.id}
+	ep.addr, _ = netutils.ParseCIDR("10.1.0.5/24")
+	n.endpoints[ep.id] = ep
+
+	w := httptest.NewRecorder()
+	d.adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/ipam", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var pools []IpamPoolInfo
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &pools))
+	if assert.Len(t, pools, 1) {
+		assert.Equal(t, "10.1.0.1", pools[0].Gateway)
+		assert.Equal(t, []IpamAddressInfo{
+			{Address: "10.1.0.1", Kind: ipamGateway},
+			{Address: "10.1.0.5", Kind: ipamAddress, EndpointID: ep.id},
+		}, pools[0].Addresses)
+	}
+}
@@ -0,0 +1,86 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+)
+
+const (
+	macOption = "mac"
+
+	// macRandom picks a new address for every endpoint, macFromIP derives
+	// it from the endpoint address and macHash from the endpoint id
+	macRandom = "random"
+	macFromIP = "from-ip"
+	macHash   = "hash"
+
+	randomMACRetries = 3
+)
+
+// getMacMode returns how the endpoints get a mac address when docker has
+// none, random by default like before the option existed
+func getMacMode(opts map[string]string) (string, error) {
+	switch mode := opts[macOption]; mode {
+	case "":
+		return macRandom, nil
+	case macRandom, macFromIP, macHash:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid %s option %q, must be %s, %s or %s", macOption, mode, macRandom, macFromIP, macHash)
+	}
+}
+
+// generateMAC returns the mac address of an endpoint created without one.
+// from-ip uses the IPv4 address and the IPv6 one of endpoints without.
+func (n *network) generateMAC(ep *endpoint) (net.HardwareAddr, error) {
+	switch n.macMode {
+	case macFromIP:
+		ip := ep.addr
+		if ip == nil {
+			ip = ep.addrv6
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("endpoint %s has no address to derive its mac address from", ep.id[0:7])
+		}
+		return netutils.GenerateMACFromIP(ip.IP), nil
+	case macHash:
+		return netutils.GenerateMACFromID(ep.id), nil
+	}
+	// a random address is retried, the others would collide again
+	mac := netutils.GenerateRandomMAC()
+	for i := 0; i < randomMACRetries && n.macUser(ep.id, mac) != nil; i++ {
+		mac = netutils.GenerateRandomMAC()
+	}
+	return mac, nil
+}
+
+// macUser returns another endpoint of the network having the mac address
+func (n *network) macUser(eid string, mac net.HardwareAddr) *endpoint {
+	n.Lock()
+	defer n.Unlock()
+	return n.macUserLocked(eid, mac)
+}
+
+func (n *network) macUserLocked(eid string, mac net.HardwareAddr) *endpoint {
+	for _, other := range n.endpoints {
+		if other.id != eid && other.mac.String() == mac.String() {
+			return other
+		}
+	}
+	return nil
+}
+
+// reserveMAC adds the endpoint to the network unless another endpoint uses
+// its mac address. Both happen under one lock, so of two endpoints created
+// at once with the same address only one gets it.
+func (n *network) reserveMAC(ep *endpoint) error {
+	n.Lock()
+	defer n.Unlock()
+	if other := n.macUserLocked(ep.id, ep.mac); other != nil {
+		return fmt.Errorf("mac address %s of endpoint %s is already used by endpoint %s in network %s", ep.mac, ep.id[0:7], other.id[0:7], n.id)
+	}
+	n.endpoints[ep.id] = ep
+	return nil
+}
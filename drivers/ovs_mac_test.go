@@ -0,0 +1,93 @@
+package drivers
+
+import (
+	"net"
+	"testing"
+
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetMacMode(t *testing.T) {
+	mode, err := getMacMode(map[string]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, macRandom, mode)
+	mode, err = getMacMode(map[string]string{macOption: macHash})
+	assert.Nil(t, err)
+	assert.Equal(t, macHash, mode)
+	_, err = getMacMode(map[string]string{macOption: "static"})
+	assert.NotNil(t, err)
+}
+
+func TestGenerateMAC(t *testing.T) {
+	n := &network{id: "ba9876543210", endpoints: endpointTable{}}
+	ep := &endpoint{id: "0123456789ab"}
+	ep.addr, _ = netutils.ParseCIDR("10.1.0.5/24")
+	ep.addrv6, _ = netutils.ParseCIDR("fd00::a01:6/64")
+
+	n.macMode = macFromIP
+	mac, err := n.generateMAC(ep)
+	assert.Nil(t, err)
+	assert.Equal(t, "02:42:0a:01:00:05", mac.String())
+	ep.addr = nil
+	mac, err = n.generateMAC(ep)
+	assert.Nil(t, err)
+	assert.Equal(t, "02:42:0a:01:00:06", mac.String())
+	ep.addrv6 = nil
+	_, err = n.generateMAC(ep)
+	assert.NotNil(t, err)
+
+	n.macMode = macHash
+	mac, err = n.generateMAC(ep)
+	assert.Nil(t, err)
+	assert.Equal(t, netutils.GenerateMACFromID(ep.id), mac)
+
+	n.macMode = macRandom
+	mac, err = n.generateMAC(ep)
+	assert.Nil(t, err)
+	assert.Len(t, mac, 6)
+}
+
+func TestCreateEndpointMACCollision(t *testing.T) {
+	_, restore := newFakeLinks()
+	defer restore()
+
+	d, n, _ := newTestEndpointDriver()
+	n.macMode = macFromIP
+	res, err := d.CreateEndpoint(&pluginNet.CreateEndpointRequest{
+		NetworkID:  n.id,
+		EndpointID: "0123456789ab",
+		Interface:  &pluginNet.EndpointInterface{Address: "10.1.0.5/24"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "02:42:0a:01:00:05", res.Interface.MacAddress)
+
+	// a static mac of another endpoint is rejected
+	_, err = d.CreateEndpoint(&pluginNet.CreateEndpointRequest{
+		NetworkID:  n.id,
+		EndpointID: "0123456789ac",
+		Interface:  &pluginNet.EndpointInterface{Address: "10.1.0.6/24", MacAddress: "02:42:0a:01:00:05"},
+	})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "already used by endpoint 0123456")
+	}
+	assert.Len(t, n.endpoints, 1)
+}
+
+func TestReserveMAC(t *testing.T) {
+	_, n, _ := newTestEndpointDriver()
+	mac, _ := net.ParseMAC("02:42:0a:01:00:05")
+	errs := make(chan error)
+	for _, id := range []string{"0123456789ab", "0123456789ac"} {
+		go func(ep *endpoint) { errs <- n.reserveMAC(ep) }(&endpoint{id: id, nid: n.id, mac: mac})
+	}
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			failed++
+		}
+	}
+	assert.Equal(t, 1, failed)
+	assert.Len(t, n.endpoints, 1)
+}
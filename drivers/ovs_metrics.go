@@ -0,0 +1,214 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "ovs_driver"
+	metricsPath      = "/metrics"
+	resultSuccess    = "success"
+	resultError      = "error"
+)
+
+// counters of the plugin calls and ovsdb transactions, they are updated even
+// when no metrics listener is configured
+var (
+	operationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operations_total",
+		Help:      "Number of plugin calls by operation and result.",
+	}, []string{"operation", "result"})
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of the plugin calls by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	ovsdbTransactionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ovsdb_transactions_total",
+		Help:      "Number of ovsdb transactions by result.",
+	}, []string{"result"})
+	ovsdbTransactionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "ovsdb_transaction_duration_seconds",
+		Help:      "Latency of the ovsdb transactions.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+// port statistics exported per endpoint, by ovs statistics key
+var portStatistics = map[string]*prometheus.Desc{}
+
+func init() {
+	for key, help := range map[string]string{
+		"rx_bytes":   "Bytes received by the endpoint port.",
+		"tx_bytes":   "Bytes sent by the endpoint port.",
+		"rx_packets": "Packets received by the endpoint port.",
+		"tx_packets": "Packets sent by the endpoint port.",
+		"rx_dropped": "Received packets dropped by the endpoint port.",
+		"tx_dropped": "Sent packets dropped by the endpoint port.",
+		"rx_errors":  "Receive errors of the endpoint port.",
+		"tx_errors":  "Transmit errors of the endpoint port.",
+	} {
+		portStatistics[key] = prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "endpoint", key+"_total"),
+			help, []string{"network", "endpoint", "port"}, nil)
+	}
+}
+
+// observeOperation counts a plugin call and its latency
+func observeOperation(operation string, start time.Time, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultError
+	}
+	operationsTotal.WithLabelValues(operation, result).Inc()
+	operationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// observeTransaction counts an ovsdb transaction and its latency
+func observeTransaction(start time.Time, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultError
+	}
+	ovsdbTransactionsTotal.WithLabelValues(result).Inc()
+	ovsdbTransactionDuration.Observe(time.Since(start).Seconds())
+}
+
+// portCollector exports the statistics column of the endpoint interfaces
+// kept in the ovsdb cache
+type portCollector struct {
+	ovsdb *OvsdbDriver
+}
+
+func (c *portCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range portStatistics {
+		ch <- desc
+	}
+}
+
+func (c *portCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, intf := range c.ovsdb.InterfaceStatistics(extIDEndpoint) {
+		for key, value := range intf.Statistics {
+			desc, ok := portStatistics[key]
+			if !ok {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value),
+				intf.ExternalIDs[extIDNetwork], intf.ExternalIDs[extIDEndpoint], intf.Name)
+		}
+	}
+}
+
+// startMetrics serves the prometheus metrics over http on addr
+func (d *Driver) startMetrics(addr string) error {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(operationsTotal, operationDuration, ovsdbTransactionsTotal, ovsdbTransactionDuration,
+		&portCollector{ovsdb: d.ovsdb})
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics on %s: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	logrus.Infof("Serving ovs driver metrics on http://%s%s", l.Addr(), metricsPath)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			logrus.Errorf("Error serving metrics. Err: %v", err)
+		}
+	}()
+	return nil
+}
+
+// metricsDriver counts the plugin calls of the driver
+type metricsDriver struct {
+	*Driver
+}
+
+// WithMetrics returns the driver counting the calls and latency of every
+// plugin operation
+func WithMetrics(d *Driver) pluginNet.Driver {
+	return &metricsDriver{d}
+}
+
+func (m *metricsDriver) GetCapabilities() (res *pluginNet.CapabilitiesResponse, err error) {
+	defer func(start time.Time) { observeOperation("GetCapabilities", start, err) }(time.Now())
+	return m.Driver.GetCapabilities()
+}
+
+func (m *metricsDriver) CreateNetwork(r *pluginNet.CreateNetworkRequest) (err error) {
+	defer func(start time.Time) { observeOperation("CreateNetwork", start, err) }(time.Now())
+	return m.Driver.CreateNetwork(r)
+}
+
+func (m *metricsDriver) AllocateNetwork(r *pluginNet.AllocateNetworkRequest) (res *pluginNet.AllocateNetworkResponse, err error) {
+	defer func(start time.Time) { observeOperation("AllocateNetwork", start, err) }(time.Now())
+	return m.Driver.AllocateNetwork(r)
+}
+
+func (m *metricsDriver) DeleteNetwork(r *pluginNet.DeleteNetworkRequest) (err error) {
+	defer func(start time.Time) { observeOperation("DeleteNetwork", start, err) }(time.Now())
+	return m.Driver.DeleteNetwork(r)
+}
+
+func (m *metricsDriver) FreeNetwork(r *pluginNet.FreeNetworkRequest) (err error) {
+	defer func(start time.Time) { observeOperation("FreeNetwork", start, err) }(time.Now())
+	return m.Driver.FreeNetwork(r)
+}
+
+func (m *metricsDriver) CreateEndpoint(r *pluginNet.CreateEndpointRequest) (res *pluginNet.CreateEndpointResponse, err error) {
+	defer func(start time.Time) { observeOperation("CreateEndpoint", start, err) }(time.Now())
+	return m.Driver.CreateEndpoint(r)
+}
+
+func (m *metricsDriver) DeleteEndpoint(r *pluginNet.DeleteEndpointRequest) (err error) {
+	defer func(start time.Time) { observeOperation("DeleteEndpoint", start, err) }(time.Now())
+	return m.Driver.DeleteEndpoint(r)
+}
+
+func (m *metricsDriver) EndpointInfo(r *pluginNet.InfoRequest) (res *pluginNet.InfoResponse, err error) {
+	defer func(start time.Time) { observeOperation("EndpointInfo", start, err) }(time.Now())
+	return m.Driver.EndpointInfo(r)
+}
+
+func (m *metricsDriver) Join(r *pluginNet.JoinRequest) (res *pluginNet.JoinResponse, err error) {
+	defer func(start time.Time) { observeOperation("Join", start, err) }(time.Now())
+	return m.Driver.Join(r)
+}
+
+func (m *metricsDriver) Leave(r *pluginNet.LeaveRequest) (err error) {
+	defer func(start time.Time) { observeOperation("Leave", start, err) }(time.Now())
+	return m.Driver.Leave(r)
+}
+
+func (m *metricsDriver) DiscoverNew(r *pluginNet.DiscoveryNotification) (err error) {
+	defer func(start time.Time) { observeOperation("DiscoverNew", start, err) }(time.Now())
+	return m.Driver.DiscoverNew(r)
+}
+
+func (m *metricsDriver) DiscoverDelete(r *pluginNet.DiscoveryNotification) (err error) {
+	defer func(start time.Time) { observeOperation("DiscoverDelete", start, err) }(time.Now())
+	return m.Driver.DiscoverDelete(r)
+}
+
+func (m *metricsDriver) ProgramExternalConnectivity(r *pluginNet.ProgramExternalConnectivityRequest) (err error) {
+	defer func(start time.Time) { observeOperation("ProgramExternalConnectivity", start, err) }(time.Now())
+	return m.Driver.ProgramExternalConnectivity(r)
+}
+
+func (m *metricsDriver) RevokeExternalConnectivity(r *pluginNet.RevokeExternalConnectivityRequest) (err error) {
+	defer func(start time.Time) { observeOperation("RevokeExternalConnectivity", start, err) }(time.Now())
+	return m.Driver.RevokeExternalConnectivity(r)
+}
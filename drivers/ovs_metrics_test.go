@@ -0,0 +1,56 @@
+package drivers
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/socketplane/libovsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newStatisticsOvsdb() *OvsdbDriver {
+	intfs := map[libovsdb.UUID]libovsdb.Row{
+		{GoUUID: "1"}: {Fields: map[string]interface{}{
+			"name": "vport0000001",
+			"external_ids": libovsdb.OvsMap{GoMap: map[interface{}]interface{}{
+				extIDNetwork:  "ba9876543210",
+				extIDEndpoint: "0000000000001",
+			}},
+			"statistics": libovsdb.OvsMap{GoMap: map[interface{}]interface{}{
+				"rx_bytes":   float64(1500),
+				"tx_bytes":   float64(3000),
+				"rx_packets": float64(10),
+				"collisions": float64(0),
+			}},
+		}},
+		{GoUUID: "2"}: {Fields: map[string]interface{}{
+			"name":       "ovs-br0",
+			"statistics": libovsdb.OvsMap{GoMap: map[interface{}]interface{}{"rx_bytes": float64(42)}},
+		}},
+	}
+	return &OvsdbDriver{cache: map[string]map[libovsdb.UUID]libovsdb.Row{intfTable: intfs}}
+}
+
+func TestInterfaceStatistics(t *testing.T) {
+	stats := newStatisticsOvsdb().InterfaceStatistics(extIDEndpoint)
+	if assert.Len(t, stats, 1) {
+		assert.Equal(t, "vport0000001", stats[0].Name)
+		assert.Equal(t, "0000000000001", stats[0].ExternalIDs[extIDEndpoint])
+		assert.Equal(t, int64(1500), stats[0].Statistics["rx_bytes"])
+		assert.Equal(t, int64(3000), stats[0].Statistics["tx_bytes"])
+		assert.Len(t, stats[0].Statistics, 4)
+	}
+}
+
+func TestPortCollector(t *testing.T) {
+	c := &portCollector{ovsdb: newStatisticsOvsdb()}
+	ch := make(chan prometheus.Metric, 10)
+	c.Collect(ch)
+	close(ch)
+	metrics := 0
+	for range ch {
+		metrics++
+	}
+	// collisions are not exported
+	assert.Equal(t, 3, metrics)
+}
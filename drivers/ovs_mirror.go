@@ -0,0 +1,163 @@
+package drivers
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+)
+
+// external_ids of the mirrors created by the driver and their tap ports
+const (
+	extIDMirror         = "ovs-driver.mirror"
+	extIDMirrorEndpoint = "ovs-driver.mirror-endpoint-id"
+	extIDMirrorNetwork  = "ovs-driver.mirror-network-id"
+	extIDMirrorTap      = "ovs-driver.mirror-tap"
+	maxPortNameLen      = 15
+)
+
+// MirrorRequest creates a mirror of the ports of an endpoint, of the vlan of
+// a network or of all ports of a bridge. The traffic is sent to an existing
+// output port or to a new internal tap port.
+type MirrorRequest struct {
+	Name string
+	// Endpoint and Network are ids or unique id prefixes
+	Endpoint string
+	Network  string
+	All      bool
+	// Bridge of a mirror of all ports, the default bridge if empty
+	Bridge     string
+	OutputPort string
+	Tap        string
+}
+
+// CreateMirror adds a mirror to the bridge of its source
+func (d *Driver) CreateMirror(r *MirrorRequest) (*MirrorInfo, error) {
+	opts := MirrorOptions{
+		Name:        r.Name,
+		OutputPort:  r.OutputPort,
+		ExternalIDs: map[string]string{extIDMirror: r.Name},
+	}
+	if r.Tap != "" {
+		if r.OutputPort != "" {
+			return nil, fmt.Errorf("mirror %s needs either an output port or a tap", r.Name)
+		}
+		if len(r.Tap) > maxPortNameLen {
+			return nil, fmt.Errorf("mirror tap name %s is longer than %d characters", r.Tap, maxPortNameLen)
+		}
+		opts.OutputPort = r.Tap
+		opts.CreateOutput = true
+		opts.ExternalIDs[extIDMirrorTap] = r.Tap
+	}
+	switch {
+	case r.Endpoint != "" && r.Network == "" && !r.All:
+		n, ep, err := d.findEndpoint(r.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		opts.Bridge = n.bridge
+		opts.SelectPort = ep.ovsPortName()
+		opts.ExternalIDs[extIDMirrorEndpoint] = ep.id
+	case r.Network != "" && r.Endpoint == "" && !r.All:
+		n, err := d.findNetwork(r.Network)
+		if err != nil {
+			return nil, err
+		}
+		if n.vlan == 0 {
+			return nil, fmt.Errorf("network %s has no vlan to mirror", n.id)
+		}
+		opts.Bridge = n.bridge
+		opts.SelectVlan = n.vlan
+		opts.ExternalIDs[extIDMirrorNetwork] = n.id
+	case r.All && r.Endpoint == "" && r.Network == "":
+		opts.Bridge = r.Bridge
+		if opts.Bridge == "" {
+			opts.Bridge = d.bridgeName()
+		}
+		opts.SelectAll = true
+	default:
+		return nil, fmt.Errorf("mirror %s must select an endpoint, a network or all ports", r.Name)
+	}
+	if err := d.ovsdb.CreateMirror(opts); err != nil {
+		return nil, fmt.Errorf("ovs create mirror %s failed: %v", r.Name, err)
+	}
+	if r.Tap != "" {
+		// bring the tap up for capturing on the host
+		if _, err := d.ovsdb.WaitForOfport(r.Tap, portReadyTimeout); err != nil {
+			logrus.Warnf("Failed waiting for tap %s of mirror %s: %v", r.Tap, r.Name, err)
+		} else if err := netutils.SetLinkUp(r.Tap); err != nil {
+			logrus.Warnf("Failed to set tap %s of mirror %s up: %v", r.Tap, r.Name, err)
+		}
+	}
+	logrus.Infof("Created ovs mirror %s on bridge %s to port %s", r.Name, opts.Bridge, opts.OutputPort)
+	return newMirrorInfo(opts), nil
+}
+
+// newMirrorInfo returns the mirror created with opts like MirrorInfos lists
+// it, without statistics yet
+func newMirrorInfo(opts MirrorOptions) *MirrorInfo {
+	info := &MirrorInfo{
+		Name:        opts.Name,
+		Bridge:      opts.Bridge,
+		SelectPorts: []string{},
+		SelectVlans: []int{},
+		OutputPort:  opts.OutputPort,
+		SelectAll:   opts.SelectAll,
+		ExternalIDs: opts.ExternalIDs,
+	}
+	if opts.SelectPort != "" {
+		info.SelectPorts = append(info.SelectPorts, opts.SelectPort)
+	}
+	if opts.SelectVlan != 0 {
+		info.SelectVlans = append(info.SelectVlans, opts.SelectVlan)
+	}
+	return info
+}
+
+// MirrorInfos lists the mirrors created by the driver
+func (d *Driver) MirrorInfos() []MirrorInfo {
+	infos := []MirrorInfo{}
+	for _, m := range d.ovsdb.Mirrors() {
+		if _, ok := m.ExternalIDs[extIDMirror]; ok {
+			infos = append(infos, m)
+		}
+	}
+	return infos
+}
+
+// DeleteMirror removes a mirror created by the driver and its tap port
+func (d *Driver) DeleteMirror(name string) error {
+	for _, m := range d.MirrorInfos() {
+		if m.Name == name {
+			return d.deleteMirror(m)
+		}
+	}
+	return fmt.Errorf("mirror %q not found", name)
+}
+
+func (d *Driver) deleteMirror(m MirrorInfo) error {
+	if err := d.ovsdb.DeleteMirror(m.Name); err != nil {
+		return fmt.Errorf("ovs delete mirror %s failed: %v", m.Name, err)
+	}
+	if tap := m.ExternalIDs[extIDMirrorTap]; tap != "" {
+		if err := delOvsPort(d.ovsdb, tap); err != nil {
+			return fmt.Errorf("ovs delete tap %s of mirror %s failed: %v", tap, m.Name, err)
+		}
+	}
+	logrus.Infof("Deleted ovs mirror %s", m.Name)
+	return nil
+}
+
+// deleteMirrorsOf removes the mirrors of the endpoint or network, ovsdb
+// would keep them without a source
+func (d *Driver) deleteMirrorsOf(key, id string) error {
+	for _, m := range d.MirrorInfos() {
+		if m.ExternalIDs[key] != id {
+			continue
+		}
+		if err := d.deleteMirror(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
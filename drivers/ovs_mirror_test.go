@@ -0,0 +1,135 @@
+package drivers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/socketplane/libovsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMirrorOvsdb() *OvsdbDriver {
+	portSet, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUUID: "p1"}, {GoUUID: "p2"}})
+	return &OvsdbDriver{cache: map[string]map[libovsdb.UUID]libovsdb.Row{
+		bridgeTable: {
+			{GoUUID: "b1"}: {Fields: map[string]interface{}{
+				"name":    ovsBridgeName,
+				"ports":   *portSet,
+				"mirrors": libovsdb.UUID{GoUUID: "m1"},
+			}},
+		},
+		portTable: {
+			{GoUUID: "p1"}: {Fields: map[string]interface{}{"name": "vport0000001"}},
+			{GoUUID: "p2"}: {Fields: map[string]interface{}{"name": "ids0"}},
+		},
+		mirrorTable: {
+			{GoUUID: "m1"}: {Fields: map[string]interface{}{
+				"name":            "span",
+				"select_all":      false,
+				"select_src_port": libovsdb.UUID{GoUUID: "p1"},
+				"select_dst_port": libovsdb.UUID{GoUUID: "p1"},
+				"select_vlan":     libovsdb.OvsSet{},
+				"output_port":     libovsdb.UUID{GoUUID: "p2"},
+				"external_ids": libovsdb.OvsMap{GoMap: map[interface{}]interface{}{
+					extIDMirror:         "span",
+					extIDMirrorEndpoint: "0000000000001",
+				}},
+				"statistics": libovsdb.OvsMap{GoMap: map[interface{}]interface{}{"tx_packets": float64(7)}},
+			}},
+		},
+	}}
+}
+
+func TestMirrors(t *testing.T) {
+	mirrors := newMirrorOvsdb().Mirrors()
+	if assert.Len(t, mirrors, 1) {
+		m := mirrors[0]
+		assert.Equal(t, "span", m.Name)
+		assert.Equal(t, ovsBridgeName, m.Bridge)
+		assert.Equal(t, []string{"vport0000001"}, m.SelectPorts)
+		assert.Equal(t, []int{}, m.SelectVlans)
+		assert.Equal(t, "ids0", m.OutputPort)
+		assert.Equal(t, int64(7), m.Statistics["tx_packets"])
+
+		// a created mirror is returned like it is listed
+		created := newMirrorInfo(MirrorOptions{
+			Name:        m.Name,
+			Bridge:      m.Bridge,
+			SelectPort:  "vport0000001",
+			OutputPort:  m.OutputPort,
+			ExternalIDs: m.ExternalIDs,
+		})
+		m.Statistics = nil
+		assert.Equal(t, m, *created)
+	}
+	vlan := newMirrorInfo(MirrorOptions{Name: "vlan", SelectVlan: 10})
+	assert.Equal(t, []string{}, vlan.SelectPorts)
+	assert.Equal(t, []int{10}, vlan.SelectVlans)
+}
+
+func TestMirrorOperations(t *testing.T) {
+	d := newMirrorOvsdb()
+	ops, err := d.mirrorOperations(MirrorOptions{Name: "web", Bridge: ovsBridgeName, SelectPort: "vport0000001", OutputPort: "ids0"})
+	assert.Nil(t, err)
+	if assert.Len(t, ops, 2) {
+		assert.Equal(t, mirrorTable, ops[0].Table)
+		assert.Equal(t, libovsdb.UUID{GoUUID: "p1"}, ops[0].Row["select_src_port"])
+		assert.Equal(t, libovsdb.UUID{GoUUID: "p2"}, ops[0].Row["output_port"])
+		assert.Equal(t, bridgeTable, ops[1].Table)
+	}
+
+	ops, err = d.mirrorOperations(MirrorOptions{Name: "vlan10", Bridge: ovsBridgeName, SelectVlan: 10, OutputPort: "tap0", CreateOutput: true})
+	assert.Nil(t, err)
+	if assert.Len(t, ops, 5) {
+		assert.Equal(t, intfTable, ops[0].Table)
+		assert.Equal(t, portTable, ops[1].Table)
+		assert.Equal(t, 10, ops[3].Row["select_vlan"])
+		assert.Equal(t, libovsdb.UUID{GoUUID: "port"}, ops[3].Row["output_port"])
+	}
+
+	for _, opts := range []MirrorOptions{
+		{Name: "none", Bridge: ovsBridgeName, OutputPort: "ids0"},
+		{Name: "two", Bridge: ovsBridgeName, SelectAll: true, SelectVlan: 10, OutputPort: "ids0"},
+		{Name: "span", Bridge: ovsBridgeName, SelectAll: true, OutputPort: "ids0"},
+		{Name: "nobridge", Bridge: "ovs-br1", SelectAll: true, OutputPort: "ids0"},
+		{Name: "noport", Bridge: ovsBridgeName, SelectPort: "vport0000002", OutputPort: "ids0"},
+		{Name: "nooutput", Bridge: ovsBridgeName, SelectAll: true, OutputPort: "ids1"},
+		{Name: "taptaken", Bridge: ovsBridgeName, SelectAll: true, OutputPort: "ids0", CreateOutput: true},
+	} {
+		_, err := d.mirrorOperations(opts)
+		assert.NotNil(t, err, opts.Name)
+	}
+}
+
+func TestAdminMirrors(t *testing.T) {
+	d, n, _ := newTestEndpointDriver()
+	d.ovsdb = newMirrorOvsdb()
+	h := d.adminHandler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/mirrors", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"Name":"span"`)
+
+	for _, body := range []string{
+		`{`,
+		`{"Name":"web","Endpoint":"ffff","OutputPort":"ids0"}`,
+		`{"Name":"web","Network":"` + n.id + `","OutputPort":"ids0"}`,
+		`{"Name":"web","All":true,"Endpoint":"0000","OutputPort":"ids0"}`,
+		`{"Name":"web","All":true,"OutputPort":"ids0","Tap":"tap0"}`,
+		`{"Name":"web","All":true,"Tap":"tap0123456789abcdef"}`,
+	} {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/mirrors", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/mirrors/other", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/mirrors/span", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,322 @@
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/datastore"
+)
+
+const ovsNetworkPrefix = "ovs/network"
+
+// Networks are stored in the local store. Restore them so that endpoints
+// and later requests do not depend on swarm after a restart.
+func (d *Driver) restoreNetworks() error {
+	if d.localStore == nil {
+		logrus.Debugf("Cannot restore ovs networks because local datastore is missing.")
+		return nil
+	}
+	logrus.Debugf("Restore ovs networks from local datastore.")
+
+	kvol, err := d.localStore.List(datastore.Key(ovsNetworkPrefix), &network{})
+	if err != nil && err != datastore.ErrKeyNotFound {
+		return fmt.Errorf("failed to read ovs network from store: %v", err)
+	}
+
+	if err == datastore.ErrKeyNotFound {
+		logrus.Debugf("Restore network,But key not found.key=%s ", ovsNetworkPrefix)
+		return nil
+	}
+	for _, kvo := range kvol {
+		n := kvo.(*network)
+		n.driver = d
+		n.endpoints = endpointTable{}
+		logrus.Debugf("Success restore network=%s from local store ", n.id)
+		d.Lock()
+		d.networks[n.id] = n
+		d.Unlock()
+	}
+	return nil
+}
+
+func (d *Driver) writeNetworkToStore(n *network) error {
+	if d.localStore == nil {
+		return fmt.Errorf("ovs local store not initialized, network not added")
+	}
+
+	if err := d.localStore.PutObjectAtomic(n); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *Driver) deleteNetworkFromStore(n *network) error {
+	if d.localStore == nil {
+		return fmt.Errorf("ovs local store not initialized, network not deleted")
+	}
+
+	if err := d.localStore.DeleteObjectAtomic(n); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (n *network) New() datastore.KVObject {
+	return &network{}
+}
+
+func (n *network) CopyTo(o datastore.KVObject) error {
+	dstn := o.(*network)
+	dstn.id = n.id
+	dstn.vlan = n.vlan
+	dstn.bandwidth = n.bandwidth
+	dstn.brust = n.brust
+	dstn.encap = n.encap
+	dstn.vni = n.vni
+	dstn.routes = n.routes
+	dstn.internal = n.internal
+	dstn.bridge = n.bridge
+	dstn.brOpts = n.brOpts
+	dstn.brCleanup = n.brCleanup
+	dstn.attach = n.attach
+	dstn.parent = n.parent
+	dstn.parentCreated = n.parentCreated
+	dstn.parentAttached = n.parentAttached
+	dstn.bond = n.bond
+	dstn.bondOpts = n.bondOpts
+	dstn.bondAttached = n.bondAttached
+	dstn.acl = n.acl
+	dstn.aclDefault = n.aclDefault
+	dstn.portSecurity = n.portSecurity
+	dstn.macMode = n.macMode
+	dstn.driver = n.driver
+	dstn.endpoints = n.endpoints
+	dstn.subnets = n.subnets
+	dstn.dbExists = n.dbExists
+	dstn.dbIndex = n.dbIndex
+	return nil
+}
+
+func (n *network) DataScope() string {
+	return datastore.LocalScope
+}
+
+func (n *network) Key() []string {
+	return []string{ovsNetworkPrefix, n.id}
+}
+
+func (n *network) KeyPrefix() []string {
+	return []string{ovsNetworkPrefix}
+}
+
+func (n *network) Index() uint64 {
+	return n.dbIndex
+}
+
+func (n *network) SetIndex(index uint64) {
+	n.dbIndex = index
+	n.dbExists = true
+}
+
+func (n *network) Exists() bool {
+	return n.dbExists
+}
+
+func (n *network) Skip() bool {
+	return false
+}
+
+func (n *network) Value() []byte {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (n *network) SetValue(value []byte) error {
+	return json.Unmarshal(value, n)
+}
+
+func (n *network) MarshalJSON() ([]byte, error) {
+	nMap := make(map[string]interface{})
+
+	nMap["id"] = n.id
+	nMap["vlan"] = n.vlan
+	nMap["bandwidth"] = n.bandwidth
+	nMap["brust"] = n.brust
+	nMap["internal"] = n.internal
+	nMap["bridge"] = n.bridge
+	nMap["bridgeCleanup"] = n.brCleanup
+	nMap["attach"] = n.attach
+	if n.brOpts.FailMode != "" {
+		nMap["bridgeFailMode"] = n.brOpts.FailMode
+	}
+	if n.brOpts.DatapathType != "" {
+		nMap["bridgeDatapathType"] = n.brOpts.DatapathType
+	}
+	if len(n.brOpts.OtherConfig) != 0 {
+		nMap["bridgeOtherConfig"] = n.brOpts.OtherConfig
+	}
+	if n.parent != "" {
+		nMap["parent"] = n.parent
+		nMap["parentCreated"] = n.parentCreated
+		nMap["parentAttached"] = n.parentAttached
+	}
+	if n.bond != "" {
+		nMap["bond"] = n.bond
+		nMap["bondInterfaces"] = n.bondOpts.Interfaces
+		nMap["bondMode"] = n.bondOpts.Mode
+		nMap["lacp"] = n.bondOpts.LACP
+		nMap["bondAttached"] = n.bondAttached
+	}
+	if n.acl != "" {
+		nMap["acl"] = n.acl
+	}
+	nMap["aclDefault"] = n.aclDefault
+	nMap["portSecurity"] = n.portSecurity
+	nMap["macMode"] = n.macMode
+	if n.encap != "" {
+		nMap["encap"] = n.encap
+		nMap["vni"] = n.vni
+	}
+	if len(n.routes) != 0 {
+		nMap["routes"] = n.routes
+	}
+	subnets := []map[string]string{}
+	for _, s := range n.subnets {
+		sMap := map[string]string{"subnetIP": s.subnetIP.String()}
+		if s.gwIP != nil {
+			sMap["gwIP"] = s.gwIP.String()
+		}
+		subnets = append(subnets, sMap)
+	}
+	nMap["subnets"] = subnets
+
+	return json.Marshal(nMap)
+}
+
+func (n *network) UnmarshalJSON(value []byte) error {
+	var (
+		err  error
+		nMap map[string]interface{}
+	)
+
+	if err = json.Unmarshal(value, &nMap); err != nil {
+		return err
+	}
+
+	n.id = nMap["id"].(string)
+	if v, ok := nMap["vlan"]; ok {
+		n.vlan = int(v.(float64))
+	}
+	if v, ok := nMap["bandwidth"]; ok {
+		n.bandwidth = int(v.(float64))
+	}
+	if v, ok := nMap["brust"]; ok {
+		n.brust = int(v.(float64))
+	}
+	if v, ok := nMap["internal"]; ok {
+		n.internal = v.(bool)
+	}
+	n.bridge = ovsBridgeName
+	if v, ok := nMap["bridge"]; ok {
+		n.bridge = v.(string)
+	}
+	if v, ok := nMap["bridgeCleanup"]; ok {
+		n.brCleanup = v.(bool)
+	}
+	n.attach = attachVeth
+	if v, ok := nMap["attach"]; ok && v.(string) != "" {
+		n.attach = v.(string)
+	}
+	if v, ok := nMap["bridgeFailMode"]; ok {
+		n.brOpts.FailMode = v.(string)
+	}
+	if v, ok := nMap["bridgeDatapathType"]; ok {
+		n.brOpts.DatapathType = v.(string)
+	}
+	if _, ok := nMap["bridgeOtherConfig"]; ok {
+		if err = decodeOption(nMap, "bridgeOtherConfig", &n.brOpts.OtherConfig); err != nil {
+			return fmt.Errorf("failed to decode network bridge other config after json unmarshal: %v", err)
+		}
+	}
+	if v, ok := nMap["parent"]; ok {
+		n.parent = v.(string)
+	}
+	if v, ok := nMap["parentCreated"]; ok {
+		n.parentCreated = v.(bool)
+	}
+	if v, ok := nMap["parentAttached"]; ok {
+		n.parentAttached = v.(bool)
+	}
+	if v, ok := nMap["bond"]; ok {
+		n.bond = v.(string)
+	}
+	if err = decodeOption(nMap, "bondInterfaces", &n.bondOpts.Interfaces); err != nil {
+		return fmt.Errorf("failed to decode network bond interfaces after json unmarshal: %v", err)
+	}
+	if v, ok := nMap["bondMode"]; ok {
+		n.bondOpts.Mode = v.(string)
+	}
+	if v, ok := nMap["lacp"]; ok {
+		n.bondOpts.LACP = v.(string)
+	}
+	if v, ok := nMap["bondAttached"]; ok {
+		n.bondAttached = v.(bool)
+	}
+	if v, ok := nMap["acl"]; ok {
+		n.acl = v.(string)
+	}
+	// networks stored before acls allowed all traffic
+	n.aclDefault = aclAllow
+	if v, ok := nMap["aclDefault"]; ok && v.(string) != "" {
+		n.aclDefault = v.(string)
+	}
+	// networks stored before the option had no port security
+	n.portSecurity = false
+	if v, ok := nMap["portSecurity"]; ok {
+		n.portSecurity = v.(bool)
+	}
+	// networks stored before the option used random mac addresses
+	n.macMode = macRandom
+	if v, ok := nMap["macMode"]; ok && v.(string) != "" {
+		n.macMode = v.(string)
+	}
+	if v, ok := nMap["encap"]; ok {
+		n.encap = v.(string)
+	}
+	if v, ok := nMap["vni"]; ok {
+		n.vni = int(v.(float64))
+	}
+	if _, ok := nMap["routes"]; ok {
+		var routes []*pluginNet.StaticRoute
+		if err = decodeOption(nMap, "routes", &routes); err != nil {
+			return fmt.Errorf("failed to decode network routes after json unmarshal: %v", err)
+		}
+		n.routes = routes
+	}
+	n.subnets = []*subnet{}
+	if v, ok := nMap["subnets"]; ok {
+		for _, sv := range v.([]interface{}) {
+			sMap := sv.(map[string]interface{})
+			s := &subnet{}
+			if _, s.subnetIP, err = net.ParseCIDR(sMap["subnetIP"].(string)); err != nil {
+				return fmt.Errorf("failed to decode network subnet after json unmarshal: %v", err)
+			}
+			if gw, ok := sMap["gwIP"]; ok {
+				if s.gwIP, err = netutils.ParseCIDR(gw.(string)); err != nil {
+					return fmt.Errorf("failed to decode network gateway after json unmarshal: %v", err)
+				}
+			}
+			n.subnets = append(n.subnets, s)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package drivers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetworkJSON(t *testing.T) {
+	n := &network{id: "ba9876543210", internal: true}
+	err := n.parseOptions(map[string]string{
+		vlanOption:           "100",
+		bandwidthOption:      "1000",
+		brustOption:          "100",
+		encapOption:          vxlanEncap,
+		vniOption:            "5000",
+		routesOption:         "10.2.0.0/16@10.1.0.1",
+		bridgeOption:         "ovs-br1",
+		failModeOption:       "secure",
+		otherConfOption:      "hwaddr=02:42:00:00:00:01",
+		bridgeCleanup:        "true",
+		attachOption:         attachInternal,
+		aclOption:            "allow,proto=tcp,port=80",
+		aclDefaultOption:     aclDeny,
+		portSecurityOption:   "false",
+		bondOption:           "bond0",
+		bondInterfacesOption: "eth1,eth2",
+		bondModeOption:       bondBalanceTCP,
+		lacpOption:           lacpActive,
+		macOption:            macHash,
+	})
+	assert.Nil(t, err)
+	n.addSubnet("10.1.0.0/24", "10.1.0.1/24")
+	n.addSubnet("fd00::/64", "")
+
+	b, err := n.MarshalJSON()
+	assert.Nil(t, err)
+	restored := &network{}
+	assert.Nil(t, restored.UnmarshalJSON(b))
+	assert.Equal(t, n.id, restored.id)
+	assert.Equal(t, 100, restored.vlan)
+	assert.Equal(t, 1000, restored.bandwidth)
+	assert.Equal(t, 100, restored.brust)
+	assert.Equal(t, vxlanEncap, restored.encap)
+	assert.Equal(t, 5000, restored.vni)
+	assert.True(t, restored.internal)
+	assert.Equal(t, n.routes, restored.routes)
+	assert.Equal(t, "ovs-br1", restored.bridge)
+	assert.Equal(t, attachInternal, restored.attach)
+	assert.Equal(t, "secure", restored.brOpts.FailMode)
+	assert.Equal(t, map[string]string{"hwaddr": "02:42:00:00:00:01"}, restored.brOpts.OtherConfig)
+	assert.True(t, restored.brCleanup)
+	assert.Equal(t, "allow,proto=tcp,port=80", restored.acl)
+	assert.Equal(t, aclDeny, restored.aclDefault)
+	assert.False(t, restored.portSecurity)
+	assert.Equal(t, "bond0", restored.bond)
+	assert.Equal(t, macHash, restored.macMode)
+	assert.Equal(t, BondOptions{Interfaces: []string{"eth1", "eth2"}, Mode: bondBalanceTCP, LACP: lacpActive}, restored.bondOpts)
+	assert.Equal(t, 2, len(restored.subnets))
+	assert.Equal(t, "10.1.0.0/24", restored.subnets[0].subnetIP.String())
+	assert.Equal(t, "10.1.0.1/24", restored.subnets[0].gwIP.String())
+	assert.Nil(t, restored.subnets[1].gwIP)
+}
+
+func TestGetGenericOptions(t *testing.T) {
+	opts := map[string]interface{}{
+		genericOption: map[string]interface{}{vlanOption: "10", "ignored": 1},
+	}
+	generic := getGenericOptions(opts)
+	assert.Equal(t, map[string]string{vlanOption: "10"}, generic)
+	assert.Equal(t, 10, getVlan(generic))
+	assert.Equal(t, map[string]string{}, getGenericOptions(nil))
+}
+
+func TestGetSwarmGateway(t *testing.T) {
+	assert.Equal(t, "10.1.0.1/24", getSwarmGateway("10.1.0.0/24", "10.1.0.1"))
+	assert.Equal(t, "10.1.0.1/24", getSwarmGateway("10.1.0.0/24", "10.1.0.1/24"))
+	assert.Equal(t, "", getSwarmGateway("10.1.0.0/24", ""))
+}
+
+func TestNetworkJSONDefaultBridge(t *testing.T) {
+	n := &network{}
+	assert.Nil(t, n.UnmarshalJSON([]byte(`{"id":"ba9876543210","vlan":10,"subnets":[{"subnetIP":"10.1.0.0/24"}]}`)))
+	assert.Equal(t, ovsBridgeName, n.bridge)
+	assert.Equal(t, attachVeth, n.attach)
+	assert.Equal(t, 10, n.vlan)
+	assert.Equal(t, aclAllow, n.aclDefault)
+	assert.False(t, n.portSecurity)
+}
+
+func TestGetAttach(t *testing.T) {
+	attach, err := getAttach(map[string]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, attachVeth, attach)
+	attach, err = getAttach(map[string]string{attachOption: attachInternal})
+	assert.Nil(t, err)
+	assert.Equal(t, attachInternal, attach)
+	_, err = getAttach(map[string]string{attachOption: "macvlan"})
+	assert.NotNil(t, err)
+}
+
+func TestGetBridgeOptions(t *testing.T) {
+	brOpts, err := getBridgeOptions(map[string]string{
+		failModeOption:  "standalone",
+		datapathOption:  "netdev",
+		otherConfOption: "stp-priority=100,hwaddr=02:42:00:00:00:01",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "standalone", brOpts.FailMode)
+	assert.Equal(t, "netdev", brOpts.DatapathType)
+	assert.Equal(t, "100", brOpts.OtherConfig["stp-priority"])
+	assert.Equal(t, "02:42:00:00:00:01", brOpts.OtherConfig["hwaddr"])
+
+	_, err = getBridgeOptions(map[string]string{failModeOption: "open"})
+	assert.NotNil(t, err)
+	_, err = getBridgeOptions(map[string]string{otherConfOption: "stp-priority"})
+	assert.NotNil(t, err)
+
+	n := &network{}
+	assert.Nil(t, n.parseOptions(map[string]string{}))
+	assert.Equal(t, ovsBridgeName, n.bridge)
+	n.driver = &Driver{config: &Config{Bridge: "ovs-br1"}}
+	assert.Nil(t, n.parseOptions(map[string]string{}))
+	assert.Equal(t, "ovs-br1", n.bridge)
+	assert.True(t, n.portSecurity)
+}
@@ -0,0 +1,107 @@
+package drivers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+)
+
+const parentOption = "parent"
+
+// parseParent splits a parent interface like eth1.100 into the master link
+// and the vlan id, vlan id is 0 for a plain interface
+func parseParent(parent string) (string, int, error) {
+	parts := strings.SplitN(parent, ".", 2)
+	if len(parts) == 1 || parts[0] == "" {
+		return parent, 0, nil
+	}
+	vlanID, err := strconv.Atoi(parts[1])
+	if err != nil || vlanID < 1 || vlanID > 4094 {
+		return "", 0, fmt.Errorf("invalid %s option %q, vlan must be between 1 and 4094", parentOption, parent)
+	}
+	return parts[0], vlanID, nil
+}
+
+// getParentUser returns another network attached to the same uplink
+func (d *Driver) getParentUser(n *network) *network {
+	d.Lock()
+	defer d.Unlock()
+	for _, other := range d.networks {
+		if other.id != n.id && other.bridge == n.bridge && other.parent == n.parent {
+			return other
+		}
+	}
+	return nil
+}
+
+// addParent attaches the parent interface of the network to its bridge as a
+// trunk port. The first network using the parent creates the vlan sub
+// interface if needed, later ones share it.
+func (d *Driver) addParent(n *network) error {
+	if n.parent == "" {
+		return nil
+	}
+	if other := d.getParentUser(n); other != nil {
+		n.parentCreated = other.parentCreated
+		n.parentAttached = other.parentAttached
+		return nil
+	}
+	if !netutils.LinkExists(n.parent) {
+		master, vlanID, err := parseParent(n.parent)
+		if err != nil {
+			return err
+		}
+		if vlanID == 0 {
+			return fmt.Errorf("parent interface %s does not exist", n.parent)
+		}
+		if err := netutils.CreateVlanLink(n.parent, master, vlanID); err != nil {
+			return err
+		}
+		n.parentCreated = true
+	}
+	if err := netutils.SetLinkUp(n.parent); err != nil {
+		d.deleteParentLink(n)
+		return err
+	}
+	if br := d.ovsdb.PortBridge(n.parent); br != "" {
+		if br != n.bridge {
+			d.deleteParentLink(n)
+			return fmt.Errorf("parent %s of network %s is attached to bridge %s instead of %s", n.parent, n.id, br, n.bridge)
+		}
+		logrus.Debugf("ovs parent port %s already attached", n.parent)
+		return nil
+	}
+	logrus.Debugf("ovs attach parent port=%s to bridge=%s", n.parent, n.bridge)
+	if err := d.ovsdb.AddPort(n.bridge, n.parent, "", 0, 0, 0, nil); err != nil {
+		d.deleteParentLink(n)
+		return fmt.Errorf("ovs attach parent %s failed for network %s: %v", n.parent, n.id, err)
+	}
+	n.parentAttached = true
+	return nil
+}
+
+// deleteParent detaches the parent interface once no other network uses it
+func (d *Driver) deleteParent(n *network) {
+	if n.parent == "" || d.getParentUser(n) != nil {
+		return
+	}
+	if n.parentAttached {
+		logrus.Debugf("ovs detach parent port=%s from bridge=%s", n.parent, n.bridge)
+		if err := d.ovsdb.DelPort(n.parent); err != nil {
+			logrus.Errorf("Error detaching parent %s of network %s. Err: %v", n.parent, n.id, err)
+		}
+	}
+	d.deleteParentLink(n)
+}
+
+func (d *Driver) deleteParentLink(n *network) {
+	if !n.parentCreated {
+		return
+	}
+	if err := netutils.DeleteLink(n.parent); err != nil {
+		logrus.Errorf("Error deleting parent link %s of network %s. Err: %v", n.parent, n.id, err)
+	}
+}
@@ -0,0 +1,245 @@
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/XiaoweiQian/ovs-driver/utils/iptables"
+)
+
+const (
+	portMapOption      = "com.docker.network.portmap"
+	exposedPortsOption = "com.docker.network.endpoint.exposedports"
+	dnatChain          = "OVS-DRIVER"
+	protoTCP           = 6
+	protoUDP           = 17
+	protoSCTP          = 132
+)
+
+// transportPort mirrors the exposed port passed by docker
+type transportPort struct {
+	Proto int
+	Port  uint16
+}
+
+// portBinding mirrors the port binding passed by docker
+type portBinding struct {
+	Proto       int
+	IP          net.IP
+	Port        uint16
+	HostIP      net.IP
+	HostPort    uint16
+	HostPortEnd uint16
+}
+
+func protoName(proto int) (string, error) {
+	switch proto {
+	case protoTCP:
+		return "tcp", nil
+	case protoUDP:
+		return "udp", nil
+	case protoSCTP:
+		return "sctp", nil
+	}
+	return "", fmt.Errorf("unsupported protocol %d", proto)
+}
+
+// getPortMapping decodes the port bindings from the external connectivity options
+func getPortMapping(opts map[string]interface{}) ([]portBinding, error) {
+	var bindings []portBinding
+	if err := decodeOption(opts, portMapOption, &bindings); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+// getExposedPorts decodes the exposed ports from the external connectivity options
+func getExposedPorts(opts map[string]interface{}) ([]transportPort, error) {
+	var ports []transportPort
+	if err := decodeOption(opts, exposedPortsOption, &ports); err != nil {
+		return nil, err
+	}
+	return ports, nil
+}
+
+func decodeOption(opts map[string]interface{}, key string, v interface{}) error {
+	o, ok := opts[key]
+	if !ok || o == nil {
+		return nil
+	}
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("failed to decode %s option: %v", key, err)
+	}
+	return nil
+}
+
+// initPortMapping creates the nat and filter chains used for published ports
+func initPortMapping() error {
+	if err := iptables.EnsureChain(iptables.Nat, dnatChain); err != nil {
+		return err
+	}
+	if err := iptables.EnsureJump(iptables.Nat, "PREROUTING", dnatChain, "-m", "addrtype", "--dst-type", "LOCAL"); err != nil {
+		return err
+	}
+	if err := iptables.EnsureJump(iptables.Nat, "OUTPUT", dnatChain, "-m", "addrtype", "--dst-type", "LOCAL", "!", "-d", "127.0.0.0/8"); err != nil {
+		return err
+	}
+	if err := iptables.EnsureChain(iptables.Filter, dnatChain); err != nil {
+		return err
+	}
+	return iptables.EnsureJump(iptables.Filter, "FORWARD", dnatChain)
+}
+
+// ensurePortMapping creates the port mapping chains unless they already exist,
+// retried on every call until it succeeds
+func (d *Driver) ensurePortMapping() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.portMapReady {
+		return nil
+	}
+	if err := initPortMapping(); err != nil {
+		return err
+	}
+	d.portMapReady = true
+	return nil
+}
+
+// allocateHostPort picks a free host port for bindings without a fixed one.
+// The returned listener keeps the port bound until the binding is revoked, so
+// no other process can take it in the meantime.
+func allocateHostPort(pb *portBinding) (io.Closer, error) {
+	if pb.HostPort != 0 && pb.HostPortEnd <= pb.HostPort {
+		return nil, nil
+	}
+	proto, err := protoName(pb.Proto)
+	if err != nil {
+		return nil, err
+	}
+	hostIP := ""
+	if pb.HostIP != nil && !pb.HostIP.IsUnspecified() {
+		hostIP = pb.HostIP.String()
+	}
+	if pb.HostPort == 0 {
+		port, l, err := bindPort(proto, hostIP, 0)
+		if err != nil {
+			return nil, err
+		}
+		pb.HostPort = port
+		pb.HostPortEnd = port
+		return l, nil
+	}
+	for p := pb.HostPort; p <= pb.HostPortEnd; p++ {
+		if port, l, err := bindPort(proto, hostIP, p); err == nil {
+			pb.HostPort = port
+			pb.HostPortEnd = port
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no free host port in range %d-%d", pb.HostPort, pb.HostPortEnd)
+}
+
+// bindPort binds the port and returns it with the listener holding it
+func bindPort(proto, hostIP string, port uint16) (uint16, io.Closer, error) {
+	addr := net.JoinHostPort(hostIP, strconv.Itoa(int(port)))
+	switch proto {
+	case "udp":
+		c, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return 0, nil, err
+		}
+		return uint16(c.LocalAddr().(*net.UDPAddr).Port), c, nil
+	default:
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return 0, nil, err
+		}
+		return uint16(l.Addr().(*net.TCPAddr).Port), l, nil
+	}
+}
+
+// holdHostPorts binds the host ports of a restored endpoint again, they
+// were released when the previous plugin process exited. The stored
+// bindings do not tell allocated ports from fixed ones, so all are held.
+func (ep *endpoint) holdHostPorts() {
+	for _, pb := range ep.portMapping {
+		proto, err := protoName(pb.Proto)
+		if err != nil {
+			continue
+		}
+		hostIP := ""
+		if pb.HostIP != nil && !pb.HostIP.IsUnspecified() {
+			hostIP = pb.HostIP.String()
+		}
+		_, l, err := bindPort(proto, hostIP, pb.HostPort)
+		if err != nil {
+			logrus.Warnf("Failed to hold host port %d of ovs endpoint %s: %v", pb.HostPort, ep.id[0:7], err)
+			continue
+		}
+		ep.hostPorts = append(ep.hostPorts, l)
+	}
+}
+
+// releaseHostPorts closes the listeners holding allocated host ports
+func releaseHostPorts(hostPorts []io.Closer) {
+	for _, l := range hostPorts {
+		l.Close()
+	}
+}
+
+// programPortBinding adds or removes the DNAT and forward rules of a binding
+func programPortBinding(ip net.IP, pb portBinding, action iptables.Action) error {
+	proto, err := protoName(pb.Proto)
+	if err != nil {
+		return err
+	}
+	dest := net.JoinHostPort(ip.String(), strconv.Itoa(int(pb.Port)))
+	natRule := []string{"-p", proto}
+	if pb.HostIP != nil && !pb.HostIP.IsUnspecified() {
+		natRule = append(natRule, "-d", pb.HostIP.String())
+	}
+	natRule = append(natRule, "--dport", strconv.Itoa(int(pb.HostPort)), "-j", "DNAT", "--to-destination", dest)
+	if err := iptables.ProgramRule(iptables.Nat, dnatChain, action, natRule...); err != nil {
+		return err
+	}
+	filterRule := []string{"-d", ip.String(), "-p", proto, "--dport", strconv.Itoa(int(pb.Port)), "-j", "ACCEPT"}
+	return iptables.ProgramRule(iptables.Filter, dnatChain, action, filterRule...)
+}
+
+// programPortMapping installs the DNAT rules of all bindings of the endpoint
+func (ep *endpoint) programPortMapping() error {
+	for i, pb := range ep.portMapping {
+		if err := programPortBinding(ep.addr.IP, pb, iptables.Append); err != nil {
+			for _, done := range ep.portMapping[:i] {
+				if err := programPortBinding(ep.addr.IP, done, iptables.Delete); err != nil {
+					logrus.Warnf("Failed to rollback port binding %v of endpoint %s: %v", done, ep.id, err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// revokePortMapping removes the DNAT rules of all bindings of the endpoint
+// and releases the host ports allocated for them
+func (ep *endpoint) revokePortMapping() error {
+	var lastErr error
+	for _, pb := range ep.portMapping {
+		if err := programPortBinding(ep.addr.IP, pb, iptables.Delete); err != nil {
+			logrus.Warnf("Failed to revoke port binding %v of endpoint %s: %v", pb, ep.id, err)
+			lastErr = err
+		}
+	}
+	releaseHostPorts(ep.hostPorts)
+	ep.hostPorts = nil
+	return lastErr
+}
@@ -0,0 +1,100 @@
+package drivers
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPortMapping(t *testing.T) {
+	var opts map[string]interface{}
+	raw := `{
+		"com.docker.network.portmap": [{"Proto": 6, "IP": "", "Port": 80, "HostIP": "", "HostPort": 8080, "HostPortEnd": 8080}],
+		"com.docker.network.endpoint.exposedports": [{"Proto": 6, "Port": 80}, {"Proto": 17, "Port": 53}]
+	}`
+	assert.Nil(t, json.Unmarshal([]byte(raw), &opts))
+
+	bindings, err := getPortMapping(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(bindings))
+	assert.Equal(t, protoTCP, bindings[0].Proto)
+	assert.Equal(t, uint16(80), bindings[0].Port)
+	assert.Equal(t, uint16(8080), bindings[0].HostPort)
+	assert.Nil(t, bindings[0].HostIP)
+
+	ports, err := getExposedPorts(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []transportPort{{Proto: protoTCP, Port: 80}, {Proto: protoUDP, Port: 53}}, ports)
+
+	bindings, err = getPortMapping(map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.Nil(t, bindings)
+}
+
+func TestEndpointPortMappingJSON(t *testing.T) {
+	_, addr, _ := net.ParseCIDR("10.1.0.0/24")
+	addr.IP = net.ParseIP("10.1.0.5").To4()
+	ep := &endpoint{
+		id:           "0123456789ab",
+		nid:          "ba9876543210",
+		intfName:     "port1234567",
+		addr:         addr,
+		exposedPorts: []transportPort{{Proto: protoTCP, Port: 80}},
+		portMapping: []portBinding{{
+			Proto:       protoTCP,
+			Port:        80,
+			HostIP:      net.ParseIP("192.168.0.1"),
+			HostPort:    8080,
+			HostPortEnd: 8080,
+		}},
+	}
+	b, err := ep.MarshalJSON()
+	assert.Nil(t, err)
+
+	restored := &endpoint{}
+	assert.Nil(t, restored.UnmarshalJSON(b))
+	assert.Equal(t, "10.1.0.5/24", restored.addr.String())
+	assert.Equal(t, ep.exposedPorts, restored.exposedPorts)
+	assert.Equal(t, 1, len(restored.portMapping))
+	assert.Equal(t, uint16(8080), restored.portMapping[0].HostPort)
+	assert.True(t, restored.portMapping[0].HostIP.Equal(net.ParseIP("192.168.0.1")))
+}
+
+func TestAllocateHostPort(t *testing.T) {
+	pb := &portBinding{Proto: protoTCP, Port: 80, HostIP: net.ParseIP("127.0.0.1")}
+	l, err := allocateHostPort(pb)
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	assert.NotEqual(t, uint16(0), pb.HostPort)
+	assert.Equal(t, pb.HostPort, pb.HostPortEnd)
+
+	// the port stays bound until it is released
+	_, _, err = bindPort("tcp", "127.0.0.1", pb.HostPort)
+	assert.NotNil(t, err)
+	releaseHostPorts([]io.Closer{l})
+	_, l, err = bindPort("tcp", "127.0.0.1", pb.HostPort)
+	assert.Nil(t, err)
+	l.Close()
+
+	fixed := &portBinding{Proto: protoTCP, Port: 80, HostPort: 8080, HostPortEnd: 8080}
+	l, err = allocateHostPort(fixed)
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+}
+
+func TestHoldHostPorts(t *testing.T) {
+	port, l, err := bindPort("udp", "127.0.0.1", 0)
+	assert.Nil(t, err)
+	l.Close()
+	ep := &endpoint{id: "0123456789ab", portMapping: []portBinding{
+		{Proto: protoUDP, Port: 53, HostIP: net.ParseIP("127.0.0.1"), HostPort: port, HostPortEnd: port},
+	}}
+	ep.holdHostPorts()
+	assert.Len(t, ep.hostPorts, 1)
+	_, _, err = bindPort("udp", "127.0.0.1", port)
+	assert.NotNil(t, err)
+	releaseHostPorts(ep.hostPorts)
+}
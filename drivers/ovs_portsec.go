@@ -0,0 +1,92 @@
+package drivers
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	portSecurityOption = "port_security"
+
+	// portSecurityPriority allows the traffic of the endpoint address, the
+	// rest of the traffic of the port is dropped below it
+	portSecurityPriority     = 40000
+	portSecurityDropPriority = 39000
+
+	portSecurityCookie = "port-security"
+)
+
+// getPortSecurity checks if the endpoints may only send from their own
+// addresses, true by default
+func getPortSecurity(opts map[string]string) (bool, error) {
+	v := opts[portSecurityOption]
+	if v == "" {
+		return true, nil
+	}
+	portSecurity, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s option %q, must be true or false", portSecurityOption, v)
+	}
+	return portSecurity, nil
+}
+
+// portSecurityFlows allows the traffic of the endpoint port with its mac
+// and ip addresses as source, including the sender of arp packets, and
+// drops everything else sent by the container
+func portSecurityFlows(ep *endpoint, ofport int) ([]string, error) {
+	if len(ep.mac) == 0 {
+		return nil, fmt.Errorf("endpoint %s has no mac address", ep.id[0:7])
+	}
+	cookie := flowCookie(ep.id, portSecurityCookie)
+	port := fmt.Sprintf("cookie=%#x,table=%d,in_port=%d", cookie, portSecurityTable, ofport)
+	matches := []string{}
+	if ep.addr != nil {
+		matches = append(matches,
+			fmt.Sprintf("ip,nw_src=%s", ep.addr.IP),
+			fmt.Sprintf("arp,arp_sha=%s,arp_spa=%s", ep.mac, ep.addr.IP),
+		)
+	}
+	if ep.addrv6 != nil {
+		matches = append(matches,
+			fmt.Sprintf("ipv6,ipv6_src=%s", ep.addrv6.IP),
+			// neighbor discovery uses the link local address, duplicate
+			// address detection the unspecified one
+			"ipv6,ipv6_src=fe80::/10",
+			"icmp6,ipv6_src=::",
+		)
+	}
+	flows := []string{}
+	for _, match := range matches {
+		flows = append(flows, fmt.Sprintf("%s,priority=%d,dl_src=%s,%s,actions=resubmit(,%d)", port, portSecurityPriority, ep.mac, match, aclTable))
+	}
+	return append(flows, fmt.Sprintf("%s,priority=%d,actions=drop", port, portSecurityDropPriority)), nil
+}
+
+// installPortSecurity replaces the port security flows of the endpoint on
+// its ofport
+func (d *Driver) installPortSecurity(n *network, ep *endpoint, ofport int) error {
+	flows, err := portSecurityFlows(ep, ofport)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("ovs install port security flows of endpoint %s on bridge %s: %v", ep.id[0:7], n.bridge, flows)
+	if err := replaceFlows(n.bridge, flowCookie(ep.id, portSecurityCookie), flows); err != nil {
+		return fmt.Errorf("ovs install port security flows of endpoint %s failed: %v", ep.id[0:7], err)
+	}
+	return nil
+}
+
+// removePortSecurity removes the port security flows of the endpoint, ovs
+// keeps flows of deleted ports and would apply them to the next port with
+// the same ofport
+func (d *Driver) removePortSecurity(n *network, ep *endpoint) error {
+	if !n.portSecurity {
+		return nil
+	}
+	if err := delFlowsByCookie(n.bridge, flowCookie(ep.id, portSecurityCookie)); err != nil {
+		return fmt.Errorf("ovs delete port security flows of endpoint %s failed: %v", ep.id[0:7], err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPortSecurity(t *testing.T) {
+	portSecurity, err := getPortSecurity(map[string]string{})
+	assert.Nil(t, err)
+	assert.True(t, portSecurity)
+	portSecurity, err = getPortSecurity(map[string]string{portSecurityOption: "false"})
+	assert.Nil(t, err)
+	assert.False(t, portSecurity)
+	_, err = getPortSecurity(map[string]string{portSecurityOption: "off"})
+	assert.NotNil(t, err)
+}
+
+func TestPortSecurityFlows(t *testing.T) {
+	ep := &endpoint{id: "0000000000001"}
+	_, err := portSecurityFlows(ep, 5)
+	assert.NotNil(t, err)
+
+	ep.mac, _ = net.ParseMAC("02:42:0a:01:00:05")
+	ep.addr, _ = netutils.ParseCIDR("10.1.0.5/24")
+	flows, err := portSecurityFlows(ep, 5)
+	assert.Nil(t, err)
+	port := fmt.Sprintf("cookie=%#x,table=0,in_port=5", flowCookie(ep.id, portSecurityCookie))
+	assert.Equal(t, []string{
+		port + ",priority=40000,dl_src=02:42:0a:01:00:05,ip,nw_src=10.1.0.5,actions=resubmit(,1)",
+		port + ",priority=40000,dl_src=02:42:0a:01:00:05,arp,arp_sha=02:42:0a:01:00:05,arp_spa=10.1.0.5,actions=resubmit(,1)",
+		port + ",priority=39000,actions=drop",
+	}, flows)
+
+	ep.addrv6, _ = netutils.ParseCIDR("fd00:1::5/64")
+	flows, err = portSecurityFlows(ep, 5)
+	assert.Nil(t, err)
+	assert.Len(t, flows, 6)
+	assert.Contains(t, flows, port+",priority=40000,dl_src=02:42:0a:01:00:05,ipv6,ipv6_src=fd00:1::5,actions=resubmit(,1)")
+}
+
+func TestRemovePortSecurity(t *testing.T) {
+	deleted := []uint64{}
+	defer func(del func(string, uint64) error) { delFlowsByCookie = del }(delFlowsByCookie)
+	delFlowsByCookie = func(bridge string, cookie uint64) error {
+		deleted = append(deleted, cookie)
+		return nil
+	}
+
+	_, n, _ := newTestEndpointDriver()
+	ep := &endpoint{id: "0000000000001", nid: n.id}
+	d := n.driver
+	assert.Nil(t, d.removePortSecurity(n, ep))
+	assert.Len(t, deleted, 0)
+	n.portSecurity = true
+	assert.Nil(t, d.removePortSecurity(n, ep))
+	assert.Equal(t, []uint64{flowCookie(ep.id, portSecurityCookie)}, deleted)
+}
+
+func TestPortSecurityRemoteOvsdb(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.OvsdbEndpoints = []string{"tcp:10.0.0.1:6640"}
+	n := &network{driver: &Driver{config: cfg}}
+	assert.Nil(t, n.parseOptions(map[string]string{}))
+	assert.False(t, n.portSecurity)
+	assert.NotNil(t, n.parseOptions(map[string]string{portSecurityOption: "true"}))
+	assert.Nil(t, n.parseOptions(map[string]string{portSecurityOption: "false"}))
+}
@@ -0,0 +1,330 @@
+package drivers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+	"github.com/docker/libnetwork/datastore"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	orphanLink     = "link"
+	orphanPort     = "port"
+	orphanEndpoint = "endpoint"
+	orphanFlows    = "flows"
+
+	actionPending = "pending"
+	actionDryRun  = "would remove"
+	actionRemoved = "removed"
+
+	// cleanupDelay separates the two passes of a one-off cleanup, endpoints
+	// being created by a running plugin are not removed
+	cleanupDelay = 2 * time.Second
+)
+
+// host links and their removal, replaced in tests
+var (
+	listLinkNames = func() ([]string, error) {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(links))
+		for _, link := range links {
+			names = append(names, link.Attrs().Name)
+		}
+		return names, nil
+	}
+	linkExists = netutils.LinkExists
+	deleteLink = netutils.DeleteLink
+)
+
+// ReconcileItem is an orphan found by a reconcile pass and what was done
+// about it
+type ReconcileItem struct {
+	Kind   string
+	Name   string
+	Action string
+}
+
+// reconciler remembers the orphans of the previous pass. Only orphans seen
+// twice in a row are removed, so endpoints being created or deleted
+// concurrently are left alone.
+type reconciler struct {
+	suspects map[string]bool
+}
+
+// startReconciler runs a reconcile pass every interval
+func (d *Driver) startReconciler(interval time.Duration) {
+	logrus.Infof("Reconciling ovs driver state every %s", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := d.Reconcile(d.reconcileDryRun()); err != nil {
+				logrus.Warnf("Failed to reconcile ovs driver state: %v", err)
+			}
+		}
+	}()
+}
+
+func (d *Driver) reconcileDryRun() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.config != nil && d.config.ReconcileDryRun
+}
+
+// Reconcile compares the host links with the endpoint prefix, the ovs ports
+// and the stored endpoints. Orphans seen in the previous pass as well are
+// removed unless dryRun is set.
+func (d *Driver) Reconcile(dryRun bool) ([]ReconcileItem, error) {
+	d.reconcileLock.Lock()
+	defer d.reconcileLock.Unlock()
+
+	orphans, err := d.findOrphans()
+	if err != nil {
+		return nil, err
+	}
+
+	suspects := map[string]bool{}
+	items := []ReconcileItem{}
+	for _, item := range orphans {
+		key := item.Kind + "/" + item.Name
+		suspects[key] = true
+		switch {
+		case !d.reconciler.suspects[key]:
+			item.Action = actionPending
+		case dryRun:
+			item.Action = actionDryRun
+		default:
+			item.Action = actionRemoved
+			if err := d.removeOrphan(item); err != nil {
+				item.Action = fmt.Sprintf("failed: %v", err)
+			}
+		}
+		logrus.Infof("ovs reconcile found orphan %s %s: %s", item.Kind, item.Name, item.Action)
+		items = append(items, item)
+	}
+	d.reconciler.suspects = suspects
+	return items, nil
+}
+
+// Cleanup runs a one-off reconcile next to or instead of the plugin, with
+// the networks and endpoints of the local store as the known state. Orphans
+// are removed when the second of two passes still finds them.
+func Cleanup(cfg *Config, dryRun bool) ([]ReconcileItem, error) {
+	d, err := newDriver(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer d.ovsdb.Close()
+
+	var items []ReconcileItem
+	for pass := 0; pass < 2; pass++ {
+		if pass > 0 {
+			time.Sleep(cleanupDelay)
+		}
+		// the store is reread as a running plugin may have changed it
+		if err := d.loadStoredState(); err != nil {
+			return nil, err
+		}
+		if items, err = d.Reconcile(dryRun); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// loadStoredState replaces the known networks and endpoints with the ones
+// of the local store, without touching links, ports or port mappings
+func (d *Driver) loadStoredState() error {
+	d.Lock()
+	d.networks = networkTable{}
+	d.Unlock()
+	if err := d.restoreNetworks(); err != nil {
+		return err
+	}
+	eps, err := d.storedEndpoints()
+	if err != nil {
+		return err
+	}
+	for _, ep := range eps {
+		d.Lock()
+		n, ok := d.networks[ep.nid]
+		d.Unlock()
+		if ok {
+			n.endpoints[ep.id] = ep
+		}
+	}
+	return nil
+}
+
+// findOrphans lists ovs ports first, then links, stored endpoints and
+// pipeline flows, the order they are removed in
+func (d *Driver) findOrphans() ([]ReconcileItem, error) {
+	prefix := d.vethPrefix()
+	// the names are the prefix and random lowercase hex, see GenerateIfaceName
+	isEndpointName := func(name string) bool {
+		name = strings.TrimPrefix(name, "v")
+		if len(name) != len(prefix)+intfLen || !strings.HasPrefix(name, prefix) {
+			return false
+		}
+		for _, c := range name[len(prefix):] {
+			if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+				return false
+			}
+		}
+		return true
+	}
+
+	known := map[string]bool{}
+	bridges := map[string]bool{}
+	for _, n := range d.getNetworks() {
+		bridges[n.bridge] = true
+		n.Lock()
+		for _, ep := range n.endpoints {
+			known[ep.intfName] = true
+			known[ep.ovsPortName()] = true
+		}
+		n.Unlock()
+	}
+
+	// only the ports of the bridges of the networks are looked at
+	orphans := []ReconcileItem{}
+	for bridge := range bridges {
+		for _, name := range d.ovsdb.bridgePortNames(bridge) {
+			if isEndpointName(name) && !known[name] {
+				orphans = append(orphans, ReconcileItem{Kind: orphanPort, Name: name})
+			}
+		}
+	}
+
+	links, err := listLinkNames()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, name := range links {
+		if isEndpointName(name) && !known[name] {
+			orphans = append(orphans, ReconcileItem{Kind: orphanLink, Name: name})
+		}
+	}
+
+	eps, err := d.storedEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	for _, ep := range eps {
+		if d.endpointStale(ep) {
+			orphans = append(orphans, ReconcileItem{Kind: orphanEndpoint, Name: ep.id})
+		}
+	}
+
+	// pipeline flows left on bridges without networks
+	if !d.localOvsdb() {
+		return orphans, nil
+	}
+	for _, bridge := range d.ovsdb.bridgeNames() {
+		if bridges[bridge] {
+			continue
+		}
+		flows, err := dumpFlowsByCookie(bridge, flowCookie(bridge, pipelineCookie))
+		if err != nil {
+			logrus.Debugf("Failed to dump the flows of ovs bridge %s: %v", bridge, err)
+			continue
+		}
+		if len(flows) != 0 {
+			orphans = append(orphans, ReconcileItem{Kind: orphanFlows, Name: bridge})
+		}
+	}
+	return orphans, nil
+}
+
+// endpointStale reports a stored endpoint whose network is gone or whose
+// bridge side does not exist anymore
+func (d *Driver) endpointStale(ep *endpoint) bool {
+	d.Lock()
+	_, ok := d.networks[ep.nid]
+	d.Unlock()
+	if !ok {
+		return true
+	}
+	if ep.attach == attachInternal {
+		return !ovsPortExists(d.ovsdb, ep.ovsPortName())
+	}
+	return !linkExists(ep.ovsPortName())
+}
+
+func (d *Driver) removeOrphan(item ReconcileItem) error {
+	switch item.Kind {
+	case orphanPort:
+		return delOvsPort(d.ovsdb, item.Name)
+	case orphanLink:
+		// deleting one end of a veth removes its peer too
+		if !linkExists(item.Name) {
+			return nil
+		}
+		return deleteLink(item.Name)
+	case orphanEndpoint:
+		return d.removeStaleEndpoint(item.Name)
+	case orphanFlows:
+		return delFlowsByCookie(item.Name, flowCookie(item.Name, pipelineCookie))
+	}
+	return fmt.Errorf("unknown orphan kind %s", item.Kind)
+}
+
+func (d *Driver) removeStaleEndpoint(eid string) error {
+	eps, err := d.storedEndpoints()
+	if err != nil {
+		return err
+	}
+	for _, ep := range eps {
+		if ep.id != eid {
+			continue
+		}
+		d.Lock()
+		n, ok := d.networks[ep.nid]
+		d.Unlock()
+		if ok {
+			if known := n.endpoint(ep.id); known != nil {
+				ep = known
+			}
+			return runSteps(d.deleteEndpointSteps(n, ep))
+		}
+		if err := ep.revokePortMapping(); err != nil {
+			logrus.Warnf("Failed to revoke port mapping of stale ovs endpoint %s: %v", ep.id[0:7], err)
+		}
+		return d.deleteEndpointFromStore(ep)
+	}
+	return nil
+}
+
+// storedEndpoints lists the endpoints in the local store
+func (d *Driver) storedEndpoints() ([]*endpoint, error) {
+	if d.localStore == nil {
+		return nil, nil
+	}
+	kvol, err := d.localStore.List(datastore.Key(ovsEndpointPrefix), &endpoint{})
+	if err == datastore.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ovs endpoint from store: %v", err)
+	}
+	eps := make([]*endpoint, 0, len(kvol))
+	for _, kvo := range kvol {
+		eps = append(eps, kvo.(*endpoint))
+	}
+	return eps, nil
+}
+
+func (d *Driver) getNetworks() []*network {
+	d.Lock()
+	defer d.Unlock()
+	nws := make([]*network, 0, len(d.networks))
+	for _, n := range d.networks {
+		nws = append(nws, n)
+	}
+	return nws
+}
@@ -0,0 +1,137 @@
+package drivers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/docker/libnetwork/datastore"
+	"github.com/socketplane/libovsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcile(t *testing.T) {
+	links, restore := newFakeLinks()
+	defer restore()
+	origList, origExists, origDelete, origDump := listLinkNames, linkExists, deleteLink, dumpFlowsByCookie
+	defer func() {
+		listLinkNames, linkExists, deleteLink, dumpFlowsByCookie = origList, origExists, origDelete, origDump
+	}()
+	dumpFlowsByCookie = func(bridge string, cookie uint64) ([]string, error) { return nil, nil }
+
+	// links and ports named like endpoints but not hex are not the driver's
+	hostLinks := map[string]bool{"eth0": true, "vport0000001": true, "port0000002": true, "vport0000002": true, "portchannel": true, "portABCDEF0": true}
+	listLinkNames = func() ([]string, error) {
+		names := []string{}
+		for name := range hostLinks {
+			names = append(names, name)
+		}
+		return names, nil
+	}
+	linkExists = func(name string) bool { return hostLinks[name] }
+	deleteLink = func(name string) error {
+		// removes the veth peer as well
+		delete(hostLinks, name)
+		delete(hostLinks, "v"+name)
+		return nil
+	}
+
+	// vport0000009 is on a bridge without networks of the driver
+	ports := map[libovsdb.UUID]libovsdb.Row{}
+	bridgePorts := map[string][]interface{}{}
+	for bridge, names := range map[string][]string{
+		ovsBridgeName: {"ovs-br0", "vport0000001", "vport0000003", "tunba980000beef", "portchannel"},
+		"br-foreign":  {"vport0000009"},
+	} {
+		for _, name := range names {
+			ports[libovsdb.UUID{GoUUID: name}] = libovsdb.Row{Fields: map[string]interface{}{"name": name}}
+			bridgePorts[bridge] = append(bridgePorts[bridge], libovsdb.UUID{GoUUID: name})
+			links.live["port "+name] = true
+		}
+	}
+	bridges := map[libovsdb.UUID]libovsdb.Row{}
+	for bridge, uuids := range bridgePorts {
+		bridges[libovsdb.UUID{GoUUID: bridge}] = libovsdb.Row{Fields: map[string]interface{}{"name": bridge, "ports": libovsdb.OvsSet{GoSet: uuids}}}
+	}
+	d, n, store := newTestEndpointDriver()
+	d.ovsdb = &OvsdbDriver{cache: map[string]map[libovsdb.UUID]libovsdb.Row{bridgeTable: bridges, portTable: ports}}
+
+	// ep1 is healthy, ep4 lost its veth and the network of ep5 is gone
+	ep1 := &endpoint{id: "0000000000001", nid: n.id, intfName: "port0000001", attach: attachVeth}
+	ep4 := &endpoint{id: "0000000000004", nid: n.id, intfName: "port0000004", attach: attachVeth}
+	ep5 := &endpoint{id: "0000000000005", nid: "dead00000000", intfName: "port0000005", attach: attachVeth}
+	for _, ep := range []*endpoint{ep1, ep4, ep5} {
+		store.PutObjectAtomic(ep)
+	}
+	n.endpoints[ep1.id] = ep1
+	n.endpoints[ep4.id] = ep4
+
+	expected := map[string]bool{
+		orphanPort + "/vport0000003":  true,
+		orphanLink + "/port0000002":   true,
+		orphanLink + "/vport0000002":  true,
+		orphanEndpoint + "/" + ep4.id: true,
+		orphanEndpoint + "/" + ep5.id: true,
+	}
+	check := func(items []ReconcileItem, action string) {
+		assert.Len(t, items, len(expected))
+		for _, item := range items {
+			assert.True(t, expected[item.Kind+"/"+item.Name], item.Name)
+			assert.Equal(t, action, item.Action, item.Name)
+		}
+	}
+
+	items, err := d.Reconcile(false)
+	assert.Nil(t, err)
+	check(items, actionPending)
+
+	items, err = d.Reconcile(true)
+	assert.Nil(t, err)
+	check(items, actionDryRun)
+	assert.True(t, hostLinks["port0000002"])
+
+	items, err = d.Reconcile(false)
+	assert.Nil(t, err)
+	check(items, actionRemoved)
+	assert.Equal(t, map[string]bool{"eth0": true, "vport0000001": true, "portchannel": true, "portABCDEF0": true}, hostLinks)
+	assert.False(t, links.live["port vport0000003"])
+	assert.True(t, links.live["port vport0000001"])
+	assert.True(t, links.live["port portchannel"])
+	assert.True(t, links.live["port vport0000009"])
+	assert.Len(t, n.endpoints, 1)
+	assert.Len(t, store.objects, 1)
+	_, ok := store.objects[datastore.Key(ep1.Key()...)]
+	assert.True(t, ok)
+}
+
+func TestReconcilePipelineFlows(t *testing.T) {
+	origList, origDump, origDel := listLinkNames, dumpFlowsByCookie, delFlowsByCookie
+	defer func() { listLinkNames, dumpFlowsByCookie, delFlowsByCookie = origList, origDump, origDel }()
+	listLinkNames = func() ([]string, error) { return nil, nil }
+	flows := map[string]bool{ovsBridgeName: true, "ovs-br1": true}
+	dumpFlowsByCookie = func(bridge string, cookie uint64) ([]string, error) {
+		assert.Equal(t, flowCookie(bridge, pipelineCookie), cookie)
+		if flows[bridge] {
+			return []string{fmt.Sprintf("cookie=%#x, table=1, priority=0 actions=NORMAL", cookie)}, nil
+		}
+		return nil, nil
+	}
+	delFlowsByCookie = func(bridge string, cookie uint64) error {
+		delete(flows, bridge)
+		return nil
+	}
+
+	bridges := map[libovsdb.UUID]libovsdb.Row{}
+	for _, name := range []string{ovsBridgeName, "ovs-br1", "ovs-br2"} {
+		bridges[libovsdb.UUID{GoUUID: name}] = libovsdb.Row{Fields: map[string]interface{}{"name": name}}
+	}
+	d, _, _ := newTestEndpointDriver()
+	d.ovsdb = &OvsdbDriver{cache: map[string]map[libovsdb.UUID]libovsdb.Row{bridgeTable: bridges}}
+
+	items, err := d.Reconcile(false)
+	assert.Nil(t, err)
+	assert.Equal(t, []ReconcileItem{{Kind: orphanFlows, Name: "ovs-br1", Action: actionPending}}, items)
+	items, err = d.Reconcile(false)
+	assert.Nil(t, err)
+	assert.Equal(t, []ReconcileItem{{Kind: orphanFlows, Name: "ovs-br1", Action: actionRemoved}}, items)
+	assert.Equal(t, map[string]bool{ovsBridgeName: true}, flows)
+}
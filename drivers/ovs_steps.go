@@ -0,0 +1,43 @@
+package drivers
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
+)
+
+// link and ovs changes made by the endpoint steps, replaced in tests
+var (
+	createVethPair = netutils.CreateVethPair
+	deleteVethPair = netutils.DeleteVethPair
+	addOvsPort     = (*OvsdbDriver).AddPort
+	delOvsPort     = (*OvsdbDriver).DelPort
+	ovsPortExists  = (*OvsdbDriver).PortExists
+)
+
+// step is one change of a multi-step operation and the change undoing it
+type step struct {
+	name string
+	do   func() error
+	undo func() error
+}
+
+// runSteps runs the steps in order. When a step fails the completed ones are
+// undone in reverse order and the error of the failed step is returned.
+func runSteps(steps []step) error {
+	for i, s := range steps {
+		logrus.Debugf("ovs step %s", s.name)
+		if err := s.do(); err != nil {
+			logrus.Debugf("ovs step %s failed, rolling back. Err: %v", s.name, err)
+			for j := i - 1; j >= 0; j-- {
+				if steps[j].undo == nil {
+					continue
+				}
+				if uerr := steps[j].undo(); uerr != nil {
+					logrus.Warnf("Failed to undo ovs step %s: %v", steps[j].name, uerr)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
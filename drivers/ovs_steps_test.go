@@ -0,0 +1,48 @@
+package drivers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunSteps(t *testing.T) {
+	for fail := 0; fail <= 3; fail++ {
+		done := []string{}
+		steps := []step{}
+		for i := 0; i < 3; i++ {
+			name := fmt.Sprintf("step%d", i)
+			i := i
+			steps = append(steps, step{
+				name: name,
+				do: func() error {
+					if i == fail {
+						return fmt.Errorf("%s failed", name)
+					}
+					done = append(done, name)
+					return nil
+				},
+				undo: func() error {
+					done = append(done, "undo "+name)
+					return nil
+				},
+			})
+		}
+		err := runSteps(steps)
+		switch fail {
+		case 0:
+			assert.NotNil(t, err)
+			assert.Equal(t, []string{}, done)
+		case 1:
+			assert.NotNil(t, err)
+			assert.Equal(t, []string{"step0", "undo step0"}, done)
+		case 2:
+			assert.NotNil(t, err)
+			assert.Equal(t, []string{"step0", "step1", "undo step1", "undo step0"}, done)
+		default:
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"step0", "step1", "step2"}, done)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package drivers
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// nodeDiscovery is the libnetwork discovery type for node joins and leaves
+	nodeDiscovery = 1
+	vxlanEncap    = "vxlan"
+	geneveEncap   = "geneve"
+	tunnelPrefix  = "tun"
+)
+
+// validateEncap checks the encap network option
+func validateEncap(encap string) error {
+	switch encap {
+	case "", vxlanEncap, geneveEncap:
+		return nil
+	}
+	return fmt.Errorf("invalid %s option %q, must be %s or %s", encapOption, encap, vxlanEncap, geneveEncap)
+}
+
+// parseNodeDiscovery returns the peer address announced in a node discovery
+// notification and whether the notification is about the local node
+func parseNodeDiscovery(data interface{}) (string, bool, error) {
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return "", false, fmt.Errorf("invalid node discovery data %v", data)
+	}
+	addr, _ := m["Address"].(string)
+	if net.ParseIP(addr) == nil {
+		return "", false, fmt.Errorf("invalid node discovery address %q", addr)
+	}
+	self, _ := m["Self"].(bool)
+	return addr, self, nil
+}
+
+// getTunnelPortName returns the name of the tunnel port of a network towards
+// a peer. It must fit into IFNAMSIZ, so network id and peer address are hashed.
+func getTunnelPortName(nid, peer string) string {
+	sum := sha256.Sum256([]byte(nid + "/" + peer))
+	return fmt.Sprintf("%s%x", tunnelPrefix, sum[:6])
+}
+
+// getTunnelKey returns the tunnel key of a network, vni option first then vlan
+func (n *network) getTunnelKey() int {
+	if n.vni != 0 {
+		return n.vni
+	}
+	return n.vlan
+}
+
+func (d *Driver) addPeer(peer string) error {
+	d.Lock()
+	if _, ok := d.peers[peer]; ok {
+		d.Unlock()
+		return nil
+	}
+	nws := []*network{}
+	for _, n := range d.networks {
+		if n.encap != "" {
+			nws = append(nws, n)
+		}
+	}
+	d.Unlock()
+
+	for i, n := range nws {
+		if err := d.addTunnel(n, peer); err != nil {
+			for _, added := range nws[:i] {
+				if err := d.deleteTunnel(added, peer); err != nil {
+					logrus.Warnf("Error deleting tunnel of network %s to peer %s. Err: %v", added.id, peer, err)
+				}
+			}
+			return err
+		}
+	}
+
+	// the peer is only known once all its tunnels exist, so a retried
+	// discovery creates them again
+	d.Lock()
+	d.peers[peer] = struct{}{}
+	d.Unlock()
+	return nil
+}
+
+func (d *Driver) deletePeer(peer string) error {
+	d.Lock()
+	if _, ok := d.peers[peer]; !ok {
+		d.Unlock()
+		return nil
+	}
+	delete(d.peers, peer)
+	nws := []*network{}
+	for _, n := range d.networks {
+		if n.encap != "" {
+			nws = append(nws, n)
+		}
+	}
+	d.Unlock()
+
+	for _, n := range nws {
+		if err := d.deleteTunnel(n, peer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addNetworkTunnels creates tunnel ports of the network towards all known peers
+func (d *Driver) addNetworkTunnels(n *network) {
+	for _, peer := range d.getPeers() {
+		if err := d.addTunnel(n, peer); err != nil {
+			logrus.Errorf("Error creating tunnel of network %s to peer %s. Err: %v", n.id, peer, err)
+		}
+	}
+}
+
+// deleteNetworkTunnels removes tunnel ports of the network towards all known peers
+func (d *Driver) deleteNetworkTunnels(n *network) {
+	for _, peer := range d.getPeers() {
+		if err := d.deleteTunnel(n, peer); err != nil {
+			logrus.Errorf("Error deleting tunnel of network %s to peer %s. Err: %v", n.id, peer, err)
+		}
+	}
+}
+
+func (d *Driver) getPeers() []string {
+	d.Lock()
+	defer d.Unlock()
+	peers := make([]string, 0, len(d.peers))
+	for peer := range d.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (d *Driver) addTunnel(n *network, peer string) error {
+	portName := getTunnelPortName(n.id, peer)
+	logrus.Debugf("ovs add %s tunnel port=%s,remote=%s,key=%d,vlan=%d", n.encap, portName, peer, n.getTunnelKey(), n.vlan)
+	if err := d.ovsdb.AddTunnelPort(n.bridge, portName, n.encap, peer, n.getTunnelKey(), n.vlan); err != nil {
+		return fmt.Errorf("ovs add tunnel port failed with name=%s,remote=%s,err=%s", portName, peer, err)
+	}
+	return nil
+}
+
+func (d *Driver) deleteTunnel(n *network, peer string) error {
+	portName := getTunnelPortName(n.id, peer)
+	logrus.Debugf("ovs delete %s tunnel port=%s,remote=%s", n.encap, portName, peer)
+	if err := d.ovsdb.DelPort(portName); err != nil {
+		return fmt.Errorf("ovs delete tunnel port failed with name=%s,remote=%s,err=%s", portName, peer, err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package drivers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNodeDiscovery(t *testing.T) {
+	peer, self, err := parseNodeDiscovery(map[string]interface{}{"Address": "10.0.0.2", "BindAddress": "10.0.0.2", "Self": false})
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.2", peer)
+	assert.False(t, self)
+
+	_, self, err = parseNodeDiscovery(map[string]interface{}{"Address": "10.0.0.1", "Self": true})
+	assert.Nil(t, err)
+	assert.True(t, self)
+
+	_, _, err = parseNodeDiscovery(map[string]interface{}{"Address": "invalid"})
+	assert.NotNil(t, err)
+	_, _, err = parseNodeDiscovery("10.0.0.2")
+	assert.NotNil(t, err)
+}
+
+func TestGetTunnelPortName(t *testing.T) {
+	nid := "3f2a1b0c9d8e"
+	name1 := getTunnelPortName(nid, "10.0.0.2")
+	name2 := getTunnelPortName(nid, "10.0.0.3")
+	name3 := getTunnelPortName(nid, "fd00::2")
+	assert.Equal(t, name1, getTunnelPortName(nid, "10.0.0.2"))
+	assert.NotEqual(t, name1, name2)
+	assert.True(t, len(name3) <= 15)
+	// networks sharing the first id characters get different ports
+	assert.NotEqual(t, name1, getTunnelPortName("3f2a99999999", "10.0.0.2"))
+}
+
+func TestAddPeerFailure(t *testing.T) {
+	d, n, _ := newTestEndpointDriver()
+	d.peers = map[string]struct{}{}
+	n.encap = vxlanEncap
+
+	// the bridge is missing from the ovsdb cache, so the tunnel fails
+	assert.NotNil(t, d.addPeer("10.0.0.2"))
+	assert.Empty(t, d.getPeers())
+}
+
+func TestValidateEncap(t *testing.T) {
+	assert.Nil(t, validateEncap(""))
+	assert.Nil(t, validateEncap(vxlanEncap))
+	assert.Nil(t, validateEncap(geneveEncap))
+	assert.NotNil(t, validateEncap("gre"))
+}
@@ -0,0 +1,58 @@
+package drivers
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/socketplane/libovsdb"
+)
+
+// BondOptions are the member interfaces of a bond port and how traffic is
+// balanced between them
+type BondOptions struct {
+	Interfaces []string
+	// Mode is the ovs bond_mode, active-backup, balance-slb or balance-tcp
+	Mode string
+	// LACP is active, passive or off
+	LACP string
+}
+
+// AddBond creates a trunk port of the bridge with one interface per member
+func (d *OvsdbDriver) AddBond(bridgeName, portName string, opts BondOptions) error {
+	logrus.Debugf("create ovs bond %s on bridge %s with %+v", portName, bridgeName, opts)
+	ops, err := d.bondOperations(bridgeName, portName, opts)
+	if err != nil {
+		return err
+	}
+	return d.doOperations(ops)
+}
+
+func (d *OvsdbDriver) bondOperations(bridgeName, portName string, opts BondOptions) ([]libovsdb.Operation, error) {
+	if len(opts.Interfaces) < 2 {
+		return nil, fmt.Errorf("ovs bond %s needs at least two interfaces", portName)
+	}
+	if !d.BridgeExists(bridgeName) {
+		return nil, fmt.Errorf("ovs bridge %s does not exist", bridgeName)
+	}
+	ops := []libovsdb.Operation{}
+	intfUUIDs := []libovsdb.UUID{}
+	for i, name := range opts.Interfaces {
+		uuidName := fmt.Sprintf("intf%d", i)
+		ops = append(ops, insertRow(intfTable, uuidName, map[string]interface{}{"name": name}))
+		intfUUIDs = append(intfUUIDs, libovsdb.UUID{GoUUID: uuidName})
+	}
+	intfs, err := libovsdb.NewOvsSet(intfUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	return append(ops,
+		insertRow(portTable, "bond", map[string]interface{}{
+			"name":       portName,
+			"interfaces": intfs,
+			"bond_mode":  opts.Mode,
+			"lacp":       opts.LACP,
+			"vlan_mode":  "trunk",
+		}),
+		mutateSet(bridgeTable, "ports", insertOp, []libovsdb.UUID{{GoUUID: "bond"}}, libovsdb.NewCondition("name", "==", bridgeName)),
+	), nil
+}
@@ -0,0 +1,273 @@
+package drivers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/socketplane/libovsdb"
+)
+
+const (
+	unixProto           = "unix"
+	tcpProto            = "tcp"
+	sslProto            = "ssl"
+	reconnectMinBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// ErrOvsdbDisconnected is returned by ovsdb changes while the driver is
+// reconnecting
+var ErrOvsdbDisconnected = errors.New("ovsdb is disconnected, reconnecting")
+
+// OvsdbStatus describes the ovsdb connection
+type OvsdbStatus struct {
+	Endpoint      string
+	Connected     bool
+	Reconnects    int
+	LastConnected time.Time
+}
+
+// parseOvsdbEndpoint splits an ovsdb endpoint in ovs-vsctl syntax, like
+// unix:/var/run/openvswitch/db.sock, tcp:10.0.0.1:6640 or ssl:10.0.0.1:6640
+func parseOvsdbEndpoint(endpoint string) (string, string, error) {
+	parts := strings.SplitN(endpoint, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid ovsdb endpoint %q", endpoint)
+	}
+	proto, addr := parts[0], parts[1]
+	switch proto {
+	case unixProto:
+	case tcpProto, sslProto:
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", "", fmt.Errorf("invalid ovsdb endpoint %q: %v", endpoint, err)
+		}
+	default:
+		return "", "", fmt.Errorf("invalid ovsdb endpoint %q, protocol must be unix, tcp or ssl", endpoint)
+	}
+	return proto, addr, nil
+}
+
+// newOvsdbTLSConfig loads the client key pair and the CA of ssl endpoints.
+// ovs-pki certificates do not carry host names, so the server certificate
+// is only verified against the CA.
+func newOvsdbTLSConfig(keyFile, certFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ovsdb ssl key pair: %v", err)
+	}
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ovsdb ssl ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in ovsdb ssl ca %s", caFile)
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, 0, len(rawCerts))
+			for _, raw := range rawCerts {
+				c, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, c)
+			}
+			if len(certs) == 0 {
+				return fmt.Errorf("ovsdb server sent no certificate")
+			}
+			opts := x509.VerifyOptions{
+				Roots:         pool,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, c := range certs[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := certs[0].Verify(opts)
+			return err
+		},
+	}, nil
+}
+
+// connectOvsdb connects to the first reachable endpoint
+func connectOvsdb(endpoints []string, tlsConfig *tls.Config) (*libovsdb.OvsdbClient, string, error) {
+	var lastErr error
+	for _, endpoint := range endpoints {
+		ovsClient, err := dialOvsdb(endpoint, tlsConfig)
+		if err == nil {
+			logrus.Infof("Connected to ovsdb at %s", endpoint)
+			return ovsClient, endpoint, nil
+		}
+		logrus.Warnf("Error connecting to ovsdb at %s. Err: %v", endpoint, err)
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no ovsdb endpoint configured")
+	}
+	return nil, "", lastErr
+}
+
+func dialOvsdb(endpoint string, tlsConfig *tls.Config) (*libovsdb.OvsdbClient, error) {
+	proto, addr, err := parseOvsdbEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch proto {
+	case unixProto:
+		return libovsdb.ConnectWithUnixSocket(addr)
+	case tcpProto:
+		return libovsdb.ConnectUsingProtocol(tcpProto, addr)
+	}
+	if tlsConfig == nil {
+		return nil, fmt.Errorf("ssl key, certificate and ca are required for %s", endpoint)
+	}
+	tlsConn, err := tls.Dial(tcpProto, addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	sockPath, err := proxyOvsdbConn(tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return libovsdb.ConnectUsingProtocol(unixProto, sockPath)
+}
+
+// proxyOvsdbConn exposes an established connection on a private unix
+// socket, libovsdb can only dial plain connections itself
+func proxyOvsdbConn(conn net.Conn) (string, error) {
+	dir, err := ioutil.TempDir("", "ovsdb-ssl")
+	if err != nil {
+		return "", err
+	}
+	sockPath := filepath.Join(dir, "db.sock")
+	l, err := net.Listen(unixProto, sockPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	go func() {
+		defer os.RemoveAll(dir)
+		local, err := l.Accept()
+		l.Close()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		go func() {
+			io.Copy(conn, local)
+			conn.Close()
+		}()
+		io.Copy(local, conn)
+		local.Close()
+	}()
+	return sockPath, nil
+}
+
+// connect connects to the first reachable endpoint and replaces the cache
+// with the monitored state of the new connection
+func (d *OvsdbDriver) connect() error {
+	ovsClient, endpoint, err := connectOvsdb(d.endpoints, d.tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	// monitor updates received before the initial state is in place are
+	// buffered and replayed on the new cache
+	pending := []libovsdb.TableUpdates{}
+	d.Lock()
+	d.ovsClient = ovsClient
+	d.endpoint = endpoint
+	d.pending = &pending
+	d.Unlock()
+
+	ovsClient.Register(d)
+	initial, err := ovsClient.MonitorAll(ovsDataBase, "")
+	if err != nil || initial == nil {
+		d.Lock()
+		d.pending = nil
+		d.Unlock()
+		ovsClient.Disconnect()
+		return fmt.Errorf("failed to monitor ovsdb at %s: %v", endpoint, err)
+	}
+
+	cache := make(map[string]map[libovsdb.UUID]libovsdb.Row)
+	applyUpdates(cache, *initial)
+
+	d.Lock()
+	defer d.Unlock()
+	for _, updates := range *d.pending {
+		applyUpdates(cache, updates)
+	}
+	d.pending = nil
+	if d.ovsClient != ovsClient {
+		return fmt.Errorf("lost connection to ovsdb at %s while synchronising", endpoint)
+	}
+	d.cache = cache
+	d.notifyUpdated()
+	d.connected = true
+	d.lastConnected = time.Now()
+	return nil
+}
+
+// reconnect retries all endpoints with an exponential backoff until one of
+// them connects
+func (d *OvsdbDriver) reconnect() {
+	backoff := reconnectMinBackoff
+	for {
+		time.Sleep(backoff)
+		err := d.connect()
+		if err == nil {
+			d.Lock()
+			d.reconnects++
+			logrus.Infof("Reconnected to ovsdb at %s, reconnects=%d", d.endpoint, d.reconnects)
+			d.Unlock()
+			return
+		}
+		backoff = nextBackoff(backoff)
+		logrus.Warnf("Error reconnecting to ovsdb, retry in %s. Err: %v", backoff, err)
+	}
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > reconnectMaxBackoff {
+		return reconnectMaxBackoff
+	}
+	return backoff
+}
+
+// client returns the connected ovsdb client, plugin calls fail fast with
+// ErrOvsdbDisconnected instead of waiting for the reconnect
+func (d *OvsdbDriver) client() (*libovsdb.OvsdbClient, error) {
+	d.RLock()
+	defer d.RUnlock()
+	if !d.connected {
+		return nil, ErrOvsdbDisconnected
+	}
+	return d.ovsClient, nil
+}
+
+// Status returns the state of the ovsdb connection
+func (d *OvsdbDriver) Status() OvsdbStatus {
+	d.RLock()
+	defer d.RUnlock()
+	return OvsdbStatus{
+		Endpoint:      d.endpoint,
+		Connected:     d.connected,
+		Reconnects:    d.reconnects,
+		LastConnected: d.lastConnected,
+	}
+}
@@ -0,0 +1,109 @@
+package drivers
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/socketplane/libovsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOvsdbEndpoint(t *testing.T) {
+	proto, addr, err := parseOvsdbEndpoint("unix:/var/run/openvswitch/db.sock")
+	assert.Nil(t, err)
+	assert.Equal(t, unixProto, proto)
+	assert.Equal(t, "/var/run/openvswitch/db.sock", addr)
+
+	proto, addr, err = parseOvsdbEndpoint("tcp:[::1]:6640")
+	assert.Nil(t, err)
+	assert.Equal(t, tcpProto, proto)
+	assert.Equal(t, "[::1]:6640", addr)
+
+	proto, addr, err = parseOvsdbEndpoint("ssl:10.0.0.1:6640")
+	assert.Nil(t, err)
+	assert.Equal(t, sslProto, proto)
+	assert.Equal(t, "10.0.0.1:6640", addr)
+
+	for _, endpoint := range []string{"", "unix:", "tcp:10.0.0.1", "ptcp:6640", "/var/run/openvswitch/db.sock"} {
+		_, _, err = parseOvsdbEndpoint(endpoint)
+		assert.NotNil(t, err, endpoint)
+	}
+}
+
+func TestProxyOvsdbConn(t *testing.T) {
+	remote, server := net.Pipe()
+	defer server.Close()
+	sockPath, err := proxyOvsdbConn(remote)
+	assert.Nil(t, err)
+
+	local, err := net.Dial(unixProto, sockPath)
+	assert.Nil(t, err)
+	defer local.Close()
+
+	go local.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = server.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	go server.Write([]byte("pong"))
+	_, err = local.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "pong", string(buf))
+}
+
+func TestConnectOvsdbNoEndpoint(t *testing.T) {
+	_, _, err := connectOvsdb(nil, nil)
+	assert.NotNil(t, err)
+	_, _, err = connectOvsdb([]string{"ssl:127.0.0.1:6640"}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestNextBackoff(t *testing.T) {
+	assert.Equal(t, 2*reconnectMinBackoff, nextBackoff(reconnectMinBackoff))
+	assert.Equal(t, reconnectMaxBackoff, nextBackoff(reconnectMaxBackoff))
+	assert.Equal(t, reconnectMaxBackoff, nextBackoff(reconnectMaxBackoff-time.Second))
+}
+
+func TestOvsdbDisconnected(t *testing.T) {
+	ovsClient := &libovsdb.OvsdbClient{}
+	d := &OvsdbDriver{
+		endpoints: []string{"unix:/nonexistent/db.sock"},
+		ovsClient: ovsClient,
+		connected: true,
+		cache:     make(map[string]map[libovsdb.UUID]libovsdb.Row),
+	}
+	_, err := d.client()
+	assert.Nil(t, err)
+
+	// notifications of an older connection are ignored
+	d.Disconnected(&libovsdb.OvsdbClient{})
+	assert.True(t, d.Status().Connected)
+
+	d.Disconnected(ovsClient)
+	status := d.Status()
+	assert.False(t, status.Connected)
+	assert.Equal(t, 0, status.Reconnects)
+	_, err = d.client()
+	assert.Equal(t, ErrOvsdbDisconnected, err)
+	assert.Equal(t, ErrOvsdbDisconnected, d.doOperations(nil))
+}
+
+func TestPopulateCachePending(t *testing.T) {
+	d := &OvsdbDriver{cache: make(map[string]map[libovsdb.UUID]libovsdb.Row)}
+	updates := libovsdb.TableUpdates{Updates: map[string]libovsdb.TableUpdate{
+		portTable: {Rows: map[string]libovsdb.RowUpdate{
+			"1": {New: libovsdb.Row{Fields: map[string]interface{}{"name": "port1"}}},
+		}},
+	}}
+	pending := []libovsdb.TableUpdates{}
+	d.pending = &pending
+	d.populateCache(updates)
+	assert.Len(t, d.cache[portTable], 0)
+	assert.Len(t, pending, 1)
+
+	d.pending = nil
+	d.populateCache(updates)
+	assert.Len(t, d.cache[portTable], 1)
+}
@@ -0,0 +1,183 @@
+package drivers
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/socketplane/libovsdb"
+)
+
+// flow export tables, each one referenced by a column of the bridge
+const (
+	sflowTable   = "sFlow"
+	netflowTable = "NetFlow"
+	ipfixTable   = "IPFIX"
+	// extIDFlowExport marks the rows set by the driver, others are kept
+	extIDFlowExport = "ovs-driver.flow-export"
+)
+
+// flowExportColumns are the bridge columns of the flow export tables
+var flowExportColumns = map[string]string{
+	sflowTable:   "sflow",
+	netflowTable: "netflow",
+	ipfixTable:   "ipfix",
+}
+
+// FlowExport are the collectors of a flow export protocol and how often
+// traffic is sampled and counters are sent
+type FlowExport struct {
+	// Targets are the host:port of the collectors
+	Targets []string
+	// Sampling exports one of Sampling packets, not used by NetFlow
+	Sampling int
+	// Polling is the sFlow counter polling interval, the NetFlow active
+	// timeout or the IPFIX cache active timeout in seconds
+	Polling int
+	// Agent is the interface of the sFlow agent address
+	Agent string
+}
+
+// SetFlowExport sets the sFlow, NetFlow or IPFIX export of the bridge, or
+// clears one set by the driver when there are no targets. An export set
+// outside the driver is kept.
+func (d *OvsdbDriver) SetFlowExport(bridgeName, table string, fe FlowExport) error {
+	ops, err := d.flowExportOperations(bridgeName, table, fe)
+	if err != nil || len(ops) == 0 {
+		return err
+	}
+	logrus.Debugf("set ovs %s of bridge %s to %+v", table, bridgeName, fe)
+	return d.doOperations(ops)
+}
+
+// flowExportOperations returns the operations replacing the export row of
+// the bridge, none if it is up to date or was set outside the driver
+func (d *OvsdbDriver) flowExportOperations(bridgeName, table string, fe FlowExport) ([]libovsdb.Operation, error) {
+	column, ok := flowExportColumns[table]
+	if !ok {
+		return nil, fmt.Errorf("invalid flow export table %s", table)
+	}
+	row, err := flowExportRow(table, fe)
+	if err != nil {
+		return nil, err
+	}
+
+	// a bridge just created may be missing from the cache, its export is
+	// set without looking at the current one
+	var current *libovsdb.Row
+	if brUUID, ok := d.getBridgeUUID(bridgeName); ok {
+		d.RLock()
+		for _, uuid := range getUUIDs(d.cache[bridgeTable][brUUID].Fields[column]) {
+			if r, ok := d.cache[table][uuid]; ok {
+				current = &r
+			}
+		}
+		d.RUnlock()
+	}
+
+	foreign := current != nil && getStringMap(current.Fields["external_ids"])[extIDFlowExport] == ""
+	condition := libovsdb.NewCondition("name", "==", bridgeName)
+	if len(fe.Targets) == 0 {
+		if current == nil || foreign {
+			return nil, nil
+		}
+		// the unreferenced row is deleted by ovsdb
+		return []libovsdb.Operation{{
+			Op:    updateOp,
+			Table: bridgeTable,
+			Row:   map[string]interface{}{column: libovsdb.OvsSet{GoSet: []interface{}{}}},
+			Where: []interface{}{condition},
+		}}, nil
+	}
+	if foreign {
+		logrus.Warnf("Not setting the %s export of ovs bridge %s, it has one set outside the driver", table, bridgeName)
+		return nil, nil
+	}
+	if current != nil && flowExportMatches(table, *current, fe) {
+		return nil, nil
+	}
+	return []libovsdb.Operation{
+		insertRow(table, "export", row),
+		{
+			Op:    updateOp,
+			Table: bridgeTable,
+			Row:   map[string]interface{}{column: libovsdb.UUID{GoUUID: "export"}},
+			Where: []interface{}{condition},
+		},
+	}, nil
+}
+
+func flowExportRow(table string, fe FlowExport) (map[string]interface{}, error) {
+	targets, err := libovsdb.NewOvsSet(fe.Targets)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := libovsdb.NewOvsMap(map[string]string{extIDFlowExport: "true"})
+	if err != nil {
+		return nil, err
+	}
+	row := map[string]interface{}{"targets": targets, "external_ids": ids}
+	switch table {
+	case sflowTable:
+		row["sampling"] = fe.Sampling
+		row["polling"] = fe.Polling
+		if fe.Agent != "" {
+			row["agent"] = fe.Agent
+		}
+	case netflowTable:
+		row["active_timeout"] = fe.Polling
+	case ipfixTable:
+		row["sampling"] = fe.Sampling
+		row["cache_active_timeout"] = fe.Polling
+	}
+	return row, nil
+}
+
+// flowExportMatches checks if the cached row has the settings of fe
+func flowExportMatches(table string, row libovsdb.Row, fe FlowExport) bool {
+	targets := getStrings(row.Fields["targets"])
+	want := append([]string{}, fe.Targets...)
+	sort.Strings(targets)
+	sort.Strings(want)
+	if !reflect.DeepEqual(targets, want) {
+		return false
+	}
+	ints := map[string]int{}
+	switch table {
+	case sflowTable:
+		ints["sampling"] = fe.Sampling
+		ints["polling"] = fe.Polling
+		if strings.Join(getStrings(row.Fields["agent"]), ",") != fe.Agent {
+			return false
+		}
+	case netflowTable:
+		ints["active_timeout"] = fe.Polling
+	case ipfixTable:
+		ints["sampling"] = fe.Sampling
+		ints["cache_active_timeout"] = fe.Polling
+	}
+	for column, v := range ints {
+		if got := getInts(row.Fields[column]); !reflect.DeepEqual(got, []int{v}) {
+			return false
+		}
+	}
+	return true
+}
+
+// getStrings returns the strings of a set column
+func getStrings(column interface{}) []string {
+	strs := []string{}
+	switch v := column.(type) {
+	case string:
+		strs = append(strs, v)
+	case libovsdb.OvsSet:
+		for _, e := range v.GoSet {
+			if s, ok := e.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+	}
+	return strs
+}
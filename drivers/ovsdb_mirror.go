@@ -0,0 +1,225 @@
+package drivers
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/socketplane/libovsdb"
+)
+
+const mirrorTable = "Mirror"
+
+// MirrorOptions select the traffic of a mirror and the port receiving it.
+// Exactly one of SelectPort, SelectVlan and SelectAll is set.
+type MirrorOptions struct {
+	Name   string
+	Bridge string
+	// SelectPort mirrors the traffic sent and received by the port
+	SelectPort string
+	// SelectVlan mirrors the traffic of the vlan on all ports
+	SelectVlan int
+	// SelectAll mirrors all traffic of the bridge
+	SelectAll  bool
+	OutputPort string
+	// CreateOutput adds the output port as an internal port with the mirror
+	CreateOutput bool
+	ExternalIDs  map[string]string
+}
+
+// MirrorInfo describes a mirror of a bridge
+type MirrorInfo struct {
+	Name        string
+	Bridge      string
+	SelectPorts []string
+	SelectVlans []int
+	SelectAll   bool
+	OutputPort  string
+	ExternalIDs map[string]string
+	Statistics  map[string]int64
+}
+
+// CreateMirror adds the mirror to its bridge
+func (d *OvsdbDriver) CreateMirror(opts MirrorOptions) error {
+	logrus.Debugf("create ovs mirror %+v", opts)
+	ops, err := d.mirrorOperations(opts)
+	if err != nil {
+		return err
+	}
+	return d.doOperations(ops)
+}
+
+func (d *OvsdbDriver) mirrorOperations(opts MirrorOptions) ([]libovsdb.Operation, error) {
+	selected := 0
+	for _, s := range []bool{opts.SelectPort != "", opts.SelectVlan != 0, opts.SelectAll} {
+		if s {
+			selected++
+		}
+	}
+	if selected != 1 {
+		return nil, fmt.Errorf("ovs mirror %s must select one port, one vlan or all traffic", opts.Name)
+	}
+	if opts.Name == "" || opts.OutputPort == "" {
+		return nil, fmt.Errorf("ovs mirror needs a name and an output port")
+	}
+	if !d.BridgeExists(opts.Bridge) {
+		return nil, fmt.Errorf("ovs bridge %s does not exist", opts.Bridge)
+	}
+	if _, ok := d.getMirrorUUID(opts.Name); ok {
+		return nil, fmt.Errorf("ovs mirror %s already exists", opts.Name)
+	}
+	idMap, err := libovsdb.NewOvsMap(opts.ExternalIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := []libovsdb.Operation{}
+	brCondition := libovsdb.NewCondition("name", "==", opts.Bridge)
+	mirror := map[string]interface{}{
+		"name":         opts.Name,
+		"select_all":   opts.SelectAll,
+		"external_ids": idMap,
+	}
+	if opts.SelectPort != "" {
+		portUUID, ok := d.getPortUUID(opts.SelectPort)
+		if !ok {
+			return nil, fmt.Errorf("ovs mirror source port %s does not exist", opts.SelectPort)
+		}
+		mirror["select_src_port"] = portUUID
+		mirror["select_dst_port"] = portUUID
+	}
+	if opts.SelectVlan != 0 {
+		mirror["select_vlan"] = opts.SelectVlan
+	}
+	if opts.CreateOutput {
+		if d.PortExists(opts.OutputPort) {
+			return nil, fmt.Errorf("ovs mirror output port %s already exists", opts.OutputPort)
+		}
+		ops = append(ops,
+			insertRow(intfTable, "intf", map[string]interface{}{
+				"name": opts.OutputPort,
+				"type": "internal",
+			}),
+			insertRow(portTable, "port", map[string]interface{}{
+				"name":         opts.OutputPort,
+				"interfaces":   libovsdb.UUID{GoUUID: "intf"},
+				"external_ids": idMap,
+			}),
+			mutateSet(bridgeTable, "ports", insertOp, []libovsdb.UUID{{GoUUID: "port"}}, brCondition),
+		)
+		mirror["output_port"] = libovsdb.UUID{GoUUID: "port"}
+	} else {
+		portUUID, ok := d.getPortUUID(opts.OutputPort)
+		if !ok {
+			return nil, fmt.Errorf("ovs mirror output port %s does not exist", opts.OutputPort)
+		}
+		mirror["output_port"] = portUUID
+	}
+	return append(ops,
+		insertRow(mirrorTable, "mirror", mirror),
+		mutateSet(bridgeTable, "mirrors", insertOp, []libovsdb.UUID{{GoUUID: "mirror"}}, brCondition),
+	), nil
+}
+
+// DeleteMirror removes the mirror from its bridge, ovsdb deletes the
+// unreferenced row. A missing mirror is not an error.
+func (d *OvsdbDriver) DeleteMirror(name string) error {
+	logrus.Debugf("delete ovs mirror %s", name)
+	mirrorUUID, ok := d.getMirrorUUID(name)
+	if !ok {
+		return nil
+	}
+	bridge := ""
+	d.RLock()
+	for _, row := range d.cache[bridgeTable] {
+		for _, uuid := range getUUIDs(row.Fields["mirrors"]) {
+			if uuid == mirrorUUID {
+				bridge, _ = row.Fields["name"].(string)
+			}
+		}
+	}
+	d.RUnlock()
+	if bridge == "" {
+		return nil
+	}
+	return d.Mutate(bridgeTable, "mirrors", deleteOp, []libovsdb.UUID{mirrorUUID}, libovsdb.NewCondition("name", "==", bridge))
+}
+
+// Mirrors lists the mirrors of all bridges sorted by name
+func (d *OvsdbDriver) Mirrors() []MirrorInfo {
+	d.RLock()
+	defer d.RUnlock()
+	portNames := map[libovsdb.UUID]string{}
+	for uuid, row := range d.cache[portTable] {
+		portNames[uuid], _ = row.Fields["name"].(string)
+	}
+	bridges := map[libovsdb.UUID]string{}
+	for _, row := range d.cache[bridgeTable] {
+		for _, uuid := range getUUIDs(row.Fields["mirrors"]) {
+			bridges[uuid], _ = row.Fields["name"].(string)
+		}
+	}
+	mirrors := []MirrorInfo{}
+	for uuid, row := range d.cache[mirrorTable] {
+		info := MirrorInfo{
+			Bridge:      bridges[uuid],
+			SelectPorts: []string{},
+			SelectVlans: getInts(row.Fields["select_vlan"]),
+			ExternalIDs: getStringMap(row.Fields["external_ids"]),
+			Statistics:  getIntMap(row.Fields["statistics"]),
+		}
+		info.Name, _ = row.Fields["name"].(string)
+		info.SelectAll, _ = row.Fields["select_all"].(bool)
+		selected := map[string]bool{}
+		for _, column := range []string{"select_src_port", "select_dst_port"} {
+			for _, portUUID := range getUUIDs(row.Fields[column]) {
+				if name := portNames[portUUID]; name != "" && !selected[name] {
+					selected[name] = true
+					info.SelectPorts = append(info.SelectPorts, name)
+				}
+			}
+		}
+		if outputs := getUUIDs(row.Fields["output_port"]); len(outputs) != 0 {
+			info.OutputPort = portNames[outputs[0]]
+		}
+		mirrors = append(mirrors, info)
+	}
+	sort.Slice(mirrors, func(i, j int) bool { return mirrors[i].Name < mirrors[j].Name })
+	return mirrors
+}
+
+func (d *OvsdbDriver) getMirrorUUID(name string) (libovsdb.UUID, bool) {
+	return d.getUUIDByName(mirrorTable, name)
+}
+
+func (d *OvsdbDriver) getPortUUID(name string) (libovsdb.UUID, bool) {
+	return d.getUUIDByName(portTable, name)
+}
+
+func (d *OvsdbDriver) getUUIDByName(table, name string) (libovsdb.UUID, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	for uuid, row := range d.cache[table] {
+		if n, _ := row.Fields["name"].(string); n == name {
+			return uuid, true
+		}
+	}
+	return libovsdb.UUID{}, false
+}
+
+// getInts returns the integers of a set column, json numbers are decoded as
+// float64
+func getInts(column interface{}) []int {
+	ints := []int{}
+	switch v := column.(type) {
+	case float64:
+		ints = append(ints, int(v))
+	case libovsdb.OvsSet:
+		for _, e := range v.GoSet {
+			if f, ok := e.(float64); ok {
+				ints = append(ints, int(f))
+			}
+		}
+	}
+	return ints
+}
@@ -1,9 +1,13 @@
 package drivers
 
 import (
+	"crypto/tls"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/socketplane/libovsdb"
@@ -16,45 +20,197 @@ const (
 	portTable   = "Port"
 	intfTable   = "Interface"
 	bridgeTable = "Bridge"
+	ovsTable    = "Open_vSwitch"
 	insertOp    = "insert"
 	mutateOp    = "mutate"
+	updateOp    = "update"
 	deleteOp    = "delete"
 )
 
 //OvsdbDriver ...
 type OvsdbDriver struct {
 	bridgeName string
+	endpoints  []string
+	tlsConfig  *tls.Config
+	endpoint   string
 	ovsClient  *libovsdb.OvsdbClient
 	cache      map[string]map[libovsdb.UUID]libovsdb.Row
+	// pending buffers monitor updates while a new cache is synchronised
+	pending *[]libovsdb.TableUpdates
+	// updated is closed and replaced whenever the cache changes
+	updated       chan struct{}
+	connected     bool
+	reconnects    int
+	lastConnected time.Time
 	sync.RWMutex
 }
 
-// NewOvsdbDriver ...
-func NewOvsdbDriver(bridgeName string) (*OvsdbDriver, error) {
+// NewOvsdbDriver connects to the first reachable ovsdb endpoint. tlsConfig
+// is only used by ssl endpoints.
+func NewOvsdbDriver(bridgeName string, endpoints []string, tlsConfig *tls.Config) (*OvsdbDriver, error) {
 	// Create a new ovsdb driver instance
 	d := new(OvsdbDriver)
 	d.bridgeName = bridgeName
+	d.endpoints = endpoints
+	d.tlsConfig = tlsConfig
 
-	// Connect to ovs
-	ovsClient, err := libovsdb.ConnectWithUnixSocket(socketFile)
-	if err != nil {
-		logrus.Fatalf("Error connecting to ovs. Err: %v", err)
+	// Connect to ovs and initialize the cache
+	d.cache = make(map[string]map[libovsdb.UUID]libovsdb.Row)
+	d.updated = make(chan struct{})
+	if err := d.connect(); err != nil {
+		logrus.Errorf("Error connecting to ovs. Err: %v", err)
 		return nil, err
 	}
 
-	d.ovsClient = ovsClient
+	return d, nil
+}
 
-	// Initialize the cache
-	d.cache = make(map[string]map[libovsdb.UUID]libovsdb.Row)
-	d.ovsClient.Register(d)
-	initial, _ := d.ovsClient.MonitorAll(ovsDataBase, "")
-	d.populateCache(*initial)
+// Close disconnects from ovsdb without reconnecting
+func (d *OvsdbDriver) Close() {
+	d.Lock()
+	ovsClient := d.ovsClient
+	d.connected = false
+	d.ovsClient = nil
+	d.Unlock()
+	if ovsClient != nil {
+		ovsClient.Disconnect()
+	}
+}
 
-	return d, nil
+// BridgeOptions are the columns set on a bridge created by the driver
+type BridgeOptions struct {
+	FailMode     string
+	DatapathType string
+	OtherConfig  map[string]string
+}
+
+// CreateBridge creates the bridge with its internal port if it does not exist
+func (d *OvsdbDriver) CreateBridge(bridgeName string, opts BridgeOptions) error {
+	if d.BridgeExists(bridgeName) {
+		return nil
+	}
+	logrus.Debugf("create ovs bridge name=%s,opts=%+v", bridgeName, opts)
+	rootUUID, err := d.getRootUUID()
+	if err != nil {
+		return err
+	}
+	intfUUID := "intf"
+	portUUID := "port"
+	brUUID := "bridge"
+
+	// insert the bridge internal interface and port
+	intfOp := libovsdb.Operation{
+		Op:       insertOp,
+		Table:    intfTable,
+		Row:      map[string]interface{}{"name": bridgeName, "type": "internal"},
+		UUIDName: intfUUID,
+	}
+	portOp := libovsdb.Operation{
+		Op:    insertOp,
+		Table: portTable,
+		Row: map[string]interface{}{
+			"name":       bridgeName,
+			"interfaces": libovsdb.UUID{GoUUID: intfUUID},
+		},
+		UUIDName: portUUID,
+	}
+
+	// insert bridge
+	bridge := make(map[string]interface{})
+	bridge["name"] = bridgeName
+	bridge["ports"] = libovsdb.UUID{GoUUID: portUUID}
+	if opts.FailMode != "" {
+		bridge["fail_mode"] = opts.FailMode
+	}
+	if opts.DatapathType != "" {
+		bridge["datapath_type"] = opts.DatapathType
+	}
+	if len(opts.OtherConfig) != 0 {
+		otherConfig, err := libovsdb.NewOvsMap(opts.OtherConfig)
+		if err != nil {
+			return err
+		}
+		bridge["other_config"] = otherConfig
+	}
+	brOp := libovsdb.Operation{
+		Op:       insertOp,
+		Table:    bridgeTable,
+		Row:      bridge,
+		UUIDName: brUUID,
+	}
+
+	// mutate the root table
+	mutateSet, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUUID: brUUID}})
+	mutation := libovsdb.NewMutation("bridges", insertOp, mutateSet)
+	condition := libovsdb.NewCondition("_uuid", "==", rootUUID)
+	mutateOp := libovsdb.Operation{
+		Op:        mutateOp,
+		Table:     ovsTable,
+		Mutations: []interface{}{mutation},
+		Where:     []interface{}{condition},
+	}
+
+	ops := []libovsdb.Operation{intfOp, portOp, brOp, mutateOp}
+	return d.doOperations(ops)
+}
+
+// DeleteBridge deletes the bridge, its ports are garbage collected by ovsdb
+func (d *OvsdbDriver) DeleteBridge(bridgeName string) error {
+	logrus.Debugf("delete ovs bridge name=%s", bridgeName)
+	brUUID, ok := d.getBridgeUUID(bridgeName)
+	if !ok {
+		return nil
+	}
+	rootUUID, err := d.getRootUUID()
+	if err != nil {
+		return err
+	}
+	condition := libovsdb.NewCondition("name", "==", bridgeName)
+	brOp := libovsdb.Operation{
+		Op:    deleteOp,
+		Table: bridgeTable,
+		Where: []interface{}{condition},
+	}
+
+	mutateSet, _ := libovsdb.NewOvsSet([]libovsdb.UUID{brUUID})
+	mutation := libovsdb.NewMutation("bridges", deleteOp, mutateSet)
+	condition = libovsdb.NewCondition("_uuid", "==", rootUUID)
+	mutateOp := libovsdb.Operation{
+		Op:        mutateOp,
+		Table:     ovsTable,
+		Mutations: []interface{}{mutation},
+		Where:     []interface{}{condition},
+	}
+
+	ops := []libovsdb.Operation{brOp, mutateOp}
+	return d.doOperations(ops)
+}
+
+// BridgeExists checks the cache for the bridge
+func (d *OvsdbDriver) BridgeExists(bridgeName string) bool {
+	_, ok := d.getBridgeUUID(bridgeName)
+	return ok
+}
+
+// AddPort create a ovs internal port, externalIDs are set on both the port
+// and its interface
+func (d *OvsdbDriver) AddPort(bridgeName, intfName, intfType string, tag, burst, bandwidth int, externalIDs map[string]string) error {
+	return d.addPort(bridgeName, intfName, intfType, tag, burst, bandwidth, nil, externalIDs)
+}
+
+// AddTunnelPort creates a vxlan or geneve port towards remoteIP
+func (d *OvsdbDriver) AddTunnelPort(bridgeName, intfName, encap, remoteIP string, key, tag int) error {
+	options := map[string]string{"remote_ip": remoteIP}
+	if key != 0 {
+		options["key"] = strconv.Itoa(key)
+	}
+	return d.addPort(bridgeName, intfName, encap, tag, 0, 0, options, nil)
 }
 
-// AddPort create a ovs internal port
-func (d *OvsdbDriver) AddPort(intfName, intfType string, tag, burst, bandwidth int) error {
+func (d *OvsdbDriver) addPort(bridgeName, intfName, intfType string, tag, burst, bandwidth int, options, externalIDs map[string]string) error {
+	if !d.BridgeExists(bridgeName) {
+		return fmt.Errorf("ovs bridge %s does not exist", bridgeName)
+	}
 
 	intfUUID := "intf"
 	portUUID := "port"
@@ -69,6 +225,21 @@ func (d *OvsdbDriver) AddPort(intfName, intfType string, tag, burst, bandwidth i
 	if burst != 0 {
 		intf["ingress_policing_burst"] = burst
 	}
+	if len(options) != 0 {
+		optMap, err := libovsdb.NewOvsMap(options)
+		if err != nil {
+			return err
+		}
+		intf["options"] = optMap
+	}
+	var idMap *libovsdb.OvsMap
+	if len(externalIDs) != 0 {
+		var err error
+		if idMap, err = libovsdb.NewOvsMap(externalIDs); err != nil {
+			return err
+		}
+		intf["external_ids"] = idMap
+	}
 
 	intfOp := libovsdb.Operation{
 		Op:       insertOp,
@@ -87,6 +258,9 @@ func (d *OvsdbDriver) AddPort(intfName, intfType string, tag, burst, bandwidth i
 	} else {
 		port["vlan_mode"] = "trunk"
 	}
+	if idMap != nil {
+		port["external_ids"] = idMap
+	}
 
 	portOp := libovsdb.Operation{
 		Op:       insertOp,
@@ -99,7 +273,7 @@ func (d *OvsdbDriver) AddPort(intfName, intfType string, tag, burst, bandwidth i
 	mutateUUID := []libovsdb.UUID{libovsdb.UUID{GoUUID: portUUID}}
 	mutateSet, _ := libovsdb.NewOvsSet(mutateUUID)
 	mutation := libovsdb.NewMutation("ports", insertOp, mutateSet)
-	condition := libovsdb.NewCondition("name", "==", d.bridgeName)
+	condition := libovsdb.NewCondition("name", "==", bridgeName)
 	mutateOp := libovsdb.Operation{
 		Op:        mutateOp,
 		Table:     bridgeTable,
@@ -115,7 +289,100 @@ func (d *OvsdbDriver) AddPort(intfName, intfType string, tag, burst, bandwidth i
 	return nil
 }
 
-// DelPort ...
+// SetExternalIDs replaces the external_ids of the port and its interface
+func (d *OvsdbDriver) SetExternalIDs(portName string, externalIDs map[string]string) error {
+	idMap, err := libovsdb.NewOvsMap(externalIDs)
+	if err != nil {
+		return err
+	}
+	ops := []libovsdb.Operation{}
+	for _, table := range []string{intfTable, portTable} {
+		ops = append(ops, libovsdb.Operation{
+			Op:    updateOp,
+			Table: table,
+			Row:   map[string]interface{}{"external_ids": idMap},
+			Where: []interface{}{libovsdb.NewCondition("name", "==", portName)},
+		})
+	}
+	return d.doOperations(ops)
+}
+
+// InterfaceExternalIDs returns the external_ids of the interfaces having
+// the key by interface name
+func (d *OvsdbDriver) InterfaceExternalIDs(key string) map[string]map[string]string {
+	d.RLock()
+	defer d.RUnlock()
+	intfs := map[string]map[string]string{}
+	for _, row := range d.cache[intfTable] {
+		name, _ := row.Fields["name"].(string)
+		ids := getStringMap(row.Fields["external_ids"])
+		if _, ok := ids[key]; ok && name != "" {
+			intfs[name] = ids
+		}
+	}
+	return intfs
+}
+
+// InterfaceStatistics are the counters of an interface
+type InterfaceStatistics struct {
+	Name        string
+	ExternalIDs map[string]string
+	Statistics  map[string]int64
+}
+
+// InterfaceStatistics returns the statistics column of the interfaces having
+// the external_ids key
+func (d *OvsdbDriver) InterfaceStatistics(key string) []InterfaceStatistics {
+	d.RLock()
+	defer d.RUnlock()
+	stats := []InterfaceStatistics{}
+	for _, row := range d.cache[intfTable] {
+		name, _ := row.Fields["name"].(string)
+		ids := getStringMap(row.Fields["external_ids"])
+		if _, ok := ids[key]; !ok || name == "" {
+			continue
+		}
+		stats = append(stats, InterfaceStatistics{
+			Name:        name,
+			ExternalIDs: ids,
+			Statistics:  getIntMap(row.Fields["statistics"]),
+		})
+	}
+	return stats
+}
+
+// getIntMap converts an ovsdb map column of integers, json numbers are
+// decoded as float64
+func getIntMap(column interface{}) map[string]int64 {
+	m := map[string]int64{}
+	if ovsMap, ok := column.(libovsdb.OvsMap); ok {
+		for k, v := range ovsMap.GoMap {
+			ks, kok := k.(string)
+			vf, vok := v.(float64)
+			if kok && vok {
+				m[ks] = int64(vf)
+			}
+		}
+	}
+	return m
+}
+
+// getStringMap converts an ovsdb map column
+func getStringMap(column interface{}) map[string]string {
+	m := map[string]string{}
+	if ovsMap, ok := column.(libovsdb.OvsMap); ok {
+		for k, v := range ovsMap.GoMap {
+			ks, kok := k.(string)
+			vs, vok := v.(string)
+			if kok && vok {
+				m[ks] = vs
+			}
+		}
+	}
+	return m
+}
+
+// DelPort deletes the port and its interface, a missing port is not an error
 func (d *OvsdbDriver) DelPort(intfName string) error {
 	logrus.Debugf("delete ovs port name =%s", intfName)
 	portUUID := []libovsdb.UUID{{GoUUID: intfName}}
@@ -136,20 +403,34 @@ func (d *OvsdbDriver) DelPort(intfName string) error {
 	}
 
 	// get from cache
+	bridgeName := d.bridgeName
+	found := false
 	d.RLock()
 	for uuid, row := range d.cache["Port"] {
 		name := row.Fields["name"].(string)
 		if name == intfName {
 			portUUID = []libovsdb.UUID{uuid}
+			found = true
 			break
 		}
 	}
+	for _, row := range d.cache[bridgeTable] {
+		for _, uuid := range getUUIDs(row.Fields["ports"]) {
+			if uuid == portUUID[0] {
+				bridgeName = row.Fields["name"].(string)
+			}
+		}
+	}
 	d.RUnlock()
+	if !found {
+		logrus.Debugf("ovs port name=%s already deleted", intfName)
+		return nil
+	}
 
 	// mutate the bridge
 	mutateSet, _ := libovsdb.NewOvsSet(portUUID)
 	mutation := libovsdb.NewMutation("ports", deleteOp, mutateSet)
-	condition = libovsdb.NewCondition("name", "==", d.bridgeName)
+	condition = libovsdb.NewCondition("name", "==", bridgeName)
 	mutateOp := libovsdb.Operation{
 		Op:        mutateOp,
 		Table:     bridgeTable,
@@ -163,40 +444,316 @@ func (d *OvsdbDriver) DelPort(intfName string) error {
 
 }
 
+// PortExists checks the cache for the port
+func (d *OvsdbDriver) PortExists(portName string) bool {
+	d.RLock()
+	defer d.RUnlock()
+	for _, row := range d.cache[portTable] {
+		if name, _ := row.Fields["name"].(string); name == portName {
+			return true
+		}
+	}
+	return false
+}
+
+// PortBridge returns the name of the bridge the port is attached to, empty
+// if the port does not exist
+func (d *OvsdbDriver) PortBridge(portName string) string {
+	d.RLock()
+	defer d.RUnlock()
+	for _, br := range d.cache[bridgeTable] {
+		for _, portUUID := range getUUIDs(br.Fields["ports"]) {
+			if name, _ := d.cache[portTable][portUUID].Fields["name"].(string); name == portName {
+				brName, _ := br.Fields["name"].(string)
+				return brName
+			}
+		}
+	}
+	return ""
+}
+
+// Rows returns a copy of the cached rows of the table by uuid, ovsdb sets,
+// maps and uuids keep their ovsdb json encoding
+func (d *OvsdbDriver) Rows(table string) map[string]map[string]interface{} {
+	d.RLock()
+	defer d.RUnlock()
+	rows := make(map[string]map[string]interface{}, len(d.cache[table]))
+	for uuid, row := range d.cache[table] {
+		fields := make(map[string]interface{}, len(row.Fields))
+		for k, v := range row.Fields {
+			fields[k] = v
+		}
+		rows[uuid.GoUUID] = fields
+	}
+	return rows
+}
+
+// PortInfo describes a port of a bridge and its first interface
+type PortInfo struct {
+	Name        string
+	Bridge      string
+	Type        string
+	Tag         int
+	Ofport      int
+	ExternalIDs map[string]string
+}
+
+// Ports lists the ports of all bridges sorted by bridge and name
+func (d *OvsdbDriver) Ports() []PortInfo {
+	d.RLock()
+	defer d.RUnlock()
+	ports := []PortInfo{}
+	for _, br := range d.cache[bridgeTable] {
+		brName, _ := br.Fields["name"].(string)
+		for _, portUUID := range getUUIDs(br.Fields["ports"]) {
+			port, ok := d.cache[portTable][portUUID]
+			if !ok {
+				continue
+			}
+			info := PortInfo{Bridge: brName, ExternalIDs: getStringMap(port.Fields["external_ids"])}
+			info.Name, _ = port.Fields["name"].(string)
+			if tag, ok := port.Fields["tag"].(float64); ok {
+				info.Tag = int(tag)
+			}
+			if intfUUIDs := getUUIDs(port.Fields["interfaces"]); len(intfUUIDs) != 0 {
+				intf := d.cache[intfTable][intfUUIDs[0]]
+				info.Type, _ = intf.Fields["type"].(string)
+				if ofport, ok := intf.Fields["ofport"].(float64); ok {
+					info.Ofport = int(ofport)
+				}
+			}
+			ports = append(ports, info)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Bridge != ports[j].Bridge {
+			return ports[i].Bridge < ports[j].Bridge
+		}
+		return ports[i].Name < ports[j].Name
+	})
+	return ports
+}
+
+// bridgePortNames returns the names of the ports of the bridge
+func (d *OvsdbDriver) bridgePortNames(bridgeName string) []string {
+	d.RLock()
+	defer d.RUnlock()
+	names := []string{}
+	for _, br := range d.cache[bridgeTable] {
+		if name, _ := br.Fields["name"].(string); name != bridgeName {
+			continue
+		}
+		for _, portUUID := range getUUIDs(br.Fields["ports"]) {
+			if name, ok := d.cache[portTable][portUUID].Fields["name"].(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// bridgeNames returns the names of all bridges
+func (d *OvsdbDriver) bridgeNames() []string {
+	d.RLock()
+	defer d.RUnlock()
+	names := make([]string, 0, len(d.cache[bridgeTable]))
+	for _, row := range d.cache[bridgeTable] {
+		if name, ok := row.Fields["name"].(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (d *OvsdbDriver) getBridgeUUID(bridgeName string) (libovsdb.UUID, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	for uuid, row := range d.cache[bridgeTable] {
+		if name, _ := row.Fields["name"].(string); name == bridgeName {
+			return uuid, true
+		}
+	}
+	return libovsdb.UUID{}, false
+}
+
+func (d *OvsdbDriver) getRootUUID() (libovsdb.UUID, error) {
+	d.RLock()
+	defer d.RUnlock()
+	for uuid := range d.cache[ovsTable] {
+		return uuid, nil
+	}
+	return libovsdb.UUID{}, fmt.Errorf("ovs root table %s is empty", ovsTable)
+}
+
+// getUUIDs returns the uuids of a column, ovsdb sends sets with a single
+// element as the element itself
+func getUUIDs(column interface{}) []libovsdb.UUID {
+	switch v := column.(type) {
+	case libovsdb.UUID:
+		return []libovsdb.UUID{v}
+	case libovsdb.OvsSet:
+		uuids := []libovsdb.UUID{}
+		for _, e := range v.GoSet {
+			if uuid, ok := e.(libovsdb.UUID); ok {
+				uuids = append(uuids, uuid)
+			}
+		}
+		return uuids
+	}
+	return nil
+}
+
 func (d *OvsdbDriver) populateCache(updates libovsdb.TableUpdates) {
 	d.Lock()
 	defer func() { d.Unlock() }()
 
+	if d.pending != nil {
+		*d.pending = append(*d.pending, updates)
+		return
+	}
+	applyUpdates(d.cache, updates)
+	d.notifyUpdated()
+}
+
+// notifyUpdated wakes up the waiters of cache changes, the lock must be held
+func (d *OvsdbDriver) notifyUpdated() {
+	if d.updated != nil {
+		close(d.updated)
+	}
+	d.updated = make(chan struct{})
+}
+
+// WaitForOfport waits until ovs assigned an OpenFlow port number to the
+// interface and returns it. ovs sets the ofport to -1 when it could not add
+// the interface, the error column tells why.
+func (d *OvsdbDriver) WaitForOfport(intfName string, timeout time.Duration) (int, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		d.RLock()
+		ofport, intfErr := d.getOfport(intfName)
+		updated := d.updated
+		d.RUnlock()
+
+		if ofport > 0 {
+			return ofport, nil
+		}
+		if ofport == -1 {
+			return -1, fmt.Errorf("ovs failed to add interface %s: %s", intfName, intfErr)
+		}
+		select {
+		case <-updated:
+		case <-timer.C:
+			return 0, fmt.Errorf("timeout waiting for ovs interface %s after %s", intfName, timeout)
+		}
+	}
+}
+
+// Ofport returns the ofport of the interface, 0 if ovs has not assigned one
+func (d *OvsdbDriver) Ofport(intfName string) int {
+	d.RLock()
+	defer d.RUnlock()
+	ofport, _ := d.getOfport(intfName)
+	return ofport
+}
+
+// getOfport returns the ofport and error columns of the interface, the
+// ofport is 0 while ovs has not assigned one yet
+func (d *OvsdbDriver) getOfport(intfName string) (int, string) {
+	for _, row := range d.cache[intfTable] {
+		if name, ok := row.Fields["name"]; !ok || name != intfName {
+			continue
+		}
+		ofport := 0
+		if v, ok := row.Fields["ofport"].(float64); ok {
+			ofport = int(v)
+		}
+		intfErr, _ := row.Fields["error"].(string)
+		return ofport, intfErr
+	}
+	return 0, ""
+}
+
+func applyUpdates(cache map[string]map[libovsdb.UUID]libovsdb.Row, updates libovsdb.TableUpdates) {
 	for table, tableUpdate := range updates.Updates {
-		if _, ok := d.cache[table]; !ok {
-			d.cache[table] = make(map[libovsdb.UUID]libovsdb.Row)
+		if _, ok := cache[table]; !ok {
+			cache[table] = make(map[libovsdb.UUID]libovsdb.Row)
 		}
 		for uuid, row := range tableUpdate.Rows {
 			empty := libovsdb.Row{}
 			if !reflect.DeepEqual(row.New, empty) {
-				d.cache[table][libovsdb.UUID{GoUUID: uuid}] = row.New
+				cache[table][libovsdb.UUID{GoUUID: uuid}] = row.New
 			} else {
-				delete(d.cache[table], libovsdb.UUID{GoUUID: uuid})
+				delete(cache[table], libovsdb.UUID{GoUUID: uuid})
 			}
 		}
 	}
 }
 
+// Insert inserts the row and adds it to the set column of the parent rows
+// matching the condition, like a mirror to the mirrors of its bridge
+func (d *OvsdbDriver) Insert(table string, row map[string]interface{}, parentTable, column string, parentCondition []interface{}) error {
+	rowUUID := libovsdb.UUID{GoUUID: "row"}
+	ops := []libovsdb.Operation{
+		insertRow(table, rowUUID.GoUUID, row),
+		mutateSet(parentTable, column, insertOp, []libovsdb.UUID{rowUUID}, parentCondition),
+	}
+	return d.doOperations(ops)
+}
+
+// Mutate adds (insert) or removes (delete) the uuids from the set column of
+// the rows matching the condition
+func (d *OvsdbDriver) Mutate(table, column, mutator string, uuids []libovsdb.UUID, condition []interface{}) error {
+	return d.doOperations([]libovsdb.Operation{mutateSet(table, column, mutator, uuids, condition)})
+}
+
+// insertRow returns the operation inserting the row, the other operations of
+// the transaction refer to it by uuidName
+func insertRow(table, uuidName string, row map[string]interface{}) libovsdb.Operation {
+	return libovsdb.Operation{
+		Op:       insertOp,
+		Table:    table,
+		Row:      row,
+		UUIDName: uuidName,
+	}
+}
+
+// mutateSet returns the operation adding or removing the uuids from the set
+// column of the rows matching the condition
+func mutateSet(table, column, mutator string, uuids []libovsdb.UUID, condition []interface{}) libovsdb.Operation {
+	set, _ := libovsdb.NewOvsSet(uuids)
+	return libovsdb.Operation{
+		Op:        mutateOp,
+		Table:     table,
+		Mutations: []interface{}{libovsdb.NewMutation(column, mutator, set)},
+		Where:     []interface{}{condition},
+	}
+}
+
 func (d *OvsdbDriver) doOperations(ops []libovsdb.Operation) error {
-	reply, _ := d.ovsClient.Transact(ovsDataBase, ops...)
+	ovsClient, err := d.client()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	reply, err := ovsClient.Transact(ovsDataBase, ops...)
+	if err != nil {
+		observeTransaction(start, err)
+		return fmt.Errorf("ovsdb transact failed: %v", err)
+	}
 	if len(reply) < len(ops) {
 		logrus.Errorf("Unexpected number of replies. Expected: %d, Recvd: %d", len(ops), len(reply))
 	}
 
-	for i, o := range reply {
-		if o.Error != "" && i < len(ops) {
-			return fmt.Errorf("%s(%s)", o.Error, o.Details)
-		} else if o.Error != "" {
-			return fmt.Errorf("%s(%s)", o.Error, o.Details)
+	for _, o := range reply {
+		if o.Error != "" {
+			err = fmt.Errorf("%s(%s)", o.Error, o.Details)
+			break
 		}
 	}
+	observeTransaction(start, err)
 
-	return nil
+	return err
 
 }
 
@@ -221,7 +778,20 @@ func (d *OvsdbDriver) Echo([]interface{}) {
 	logrus.Debugf("Echo ovs")
 }
 
-//Disconnected ...
-func (d *OvsdbDriver) Disconnected(*libovsdb.OvsdbClient) {
-	logrus.Debugf("Disconnected ovs")
+//Disconnected marks the driver disconnected and starts reconnecting. It is
+//called with the libovsdb connection lock held, so it must not block.
+func (d *OvsdbDriver) Disconnected(ovsClient *libovsdb.OvsdbClient) {
+	d.Lock()
+	defer d.Unlock()
+	if ovsClient != d.ovsClient {
+		return
+	}
+	// a connect in progress notices the cleared client and fails
+	d.ovsClient = nil
+	if !d.connected {
+		return
+	}
+	logrus.Warnf("Disconnected from ovsdb at %s", d.endpoint)
+	d.connected = false
+	go d.reconnect()
 }
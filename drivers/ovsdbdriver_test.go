@@ -4,12 +4,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/socketplane/libovsdb"
 	"github.com/stretchr/testify/assert"
 	"github.com/vishvananda/netlink"
 )
 
 func initOvsdbDriver(t *testing.T) *OvsdbDriver {
-	d, err := NewOvsdbDriver("ovs-br0")
+	d, err := NewOvsdbDriver("ovs-br0", []string{"unix:" + socketFile}, nil)
 	assert.Nil(t, err)
 	return d
 }
@@ -23,7 +24,7 @@ func TestAddlPort(t *testing.T) {
 	d := initOvsdbDriver(t)
 	ovsPortName := "port1"
 	ovsPortType := "internal"
-	err := d.AddPort(ovsPortName, ovsPortType, 10, 100, 1000)
+	err := d.AddPort("ovs-br0", ovsPortName, ovsPortType, 10, 100, 1000, nil)
 	assert.Nil(t, err)
 
 	// Wait a little for OVS to create the interface
@@ -40,3 +41,91 @@ func TestAddlPort(t *testing.T) {
 	assert.NotNil(t, err)
 	//defer func() { d.ovsClient.Disconnect }()
 }
+
+func TestCreateBridge(t *testing.T) {
+	d := initOvsdbDriver(t)
+	brName := "ovs-test0"
+	err := d.CreateBridge(brName, BridgeOptions{FailMode: "standalone", OtherConfig: map[string]string{"stp-priority": "100"}})
+	assert.Nil(t, err)
+
+	// Wait a little for the cache to be updated
+	time.Sleep(300 * time.Millisecond)
+	assert.True(t, d.BridgeExists(brName))
+	assert.Nil(t, d.CreateBridge(brName, BridgeOptions{}))
+
+	err = d.DeleteBridge(brName)
+	assert.Nil(t, err)
+	time.Sleep(300 * time.Millisecond)
+	assert.False(t, d.BridgeExists(brName))
+
+	err = d.AddPort(brName, "port2", "internal", 0, 0, 0, nil)
+	assert.NotNil(t, err)
+}
+
+func TestWaitForOfport(t *testing.T) {
+	d := &OvsdbDriver{
+		cache:   make(map[string]map[libovsdb.UUID]libovsdb.Row),
+		updated: make(chan struct{}),
+	}
+	intfUpdate := func(name string, fields map[string]interface{}) libovsdb.TableUpdates {
+		fields["name"] = name
+		return libovsdb.TableUpdates{Updates: map[string]libovsdb.TableUpdate{
+			intfTable: {Rows: map[string]libovsdb.RowUpdate{
+				name: {New: libovsdb.Row{Fields: fields}},
+			}},
+		}}
+	}
+
+	_, err := d.WaitForOfport("vport1", 10*time.Millisecond)
+	assert.NotNil(t, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		d.populateCache(intfUpdate("vport1", map[string]interface{}{"ofport": libovsdb.OvsSet{}}))
+		time.Sleep(10 * time.Millisecond)
+		d.populateCache(intfUpdate("vport1", map[string]interface{}{"ofport": float64(3)}))
+	}()
+	ofport, err := d.WaitForOfport("vport1", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, ofport)
+
+	d.populateCache(intfUpdate("vport2", map[string]interface{}{
+		"ofport": float64(-1),
+		"error":  "could not open network device vport2 (No such device)",
+	}))
+	_, err = d.WaitForOfport("vport2", time.Second)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "No such device")
+}
+
+func TestPorts(t *testing.T) {
+	row := func(fields map[string]interface{}) libovsdb.Row { return libovsdb.Row{Fields: fields} }
+	d := &OvsdbDriver{cache: map[string]map[libovsdb.UUID]libovsdb.Row{
+		bridgeTable: {
+			{GoUUID: "br0"}: row(map[string]interface{}{"name": "ovs-br0", "ports": libovsdb.OvsSet{GoSet: []interface{}{
+				libovsdb.UUID{GoUUID: "p1"}, libovsdb.UUID{GoUUID: "p0"},
+			}}}),
+		},
+		portTable: {
+			{GoUUID: "p0"}: row(map[string]interface{}{"name": "ovs-br0", "tag": libovsdb.OvsSet{}, "interfaces": libovsdb.UUID{GoUUID: "i0"}}),
+			{GoUUID: "p1"}: row(map[string]interface{}{"name": "vport0000001", "tag": float64(10), "interfaces": libovsdb.UUID{GoUUID: "i1"},
+				"external_ids": libovsdb.OvsMap{GoMap: map[interface{}]interface{}{extIDEndpoint: "0000000000001"}}}),
+		},
+		intfTable: {
+			{GoUUID: "i0"}: row(map[string]interface{}{"name": "ovs-br0", "type": "internal", "ofport": float64(65534)}),
+			{GoUUID: "i1"}: row(map[string]interface{}{"name": "vport0000001", "type": "", "ofport": float64(3)}),
+		},
+	}}
+	ports := d.Ports()
+	if assert.Len(t, ports, 2) {
+		assert.Equal(t, "ovs-br0", ports[0].Name)
+		assert.Equal(t, "internal", ports[0].Type)
+		assert.Equal(t, 0, ports[0].Tag)
+		assert.Equal(t, "vport0000001", ports[1].Name)
+		assert.Equal(t, 10, ports[1].Tag)
+		assert.Equal(t, 3, ports[1].Ofport)
+		assert.Equal(t, "0000000000001", ports[1].EndpointID())
+	}
+	assert.Equal(t, "ovs-br0", d.PortBridge("vport0000001"))
+	assert.Equal(t, "", d.PortBridge("vport0000002"))
+}
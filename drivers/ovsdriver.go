@@ -2,6 +2,7 @@ package drivers
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/XiaoweiQian/ovs-driver/utils/netutils"
 	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libkv/store"
 	"github.com/docker/libkv/store/boltdb"
 	"github.com/docker/libnetwork/datastore"
 	docker "github.com/fsouza/go-dockerclient"
@@ -23,13 +25,32 @@ const (
 	vlanOption       = "vlan"
 	bandwidthOption  = "bandwidth"
 	brustOption      = "brust"
+	encapOption      = "encap"
+	vniOption        = "vni"
+	routesOption     = "routes"
+	bridgeOption     = "bridge"
+	failModeOption   = "bridge_fail_mode"
+	datapathOption   = "bridge_datapath_type"
+	otherConfOption  = "bridge_other_config"
+	bridgeCleanup    = "bridge_cleanup"
+	internalOption   = "com.docker.network.internal"
 	genericOption    = "com.docker.network.generic"
 	intfLen          = 7
 	intfPrefix       = "port"
 	containerEthName = "eth"
-	useVeth          = true
+	attachOption     = "attach"
+	attachVeth       = "veth"
+	attachInternal   = "internal"
 	internalPort     = "internal"
 	vethPort         = ""
+	// portReadyTimeout bounds the wait for ovs to add an endpoint port
+	portReadyTimeout = 5 * time.Second
+)
+
+// route types understood by libnetwork
+const (
+	routeNextHop = iota
+	routeConnected
 )
 
 type networkTable map[string]*network
@@ -37,10 +58,18 @@ type networkTable map[string]*network
 //Driver aa
 type Driver struct {
 	id         string
+	config     *Config
 	ovsdb      *OvsdbDriver
 	networks   networkTable
 	localStore datastore.DataStore
 	client     *docker.Client
+	peers      map[string]struct{}
+	ipam       *Ipam
+	// portMapReady is set once the port mapping chains exist
+	portMapReady bool
+	// reconcileLock serialises reconcile passes
+	reconcileLock sync.Mutex
+	reconciler    reconciler
 	sync.Mutex
 }
 
@@ -54,47 +83,225 @@ type network struct {
 	vlan      int
 	bandwidth int
 	brust     int
-	driver    *Driver
-	endpoints endpointTable
-	subnets   []*subnet
+	encap     string
+	vni       int
+	routes    []*pluginNet.StaticRoute
+	internal  bool
+	bridge    string
+	brOpts    BridgeOptions
+	brCleanup bool
+	// attach is how endpoints are plugged into the bridge, veth or internal
+	attach string
+	parent string
+	// acl and aclDefault filter the traffic towards the endpoints
+	acl        string
+	aclDefault string
+	// portSecurity limits the endpoints to their own mac and ip addresses
+	portSecurity bool
+	// macMode is how endpoints created without a mac address get one
+	macMode string
+	// parentCreated and parentAttached record what the driver did to the
+	// parent so the last network using it can undo it
+	parentCreated  bool
+	parentAttached bool
+	// bond is an uplink port bonding several interfaces, bondAttached
+	// records that the driver added it
+	bond         string
+	bondOpts     BondOptions
+	bondAttached bool
+	driver       *Driver
+	endpoints    endpointTable
+	subnets      []*subnet
+	dbExists     bool
+	dbIndex      uint64
 	sync.Mutex
 }
 
 // Init ...
-func Init() (*Driver, error) {
-	// initiate the OvsdbDriver
-	ovsdb, err := NewOvsdbDriver(ovsBridgeName)
-	// initiate the boltdb
-	boltdb.Register()
+func Init(cfg *Config) (*Driver, error) {
+	d, err := newDriver(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("ovsdb driver init failed. Error: %s", err)
+		return nil, err
 	}
+	client, err := newSwarmClient(cfg.SwarmEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to swarm. Error: %s", err)
+	}
+	d.client = client
 
-	if ovsdb == nil {
-		return nil, fmt.Errorf("could not connect to open vswitch")
+	if err := d.ensurePortMapping(); err != nil {
+		logrus.Warnf("Could not init ovs port mapping chains, published ports are unavailable: %v", err)
+	}
+	if err := d.restoreNetworks(); err != nil {
+		logrus.Debugf("Failure during ovs networks restore: %v", err)
+	}
+	if err := d.restoreEndpoints(); err != nil {
+		logrus.Debugf("Failure during ovs endpoints restore: %v", err)
+	}
+	if err := d.ipam.restorePools(); err != nil {
+		logrus.Debugf("Failure during ovs ipam pools restore: %v", err)
+	}
+	d.applyFlowExports()
+	if interval := cfg.reconcileInterval(); interval > 0 {
+		d.startReconciler(interval)
+	}
+	if cfg.MetricsAddress != "" {
+		if err := d.startMetrics(cfg.MetricsAddress); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AdminSocket != "" {
+		if err := d.startAdmin(cfg.AdminSocket); err != nil {
+			return nil, err
+		}
 	}
 
-	client, err := docker.NewClient(swarmEndpoint)
+	return d, nil
+}
+
+// newDriver connects to ovsdb and opens the local store
+func newDriver(cfg *Config) (*Driver, error) {
+	// initiate the OvsdbDriver
+	ovsdb, err := ConnectOvsdb(cfg)
+	// initiate the boltdb
+	boltdb.Register()
 	if err != nil {
-		return nil, fmt.Errorf("could not connect to swarm. Error: %s", err)
+		return nil, err
 	}
 
-	store, err := datastore.NewDataStore(datastore.LocalScope, nil)
+	store, err := datastore.NewDataStore(datastore.LocalScope, &datastore.ScopeCfg{
+		Client: datastore.ScopeClientCfg{
+			Provider: "boltdb",
+			Address:  cfg.StorePath,
+			Config: &store.Config{
+				Bucket: defaultStoreBucket,
+			},
+		},
+	})
 	if err != nil {
+		ovsdb.Close()
 		return nil, fmt.Errorf("could not init ovs local store. Error: %s", err)
 	}
 
 	d := &Driver{
+		config:     cfg,
 		ovsdb:      ovsdb,
 		networks:   networkTable{},
 		localStore: store,
-		client:     client,
+		peers:      map[string]struct{}{},
 	}
-	if err := d.restoreEndpoints(); err != nil {
-		logrus.Debugf("Failure during ovs endpoints restore: %v", err)
+	d.ipam = newIpam(d)
+	return d, nil
+}
+
+// Reload applies the settings that are safe to change while running, the
+// others only take effect after a restart
+func (d *Driver) Reload(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+	client, err := newSwarmClient(cfg.SwarmEndpoint)
+	if err != nil {
+		return fmt.Errorf("could not connect to swarm. Error: %s", err)
 	}
 
-	return d, nil
+	// the settings needing a restart are never changed, so cur can be
+	// compared without the lock
+	d.Lock()
+	cur := d.config
+	d.client = client
+	cur.reload(cfg)
+	d.Unlock()
+	d.applyFlowExports()
+
+	if cur.ovsdbChanged(cfg) || cur.Bridge != cfg.Bridge || cur.PluginName != cfg.PluginName ||
+		cur.PluginGroup != cfg.PluginGroup || cur.VethPrefix != cfg.VethPrefix || cur.StorePath != cfg.StorePath ||
+		cur.ReconcileInterval != cfg.ReconcileInterval || cur.MetricsAddress != cfg.MetricsAddress ||
+		cur.AdminSocket != cfg.AdminSocket || cur.IpamDefaultPool != cfg.IpamDefaultPool {
+		logrus.Warnf("ovs driver config changes of ovsdb connection, bridge, plugin socket, veth prefix, store path, reconcile interval, metrics address, admin socket or ipam default pool require a restart")
+	}
+	logrus.Infof("ovs driver config reloaded")
+	return nil
+}
+
+// ConnectOvsdb connects to the ovsdb endpoints of the config
+func ConnectOvsdb(cfg *Config) (*OvsdbDriver, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid ovs driver config. Error: %s", err)
+	}
+	tlsConfig, err := cfg.ovsdbTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid ovs driver config. Error: %s", err)
+	}
+	ovsdb, err := NewOvsdbDriver(cfg.Bridge, cfg.ovsdbEndpoints(), tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("ovsdb driver init failed. Error: %s", err)
+	}
+	if ovsdb == nil {
+		return nil, fmt.Errorf("could not connect to open vswitch")
+	}
+	return ovsdb, nil
+}
+
+func newSwarmClient(endpoint string) (*docker.Client, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	return docker.NewClient(endpoint)
+}
+
+// bridgeName returns the bridge of networks created without the bridge option
+func (d *Driver) bridgeName() string {
+	if d == nil {
+		return ovsBridgeName
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.config == nil {
+		return ovsBridgeName
+	}
+	return d.config.Bridge
+}
+
+// ipamDefaultPool returns the pool split for networks without a subnet
+func (d *Driver) ipamDefaultPool() string {
+	if d == nil {
+		return defaultIpamPool
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.config == nil {
+		return defaultIpamPool
+	}
+	return d.config.IpamDefaultPool
+}
+
+// vethPrefix returns the name prefix of the container side interfaces
+func (d *Driver) vethPrefix() string {
+	if d == nil {
+		return intfPrefix
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.config == nil {
+		return intfPrefix
+	}
+	return d.config.VethPrefix
+}
+
+// localOvsdb reports whether flows can be installed on the bridges
+func (d *Driver) localOvsdb() bool {
+	if d == nil {
+		return true
+	}
+	d.Lock()
+	defer d.Unlock()
+	return d.config == nil || d.config.localOvsdb()
 }
 
 // GetCapabilities ...
@@ -113,37 +320,115 @@ func (d *Driver) CreateNetwork(r *pluginNet.CreateNetworkRequest) error {
 	if id == "" {
 		return fmt.Errorf("invalid network id")
 	}
+	// endpoints and joins are addressed by their ipv4 address, ipv6 is
+	// only supported next to it
 	if len(ipV4Data) == 0 {
-		return fmt.Errorf("ipv4 pool is empty")
+		return fmt.Errorf("ovs network %s needs an ipv4 pool, ipv6 only networks are not supported", id)
 	}
 	n := &network{
 		id:        id,
 		driver:    d,
 		endpoints: endpointTable{},
 		subnets:   []*subnet{},
-		vlan:      getVlan(opts),
-		brust:     getBrust(opts),
-		bandwidth: getBandwidth(opts),
+		internal:  getInternal(opts),
+	}
+	if err := n.parseOptions(getGenericOptions(opts)); err != nil {
+		return err
 	}
-
-	var pool, gw *net.IPNet
 	for _, ipd := range ipV4Data {
-		_, pool, _ = net.ParseCIDR(ipd.Pool)
-		_, gw, _ = net.ParseCIDR(ipd.Gateway)
-		s := &subnet{
-			subnetIP: pool,
-			gwIP:     gw,
-		}
-		n.subnets = append(n.subnets, s)
+		n.addSubnet(ipd.Pool, ipd.Gateway)
+	}
+	for _, ipd := range r.IPv6Data {
+		n.addSubnet(ipd.Pool, ipd.Gateway)
 	}
 
-	d.Lock()
-	d.networks[id] = n
-	d.Unlock()
+	if err := runSteps(d.createNetworkSteps(n)); err != nil {
+		return err
+	}
+
+	if n.encap != "" {
+		d.addNetworkTunnels(n)
+	}
 
 	return nil
 }
 
+// createNetworkSteps sets up the bridge and uplinks of the network and
+// registers it
+func (d *Driver) createNetworkSteps(n *network) []step {
+	bridgeExisted := d.ovsdb.BridgeExists(n.bridge)
+	var old *network
+	return []step{
+		{
+			name: "create bridge " + n.bridge,
+			do: func() error {
+				if err := d.ovsdb.CreateBridge(n.bridge, n.brOpts); err != nil {
+					return fmt.Errorf("ovs create bridge %s failed for network %s: %v", n.bridge, n.id, err)
+				}
+				return nil
+			},
+			undo: func() error {
+				if bridgeExisted || d.bridgeInUse(n.bridge) {
+					return nil
+				}
+				return d.ovsdb.DeleteBridge(n.bridge)
+			},
+		},
+		{
+			name: "apply flow export " + n.bridge,
+			do:   func() error { return d.applyFlowExport(n.bridge) },
+		},
+		{
+			name: "add parent " + n.parent,
+			do:   func() error { return d.addParent(n) },
+			undo: func() error {
+				d.deleteParent(n)
+				return nil
+			},
+		},
+		{
+			name: "add bond " + n.bond,
+			do:   func() error { return d.addBond(n) },
+			undo: func() error {
+				d.deleteBond(n)
+				return nil
+			},
+		},
+		{
+			name: "register network " + n.id,
+			do: func() error {
+				d.Lock()
+				defer d.Unlock()
+				old = d.networks[n.id]
+				if old != nil && old.dbExists {
+					n.SetIndex(old.dbIndex)
+				}
+				d.networks[n.id] = n
+				return nil
+			},
+			undo: func() error {
+				d.Lock()
+				defer d.Unlock()
+				if old != nil {
+					d.networks[n.id] = old
+				} else {
+					delete(d.networks, n.id)
+				}
+				return nil
+			},
+		},
+		{
+			name: "store network " + n.id,
+			do: func() error {
+				if err := d.writeNetworkToStore(n); err != nil {
+					return fmt.Errorf("failed to update ovs network %s to local store: %v", n.id, err)
+				}
+				return nil
+			},
+		},
+	}
+}
+
 // DeleteNetwork ...
 func (d *Driver) DeleteNetwork(r *pluginNet.DeleteNetworkRequest) error {
 	logrus.Debugf("DeleteNetwork ovs")
@@ -163,10 +448,33 @@ func (d *Driver) DeleteNetwork(r *pluginNet.DeleteNetworkRequest) error {
 			return err
 		}
 	}
+	if err := d.deleteMirrorsOf(extIDMirrorNetwork, nid); err != nil {
+		return err
+	}
+	if n.encap != "" {
+		d.deleteNetworkTunnels(n)
+	}
 	d.Lock()
 	delete(d.networks, nid)
 	d.Unlock()
 
+	if err := d.deleteNetworkFromStore(n); err != nil {
+		logrus.Debugf("Failed to delete ovs network %s from local store: %v", nid, err)
+	}
+
+	d.deleteParent(n)
+	d.deleteBond(n)
+
+	if !d.bridgeInUse(n.bridge) {
+		if n.brCleanup {
+			if err := d.ovsdb.DeleteBridge(n.bridge); err != nil {
+				logrus.Errorf("Error deleting ovs bridge %s of network %s. Err: %v", n.bridge, nid, err)
+			}
+		} else {
+			d.deletePipelineFlows(n.bridge)
+		}
+	}
+
 	return nil
 }
 
@@ -180,28 +488,39 @@ func (d *Driver) AllocateNetwork(r *pluginNet.AllocateNetworkRequest) (*pluginNe
 		return nil, fmt.Errorf("invalid network id for ovs network")
 	}
 
-	if ipV4Data == nil {
-		return nil, fmt.Errorf("empty ipv4 data passed during ovs network creation")
+	if len(ipV4Data) == 0 {
+		return nil, fmt.Errorf("ovs network %s needs an ipv4 pool, ipv6 only networks are not supported", id)
+	}
+
+	d.Lock()
+	_, ok := d.networks[id]
+	d.Unlock()
+	if ok {
+		logrus.Debugf("ovs network with id %s already exists", id)
+		return &pluginNet.AllocateNetworkResponse{Options: opts}, nil
 	}
 
 	n := &network{
-		id:      id,
-		driver:  d,
-		subnets: []*subnet{},
+		id:        id,
+		driver:    d,
+		endpoints: endpointTable{},
+		subnets:   []*subnet{},
+	}
+	if err := n.parseOptions(opts); err != nil {
+		return nil, err
 	}
-	var pool, gw *net.IPNet
 	for _, ipd := range ipV4Data {
-		_, pool, _ = net.ParseCIDR(ipd.Pool)
-		_, gw, _ = net.ParseCIDR(ipd.Gateway)
-		s := &subnet{
-			subnetIP: pool,
-			gwIP:     gw,
-		}
-		n.subnets = append(n.subnets, s)
+		n.addSubnet(ipd.Pool, ipd.Gateway)
+	}
+	for _, ipd := range r.IPv6Data {
+		n.addSubnet(ipd.Pool, ipd.Gateway)
 	}
 	d.Lock()
 	d.networks[id] = n
 	d.Unlock()
+	if err := d.writeNetworkToStore(n); err != nil {
+		return nil, fmt.Errorf("failed to update ovs network %s to local store: %v", id, err)
+	}
 	res := &pluginNet.AllocateNetworkResponse{Options: opts}
 
 	return res, nil
@@ -217,7 +536,7 @@ func (d *Driver) FreeNetwork(r *pluginNet.FreeNetworkRequest) error {
 	}
 
 	d.Lock()
-	_, ok := d.networks[id]
+	n, ok := d.networks[id]
 	d.Unlock()
 
 	if !ok {
@@ -229,6 +548,10 @@ func (d *Driver) FreeNetwork(r *pluginNet.FreeNetworkRequest) error {
 	delete(d.networks, id)
 	d.Unlock()
 
+	if err := d.deleteNetworkFromStore(n); err != nil {
+		logrus.Debugf("Failed to delete ovs network %s from local store: %v", id, err)
+	}
+
 	return nil
 }
 
@@ -259,27 +582,55 @@ func (d *Driver) Join(r *pluginNet.JoinRequest) (*pluginNet.JoinResponse, error)
 	if s == nil {
 		return nil, fmt.Errorf("could not find subnet for endpoint %s", eid)
 	}
-	ovsPortName := intfName
-	if useVeth {
-		// Get OVS port name
-		ovsPortName = getOvsPortName(intfName)
-	}
-	// Wait a little for OVS to create the interface
-	time.Sleep(300 * time.Millisecond)
-	// Set the OVS side of the port as up
-	err := netutils.SetLinkUp(ovsPortName)
+	ovsPortName := ep.ovsPortName()
+	// Wait for OVS to create the interface
+	ofport, err := d.ovsdb.WaitForOfport(ovsPortName, portReadyTimeout)
 	if err != nil {
-		logrus.Errorf("Error setting link %s up. Err: %v", ovsPortName, err)
+		logrus.Errorf("Error waiting for ovs port %s. Err: %v", ovsPortName, err)
 		return nil, err
 	}
+	// Set the OVS side of the port as up, an internal port is itself moved
+	// into the container and brought up there
+	if ep.attach != attachInternal {
+		if err := netutils.SetLinkUp(ovsPortName); err != nil {
+			logrus.Errorf("Error setting link %s up. Err: %v", ovsPortName, err)
+			return nil, err
+		}
+	}
+	if n.portSecurity {
+		if err := d.installPortSecurity(n, ep, ofport); err != nil {
+			logrus.Errorf("Error installing port security of endpoint %s. Err: %v", eid, err)
+			return nil, err
+		}
+	}
+	// a join after a leave needs the flows removed by the leave again
+	if n.hasACL(ep) {
+		if err := d.installACL(n, ep); err != nil {
+			logrus.Errorf("Error installing acl of endpoint %s. Err: %v", eid, err)
+			return nil, err
+		}
+	}
 
 	res := &pluginNet.JoinResponse{
 		InterfaceName: pluginNet.InterfaceName{
 			SrcName:   intfName,
 			DstPrefix: containerEthName,
 		},
+		StaticRoutes:          n.routes,
+		DisableGatewayService: n.internal,
 	}
-	logrus.Debugf("Join ovs with port=%s,ip=%s and mac=%s", ovsPortName, ep.addr.String(), ep.mac.String())
+	if s.gwIP != nil && !n.internal {
+		res.Gateway = s.gwIP.IP.String()
+	}
+	if ep.addrv6 != nil && !n.internal {
+		if s6 := n.getSubnetforIP(ep.addrv6); s6 != nil && s6.gwIP != nil {
+			res.GatewayIPv6 = s6.gwIP.IP.String()
+		}
+	}
+	if ep.containerID == "" {
+		go d.tagEndpointContainer(n, ep)
+	}
+	logrus.Debugf("Join ovs with port=%s,ip=%s,ipv6=%s,mac=%s,gateway=%s and gatewayv6=%s", ovsPortName, ep.addr.String(), ep.addrv6.String(), ep.mac.String(), res.Gateway, res.GatewayIPv6)
 	return res, nil
 
 }
@@ -307,72 +658,357 @@ func (d *Driver) Leave(r *pluginNet.LeaveRequest) error {
 	if intfName == "" {
 		return fmt.Errorf("intfName %q empty", intfName)
 	}
-	ovsPortName := intfName
-	if useVeth {
-		// Get OVS port name
-		ovsPortName = getOvsPortName(intfName)
-	}
-	err := d.ovsdb.DelPort(ovsPortName)
+	err := d.ovsdb.DelPort(ep.ovsPortName())
 	if err != nil {
 		return fmt.Errorf("ovs delete endpoint failed with InterfaceName=%s,err=%s", intfName, err)
 	}
+	if err := d.removePortSecurity(n, ep); err != nil {
+		return err
+	}
+	if err := d.removeACL(n, ep); err != nil {
+		return err
+	}
 
 	return nil
 }
 
 // DiscoverNew ...
 func (d *Driver) DiscoverNew(r *pluginNet.DiscoveryNotification) error {
-	logrus.Debugf("DiscoverNew ovs")
-	return nil
+	logrus.Debugf("DiscoverNew ovs with type=%d,data=%v", r.DiscoveryType, r.DiscoveryData)
+	if r.DiscoveryType != nodeDiscovery {
+		return nil
+	}
+	peer, self, err := parseNodeDiscovery(r.DiscoveryData)
+	if err != nil {
+		return err
+	}
+	if self {
+		return nil
+	}
+	return d.addPeer(peer)
 }
 
 // DiscoverDelete ...
 func (d *Driver) DiscoverDelete(r *pluginNet.DiscoveryNotification) error {
-	logrus.Debugf("DiscoverDelete ovs")
-	return nil
+	logrus.Debugf("DiscoverDelete ovs with type=%d,data=%v", r.DiscoveryType, r.DiscoveryData)
+	if r.DiscoveryType != nodeDiscovery {
+		return nil
+	}
+	peer, self, err := parseNodeDiscovery(r.DiscoveryData)
+	if err != nil {
+		return err
+	}
+	if self {
+		return nil
+	}
+	return d.deletePeer(peer)
 }
 
 // ProgramExternalConnectivity ...
 func (d *Driver) ProgramExternalConnectivity(r *pluginNet.ProgramExternalConnectivityRequest) error {
-	logrus.Debugf("ProgramExternalConnectivity ovs")
+	logrus.Debugf("ProgramExternalConnectivity ovs with opts=%v", r.Options)
+	nid := r.NetworkID
+	eid := r.EndpointID
+	if nid == "" {
+		return fmt.Errorf("invalid network id")
+	}
+	if eid == "" {
+		return fmt.Errorf("invalid endpoint id")
+	}
+	n := d.network(nid)
+	if n == nil {
+		return fmt.Errorf("network id %q not found", nid)
+	}
+	ep := n.endpoint(eid)
+	if ep == nil {
+		return fmt.Errorf("endpoint id %q not found", eid)
+	}
+	exposedPorts, err := getExposedPorts(r.Options)
+	if err != nil {
+		return err
+	}
+	portMapping, err := getPortMapping(r.Options)
+	if err != nil {
+		return err
+	}
+	if len(portMapping) != 0 {
+		if err := d.ensurePortMapping(); err != nil {
+			return fmt.Errorf("ovs could not init port mapping chains for endpoint %s: %v", eid, err)
+		}
+	}
+	var hostPorts []io.Closer
+	for i := range portMapping {
+		l, err := allocateHostPort(&portMapping[i])
+		if err != nil {
+			releaseHostPorts(hostPorts)
+			return fmt.Errorf("ovs could not allocate host port for endpoint %s: %v", eid, err)
+		}
+		if l != nil {
+			hostPorts = append(hostPorts, l)
+		}
+	}
+	ep.exposedPorts = exposedPorts
+	ep.portMapping = portMapping
+	if err := ep.programPortMapping(); err != nil {
+		ep.portMapping = nil
+		releaseHostPorts(hostPorts)
+		return fmt.Errorf("ovs program port mapping failed for endpoint %s: %v", eid, err)
+	}
+	ep.hostPorts = hostPorts
+	if err := d.writeEndpointToStore(ep); err != nil {
+		// docker sees the call failing, so nothing of it may stay behind
+		if err := ep.revokePortMapping(); err != nil {
+			logrus.Warnf("Failed to revoke port mapping of ovs endpoint %s: %v", eid, err)
+		}
+		ep.exposedPorts = nil
+		ep.portMapping = nil
+		return fmt.Errorf("failed to update ovs endpoint %s to local store: %v", ep.id[0:7], err)
+	}
+	logrus.Debugf("ProgramExternalConnectivity ovs with endpoint=%s,portMapping=%v", eid, ep.portMapping)
 	return nil
 }
 
 // RevokeExternalConnectivity ...
 func (d *Driver) RevokeExternalConnectivity(r *pluginNet.RevokeExternalConnectivityRequest) error {
 	logrus.Debugf("RevokeExternalConnectivity ovs")
+	nid := r.NetworkID
+	eid := r.EndpointID
+	if nid == "" {
+		return fmt.Errorf("invalid network id")
+	}
+	if eid == "" {
+		return fmt.Errorf("invalid endpoint id")
+	}
+	n := d.network(nid)
+	if n == nil {
+		return fmt.Errorf("network id %q not found", nid)
+	}
+	ep := n.endpoint(eid)
+	if ep == nil {
+		return fmt.Errorf("endpoint id %q not found", eid)
+	}
+	if err := ep.revokePortMapping(); err != nil {
+		return fmt.Errorf("ovs revoke port mapping failed for endpoint %s: %v", eid, err)
+	}
+	ep.exposedPorts = nil
+	ep.portMapping = nil
+	if err := d.writeEndpointToStore(ep); err != nil {
+		return fmt.Errorf("failed to update ovs endpoint %s to local store: %v", ep.id[0:7], err)
+	}
 	return nil
 }
 
-func getVlan(opts map[string]interface{}) int {
-	vlan := 0
+// getGenericOptions returns the driver specific options of a create request
+func getGenericOptions(opts map[string]interface{}) map[string]string {
+	res := map[string]string{}
 	if opts != nil {
 		if o, ok := opts[genericOption].(map[string]interface{}); ok {
-			v, _ := o[vlanOption].(string)
-			vlan, _ = strconv.Atoi(v)
+			for k, v := range o {
+				if s, ok := v.(string); ok {
+					res[k] = s
+				}
+			}
 		}
 	}
+	return res
+}
+
+func getVlan(opts map[string]string) int {
+	vlan, _ := strconv.Atoi(opts[vlanOption])
 	return vlan
 }
-func getBandwidth(opts map[string]interface{}) int {
-	var bandwidth int
-	if opts != nil {
-		if o, ok := opts[genericOption].(map[string]interface{}); ok {
-			b, _ := o[bandwidthOption].(string)
-			bandwidth, _ = strconv.Atoi(b)
+func getBandwidth(opts map[string]string) int {
+	bandwidth, _ := strconv.Atoi(opts[bandwidthOption])
+	return bandwidth
+}
+func getBrust(opts map[string]string) int {
+	brust, _ := strconv.Atoi(opts[brustOption])
+	return brust
+}
+func getEncap(opts map[string]string) string {
+	return opts[encapOption]
+}
+func getVni(opts map[string]string) int {
+	vni, _ := strconv.Atoi(opts[vniOption])
+	return vni
+}
+func getRoutes(opts map[string]string) ([]*pluginNet.StaticRoute, error) {
+	return parseRoutes(opts[routesOption])
+}
+func getBridge(opts map[string]string) string {
+	return opts[bridgeOption]
+}
+func getBridgeOptions(opts map[string]string) (BridgeOptions, error) {
+	brOpts := BridgeOptions{
+		FailMode:     opts[failModeOption],
+		DatapathType: opts[datapathOption],
+	}
+	switch brOpts.FailMode {
+	case "", "standalone", "secure":
+	default:
+		return brOpts, fmt.Errorf("invalid %s option %q, must be standalone or secure", failModeOption, brOpts.FailMode)
+	}
+	for _, kv := range strings.Split(opts[otherConfOption], ",") {
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return brOpts, fmt.Errorf("invalid %s option %q, must be key=value", otherConfOption, kv)
+		}
+		if brOpts.OtherConfig == nil {
+			brOpts.OtherConfig = map[string]string{}
 		}
+		brOpts.OtherConfig[parts[0]] = parts[1]
 	}
-	return bandwidth
+	return brOpts, nil
 }
-func getBrust(opts map[string]interface{}) int {
-	var brust int
-	if opts != nil {
-		if o, ok := opts[genericOption].(map[string]interface{}); ok {
-			b, _ := o[brustOption].(string)
-			brust, _ = strconv.Atoi(b)
+func getBridgeCleanup(opts map[string]string) bool {
+	cleanup, _ := strconv.ParseBool(opts[bridgeCleanup])
+	return cleanup
+}
+
+// getAttach returns the attachment mode of the endpoints, veth by default
+func getAttach(opts map[string]string) (string, error) {
+	switch attach := opts[attachOption]; attach {
+	case "":
+		return attachVeth, nil
+	case attachVeth, attachInternal:
+		return attach, nil
+	default:
+		return "", fmt.Errorf("invalid %s option %q, must be %s or %s", attachOption, attach, attachVeth, attachInternal)
+	}
+}
+
+// parseOptions sets the driver specific options of the network
+func (n *network) parseOptions(opts map[string]string) error {
+	n.vlan = getVlan(opts)
+	n.brust = getBrust(opts)
+	n.bandwidth = getBandwidth(opts)
+	n.encap = getEncap(opts)
+	n.vni = getVni(opts)
+	if err := validateEncap(n.encap); err != nil {
+		return err
+	}
+	routes, err := getRoutes(opts)
+	if err != nil {
+		return err
+	}
+	n.routes = routes
+	n.bridge = getBridge(opts)
+	if n.bridge == "" {
+		n.bridge = n.driver.bridgeName()
+	}
+	if n.brOpts, err = getBridgeOptions(opts); err != nil {
+		return err
+	}
+	n.brCleanup = getBridgeCleanup(opts)
+	if n.attach, err = getAttach(opts); err != nil {
+		return err
+	}
+	n.parent = opts[parentOption]
+	if _, _, err := parseParent(n.parent); err != nil {
+		return err
+	}
+	if n.bond, n.bondOpts, err = getBond(opts); err != nil {
+		return err
+	}
+	if n.bond != "" && n.parent != "" {
+		return fmt.Errorf("%s and %s options cannot be used together", parentOption, bondOption)
+	}
+	n.acl = opts[aclOption]
+	if _, err := parseACL(n.acl); err != nil {
+		return fmt.Errorf("invalid %s option: %v", aclOption, err)
+	}
+	if n.aclDefault, err = getACLDefault(opts); err != nil {
+		return err
+	}
+	if n.portSecurity, err = getPortSecurity(opts); err != nil {
+		return err
+	}
+	if n.portSecurity && !n.driver.localOvsdb() {
+		if opts[portSecurityOption] != "" {
+			return fmt.Errorf("%s needs a local ovsdb, its flows are installed with ovs-ofctl", portSecurityOption)
 		}
+		n.portSecurity = false
 	}
-	return brust
+	if n.macMode, err = getMacMode(opts); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bridgeInUse checks if any network is still attached to the bridge
+func (d *Driver) bridgeInUse(bridge string) bool {
+	d.Lock()
+	defer d.Unlock()
+	for _, n := range d.networks {
+		if n.bridge == bridge {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *network) endpoint(eid string) *endpoint {
+	n.Lock()
+	defer n.Unlock()
+	return n.endpoints[eid]
+}
+
+func getInternal(opts map[string]interface{}) bool {
+	internal, _ := opts[internalOption].(bool)
+	return internal
+}
+
+// parseRoutes parses a comma separated list of static routes. A route is a
+// destination CIDR with an optional "@nexthop", routes without a next hop are
+// treated as directly connected.
+func parseRoutes(routes string) ([]*pluginNet.StaticRoute, error) {
+	res := []*pluginNet.StaticRoute{}
+	for _, r := range strings.Split(routes, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		parts := strings.SplitN(r, "@", 2)
+		_, dst, err := net.ParseCIDR(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s option destination %q: %v", routesOption, parts[0], err)
+		}
+		route := &pluginNet.StaticRoute{
+			Destination: dst.String(),
+			RouteType:   routeConnected,
+		}
+		if len(parts) == 2 {
+			nh := net.ParseIP(parts[1])
+			if nh == nil {
+				return nil, fmt.Errorf("invalid %s option next hop %q", routesOption, parts[1])
+			}
+			route.RouteType = routeNextHop
+			route.NextHop = nh.String()
+		}
+		res = append(res, route)
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return res, nil
+}
+
+// addSubnet adds an ipv4 or ipv6 pool and its gateway to the network
+func (n *network) addSubnet(pool, gateway string) {
+	_, subnetIP, err := net.ParseCIDR(pool)
+	if err != nil {
+		logrus.Debugf("Invalid pool %q for network (%s): %v", pool, n.id, err)
+		return
+	}
+	gwIP, _ := netutils.ParseCIDR(gateway)
+	s := &subnet{
+		subnetIP: subnetIP,
+		gwIP:     gwIP,
+	}
+	n.subnets = append(n.subnets, s)
 }
 
 // getSubnetforIP returns the subnet to which the given IP belongs
@@ -414,8 +1050,7 @@ func getGatewayIP(ipv4 []*pluginNet.IPAMData) (string, string, error) {
 
 // getOvsPortName returns OVS port name depending on if we use Veth pairs
 func getOvsPortName(intfName string) string {
-	ovsPortName := strings.Replace(intfName, "port", "vport", 1)
-	return ovsPortName
+	return "v" + intfName
 }
 
 // Endpoints are stored in the local store. Restore them and reconstruct
@@ -428,12 +1063,13 @@ func (d *Driver) restoreEndpoints() error {
 
 	kvol, err := d.localStore.List(datastore.Key(ovsEndpointPrefix), &endpoint{})
 	if err != nil && err != datastore.ErrKeyNotFound {
-		return fmt.Errorf("failed to read ovs endpoint from store: %v", err)
+		// a corrupt store is rebuilt from the ovs external_ids below
+		logrus.Errorf("Failed to read ovs endpoint from store, restoring from ovsdb: %v", err)
+		kvol = nil
 	}
 
 	if err == datastore.ErrKeyNotFound {
 		logrus.Debugf("Restore endpoint,But key not found.key=%s ", ovsEndpointPrefix)
-		return nil
 	}
 	var ovsPortName string
 	for _, kvo := range kvol {
@@ -445,10 +1081,11 @@ func (d *Driver) restoreEndpoints() error {
 			if err := d.deleteEndpointFromStore(ep); err != nil {
 				logrus.Debugf("Failed to delete stale ovs endpoint (%s) from store", ep.id[0:7])
 			}
-			ovsPortName = ep.intfName
-			if useVeth {
-				// Get OVS port name
-				ovsPortName = getOvsPortName(ep.intfName)
+			if err := ep.revokePortMapping(); err != nil {
+				logrus.Debugf("Failed to revoke port mapping of stale ovs endpoint (%s)", ep.id[0:7])
+			}
+			ovsPortName = ep.ovsPortName()
+			if ep.attach == attachVeth {
 				if err := netutils.DeleteVethPair(ep.intfName, ovsPortName); err != nil {
 					return fmt.Errorf("delete veth pair failed with InterfaceName=%s,peer=%s,err=%s", ep.intfName, ovsPortName, err)
 				}
@@ -464,7 +1101,24 @@ func (d *Driver) restoreEndpoints() error {
 		logrus.Debugf("Success restore endpoint=%s from local store ", epJSON)
 		n.endpoints[ep.id] = ep
 		n.Unlock()
+		if err := ep.programPortMapping(); err != nil {
+			logrus.Warnf("Failed to restore port mapping of ovs endpoint (%s): %v", ep.id[0:7], err)
+		}
+		ep.holdHostPorts()
+		if n.hasACL(ep) {
+			if err := d.installACL(n, ep); err != nil {
+				logrus.Warnf("Failed to restore acl of ovs endpoint (%s): %v", ep.id[0:7], err)
+			}
+		}
+		if n.portSecurity {
+			if ofport := d.ovsdb.Ofport(ep.ovsPortName()); ofport > 0 {
+				if err := d.installPortSecurity(n, ep, ofport); err != nil {
+					logrus.Warnf("Failed to restore port security of ovs endpoint (%s): %v", ep.id[0:7], err)
+				}
+			}
+		}
 	}
+	d.restoreEndpointsFromOvsdb()
 	return nil
 }
 
@@ -473,11 +1127,16 @@ func (d *Driver) network(nid string) *network {
 	n, ok := d.networks[nid]
 	d.Unlock()
 	if !ok {
+		// networks are restored from the local store at init, swarm is
+		// only asked about networks created before they were persisted
 		n = d.getNetworkFromSwarm(nid)
 		if n != nil {
 			d.Lock()
 			d.networks[nid] = n
 			d.Unlock()
+			if err := d.writeNetworkToStore(n); err != nil {
+				logrus.Debugf("Failed to write ovs network (%s) from swarm to local store: %v", nid, err)
+			}
 		}
 	}
 
@@ -485,39 +1144,46 @@ func (d *Driver) network(nid string) *network {
 }
 
 func (d *Driver) getNetworkFromSwarm(nid string) *network {
-	if d.client == nil {
+	d.Lock()
+	client := d.client
+	d.Unlock()
+	if client == nil {
 		return nil
 	}
-	nw, err := d.client.NetworkInfo(nid)
-	logrus.Debugf("Network (%s)  found from swarm", nw)
+	nw, err := client.NetworkInfo(nid)
 	if err != nil {
+		logrus.Debugf("Network (%s) not found from swarm: %v", nid, err)
 		return nil
 	}
-	opts := nw.Options
-	subnets := nw.IPAM.Config
-	vlan, _ := strconv.Atoi(opts[vlanOption])
-	brust, _ := strconv.Atoi(opts[brustOption])
-	bandwidth, _ := strconv.Atoi(opts[bandwidthOption])
+	logrus.Debugf("Network (%s) found from swarm", nw.ID)
 	n := &network{
 		id:        nid,
 		driver:    d,
 		endpoints: endpointTable{},
-		vlan:      vlan,
-		brust:     brust,
-		bandwidth: bandwidth,
+		internal:  nw.Internal,
 		subnets:   []*subnet{},
 	}
-	var pool, gw *net.IPNet
-	for _, ipd := range subnets {
-		_, pool, _ = net.ParseCIDR(ipd.IPRange)
-		_, gw, _ = net.ParseCIDR(ipd.Gateway)
-		s := &subnet{
-			subnetIP: pool,
-			gwIP:     gw,
-		}
-		n.subnets = append(n.subnets, s)
+	if err := n.parseOptions(nw.Options); err != nil {
+		logrus.Debugf("Invalid options of network (%s) from swarm: %v", nid, err)
+		return nil
+	}
+	for _, ipd := range nw.IPAM.Config {
+		n.addSubnet(ipd.Subnet, getSwarmGateway(ipd.Subnet, ipd.Gateway))
 	}
 
-	logrus.Debugf("restore Network (%s) from swarm", n)
+	logrus.Debugf("restore Network (%s) from swarm", nid)
 	return n
 }
+
+// getSwarmGateway returns the gateway of a swarm subnet in CIDR notation
+func getSwarmGateway(pool, gateway string) string {
+	if gateway == "" || strings.Contains(gateway, "/") {
+		return gateway
+	}
+	_, subnetIP, err := net.ParseCIDR(pool)
+	if err != nil {
+		return ""
+	}
+	ones, _ := subnetIP.Mask.Size()
+	return fmt.Sprintf("%s/%d", gateway, ones)
+}
@@ -0,0 +1,91 @@
+package drivers
+
+import (
+	"fmt"
+	"testing"
+
+	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/socketplane/libovsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := parseRoutes("10.2.0.0/16@10.1.0.1, 172.16.0.0/12,fd00:1::/64@fd00::1")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(routes))
+	assert.Equal(t, "10.2.0.0/16", routes[0].Destination)
+	assert.Equal(t, routeNextHop, routes[0].RouteType)
+	assert.Equal(t, "10.1.0.1", routes[0].NextHop)
+	assert.Equal(t, "172.16.0.0/12", routes[1].Destination)
+	assert.Equal(t, routeConnected, routes[1].RouteType)
+	assert.Equal(t, "", routes[1].NextHop)
+	assert.Equal(t, "fd00::1", routes[2].NextHop)
+
+	routes, err = parseRoutes("")
+	assert.Nil(t, err)
+	assert.Nil(t, routes)
+
+	_, err = parseRoutes("10.2.0.0@10.1.0.1")
+	assert.NotNil(t, err)
+	_, err = parseRoutes("10.2.0.0/16@gateway")
+	assert.NotNil(t, err)
+}
+
+func TestGetInternal(t *testing.T) {
+	assert.True(t, getInternal(map[string]interface{}{internalOption: true}))
+	assert.False(t, getInternal(map[string]interface{}{}))
+	assert.False(t, getInternal(nil))
+}
+
+func TestParseParent(t *testing.T) {
+	master, vlanID, err := parseParent("eth1")
+	assert.Nil(t, err)
+	assert.Equal(t, "eth1", master)
+	assert.Equal(t, 0, vlanID)
+
+	master, vlanID, err = parseParent("eth1.100")
+	assert.Nil(t, err)
+	assert.Equal(t, "eth1", master)
+	assert.Equal(t, 100, vlanID)
+
+	_, _, err = parseParent("eth1.5000")
+	assert.NotNil(t, err)
+	_, _, err = parseParent("eth1.abc")
+	assert.NotNil(t, err)
+}
+
+func TestCreateNetworkIPv6Only(t *testing.T) {
+	d, _, _ := newTestEndpointDriver()
+	ipv6Data := pluginNet.IPAMData{Pool: "fd00:1::/64", Gateway: "fd00:1::1/64"}
+
+	err := d.CreateNetwork(&pluginNet.CreateNetworkRequest{NetworkID: "0123456789ab", IPv6Data: []*pluginNet.IPAMData{&ipv6Data}})
+	assert.NotNil(t, err)
+	_, err = d.AllocateNetwork(&pluginNet.AllocateNetworkRequest{NetworkID: "0123456789ab", IPv6Data: []pluginNet.IPAMData{ipv6Data}})
+	assert.NotNil(t, err)
+	assert.Nil(t, d.network("0123456789ab"))
+}
+
+func TestCreateNetworkRollback(t *testing.T) {
+	d, _, store := newTestEndpointDriver()
+	// the bridge exists, so only the later steps touch ovsdb
+	d.ovsdb.cache[bridgeTable] = map[libovsdb.UUID]libovsdb.Row{
+		{GoUUID: "br"}: {Fields: map[string]interface{}{"name": ovsBridgeName}},
+	}
+	store.err = fmt.Errorf("injected failure")
+
+	err := d.CreateNetwork(&pluginNet.CreateNetworkRequest{
+		NetworkID: "0123456789ab",
+		IPv4Data:  []*pluginNet.IPAMData{{Pool: "10.2.0.0/24", Gateway: "10.2.0.1/24"}},
+	})
+	assert.NotNil(t, err)
+	assert.Nil(t, d.network("0123456789ab"))
+	assert.True(t, d.ovsdb.BridgeExists(ovsBridgeName))
+
+	store.err = nil
+	err = d.CreateNetwork(&pluginNet.CreateNetworkRequest{
+		NetworkID: "0123456789ab",
+		IPv4Data:  []*pluginNet.IPAMData{{Pool: "10.2.0.0/24", Gateway: "10.2.0.1/24"}},
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, d.network("0123456789ab"))
+}
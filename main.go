@@ -2,23 +2,144 @@ package main
 
 import (
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/XiaoweiQian/ovs-driver/drivers"
 	"github.com/codegangsta/cli"
+	pluginIpam "github.com/docker/go-plugins-helpers/ipam"
 	pluginNet "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/go-plugins-helpers/sdk"
 )
 
 const (
-	version     = "0.1"
-	networkType = "ovs"
+	version = "0.1"
+	// pluginManifest makes the plugin usable as network and ipam driver
+	pluginManifest = `{"Implements": ["NetworkDriver", "IpamDriver"]}`
 )
 
 func main() {
 
 	var flagDebug = cli.BoolFlag{
-		Name:  "debug, d",
-		Usage: "enable debugging",
+		Name:   "debug, d",
+		Usage:  "enable debugging",
+		EnvVar: "OVS_DRIVER_DEBUG",
+	}
+	var flagConfig = cli.StringFlag{
+		Name:   "config, c",
+		Usage:  "path of the toml config file",
+		EnvVar: "OVS_DRIVER_CONFIG",
+	}
+	var flagOvsdbSocket = cli.StringFlag{
+		Name:   "ovsdb-socket",
+		Usage:  "unix socket of ovsdb-server",
+		EnvVar: "OVS_DRIVER_OVSDB_SOCKET",
+	}
+	var flagOvsdbEndpoint = cli.StringSliceFlag{
+		Name:   "ovsdb-endpoint",
+		Usage:  "ovsdb-server endpoint tried in order, unix:/path, tcp:host:port or ssl:host:port",
+		EnvVar: "OVS_DRIVER_OVSDB_ENDPOINTS",
+	}
+	var flagOvsdbSSLKey = cli.StringFlag{
+		Name:   "ovsdb-ssl-key",
+		Usage:  "client private key of ssl ovsdb endpoints",
+		EnvVar: "OVS_DRIVER_OVSDB_SSL_KEY",
+	}
+	var flagOvsdbSSLCert = cli.StringFlag{
+		Name:   "ovsdb-ssl-cert",
+		Usage:  "client certificate of ssl ovsdb endpoints",
+		EnvVar: "OVS_DRIVER_OVSDB_SSL_CERT",
+	}
+	var flagOvsdbSSLCA = cli.StringFlag{
+		Name:   "ovsdb-ssl-ca",
+		Usage:  "CA certificate of ssl ovsdb endpoints",
+		EnvVar: "OVS_DRIVER_OVSDB_SSL_CA",
+	}
+	var flagBridge = cli.StringFlag{
+		Name:   "bridge",
+		Usage:  "bridge of networks created without the bridge option",
+		EnvVar: "OVS_DRIVER_BRIDGE",
+	}
+	var flagSwarmEndpoint = cli.StringFlag{
+		Name:   "swarm-endpoint",
+		Usage:  "swarm manager asked for unknown networks, empty to disable",
+		EnvVar: "OVS_DRIVER_SWARM_ENDPOINT",
+	}
+	var flagPluginName = cli.StringFlag{
+		Name:   "plugin-name",
+		Usage:  "name of the plugin socket",
+		EnvVar: "OVS_DRIVER_PLUGIN_NAME",
+	}
+	var flagPluginGroup = cli.StringFlag{
+		Name:   "plugin-group",
+		Usage:  "group owning the plugin socket",
+		EnvVar: "OVS_DRIVER_PLUGIN_GROUP",
+	}
+	var flagVethPrefix = cli.StringFlag{
+		Name:   "veth-prefix",
+		Usage:  "name prefix of the container interfaces",
+		EnvVar: "OVS_DRIVER_VETH_PREFIX",
+	}
+	var flagStorePath = cli.StringFlag{
+		Name:   "store-path",
+		Usage:  "boltdb file of the local store",
+		EnvVar: "OVS_DRIVER_STORE_PATH",
+	}
+	var flagReconcileInterval = cli.StringFlag{
+		Name:   "reconcile-interval",
+		Usage:  "period of the orphaned links, ports and endpoints cleanup like 5m, disabled by default",
+		EnvVar: "OVS_DRIVER_RECONCILE_INTERVAL",
+	}
+	var flagReconcileDryRun = cli.BoolFlag{
+		Name:   "reconcile-dry-run",
+		Usage:  "only log the orphans found by the cleanup",
+		EnvVar: "OVS_DRIVER_RECONCILE_DRY_RUN",
+	}
+	var flagMetricsAddress = cli.StringFlag{
+		Name:   "metrics-address",
+		Usage:  "host:port serving prometheus metrics, empty to disable",
+		EnvVar: "OVS_DRIVER_METRICS_ADDRESS",
+	}
+	var flagAdminSocket = cli.StringFlag{
+		Name:   "admin-socket",
+		Usage:  "unix socket of the admin api, empty to disable",
+		EnvVar: "OVS_DRIVER_ADMIN_SOCKET",
+	}
+	var flagSflowTarget = cli.StringSliceFlag{
+		Name:   "sflow-target",
+		Usage:  "host:port of an sFlow collector, can be repeated",
+		EnvVar: "OVS_DRIVER_SFLOW_TARGETS",
+	}
+	var flagNetflowTarget = cli.StringSliceFlag{
+		Name:   "netflow-target",
+		Usage:  "host:port of a NetFlow collector, can be repeated",
+		EnvVar: "OVS_DRIVER_NETFLOW_TARGETS",
+	}
+	var flagIpfixTarget = cli.StringSliceFlag{
+		Name:   "ipfix-target",
+		Usage:  "host:port of an IPFIX collector, can be repeated",
+		EnvVar: "OVS_DRIVER_IPFIX_TARGETS",
+	}
+	var flagFlowSampling = cli.IntFlag{
+		Name:   "flow-sampling",
+		Usage:  "export one of n packets with sFlow and IPFIX",
+		EnvVar: "OVS_DRIVER_FLOW_SAMPLING",
+	}
+	var flagFlowPolling = cli.IntFlag{
+		Name:   "flow-polling",
+		Usage:  "sFlow counter polling and NetFlow and IPFIX active timeout in seconds",
+		EnvVar: "OVS_DRIVER_FLOW_POLLING",
+	}
+	var flagSflowAgent = cli.StringFlag{
+		Name:   "sflow-agent",
+		Usage:  "interface of the sFlow agent address",
+		EnvVar: "OVS_DRIVER_SFLOW_AGENT",
+	}
+	var flagIpamDefaultPool = cli.StringFlag{
+		Name:   "ipam-default-pool",
+		Usage:  "subnet split into /24 pools of the ovs ipam driver",
+		EnvVar: "OVS_DRIVER_IPAM_DEFAULT_POOL",
 	}
 	app := cli.NewApp()
 	app.Name = "docker-ovs"
@@ -26,21 +147,129 @@ func main() {
 	app.Version = version
 	app.Flags = []cli.Flag{
 		flagDebug,
+		flagConfig,
+		flagOvsdbSocket,
+		flagOvsdbEndpoint,
+		flagOvsdbSSLKey,
+		flagOvsdbSSLCert,
+		flagOvsdbSSLCA,
+		flagBridge,
+		flagSwarmEndpoint,
+		flagPluginName,
+		flagPluginGroup,
+		flagVethPrefix,
+		flagStorePath,
+		flagReconcileInterval,
+		flagReconcileDryRun,
+		flagMetricsAddress,
+		flagAdminSocket,
+		flagSflowTarget,
+		flagNetflowTarget,
+		flagIpfixTarget,
+		flagFlowSampling,
+		flagFlowPolling,
+		flagSflowAgent,
+		flagIpamDefaultPool,
 	}
+	// without a subcommand the plugin is served as before
 	app.Action = Run
+	app.Commands = commands()
 	app.Run(os.Args)
 }
 
+// loadConfig reads the config file, flags and env vars override its settings
+func loadConfig(ctx *cli.Context) (*drivers.Config, error) {
+	cfg, err := drivers.LoadConfig(ctx.GlobalString("config"))
+	if err != nil {
+		return nil, err
+	}
+	if ctx.GlobalIsSet("debug") {
+		cfg.Debug = ctx.GlobalBool("debug")
+	}
+	if ctx.GlobalIsSet("reconcile-dry-run") {
+		cfg.ReconcileDryRun = ctx.GlobalBool("reconcile-dry-run")
+	}
+	flags := map[string]*string{
+		"ovsdb-socket":       &cfg.OvsdbSocket,
+		"ovsdb-ssl-key":      &cfg.OvsdbSSLKey,
+		"ovsdb-ssl-cert":     &cfg.OvsdbSSLCert,
+		"ovsdb-ssl-ca":       &cfg.OvsdbSSLCA,
+		"bridge":             &cfg.Bridge,
+		"swarm-endpoint":     &cfg.SwarmEndpoint,
+		"plugin-name":        &cfg.PluginName,
+		"plugin-group":       &cfg.PluginGroup,
+		"veth-prefix":        &cfg.VethPrefix,
+		"store-path":         &cfg.StorePath,
+		"reconcile-interval": &cfg.ReconcileInterval,
+		"metrics-address":    &cfg.MetricsAddress,
+		"admin-socket":       &cfg.AdminSocket,
+		"sflow-agent":        &cfg.SflowAgent,
+		"ipam-default-pool":  &cfg.IpamDefaultPool,
+	}
+	for name, value := range flags {
+		if ctx.GlobalIsSet(name) {
+			*value = ctx.GlobalString(name)
+		}
+	}
+	if ctx.GlobalIsSet("ovsdb-endpoint") {
+		cfg.OvsdbEndpoints = ctx.GlobalStringSlice("ovsdb-endpoint")
+	}
+	targets := map[string]*[]string{
+		"sflow-target":   &cfg.SflowTargets,
+		"netflow-target": &cfg.NetflowTargets,
+		"ipfix-target":   &cfg.IpfixTargets,
+	}
+	for name, value := range targets {
+		if ctx.GlobalIsSet(name) {
+			*value = ctx.GlobalStringSlice(name)
+		}
+	}
+	if ctx.GlobalIsSet("flow-sampling") {
+		cfg.FlowSampling = ctx.GlobalInt("flow-sampling")
+	}
+	if ctx.GlobalIsSet("flow-polling") {
+		cfg.FlowPolling = ctx.GlobalInt("flow-polling")
+	}
+	return cfg, nil
+}
+
 // Run initializes the driver
 func Run(ctx *cli.Context) {
-	if ctx.Bool("debug") {
+	cfg, err := loadConfig(ctx)
+	if err != nil {
+		panic(err)
+	}
+	if cfg.Debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	d, err := drivers.Init()
+	d, err := drivers.Init(cfg)
 	if err != nil {
 		panic(err)
 	}
-	h := pluginNet.NewHandler(d)
-	h.ServeUnix("root", networkType)
+	go reloadOnSighup(ctx, d)
+
+	// the network and ipam drivers share the plugin socket
+	mux := newPluginMux()
+	mux.handle("/NetworkDriver.", pluginNet.NewHandler(drivers.WithMetrics(d)))
+	mux.handle("/IpamDriver.", pluginIpam.NewHandler(d.Ipam()))
+	h := sdk.NewHandler(pluginManifest)
+	h.HandleFunc("/", mux.ServeHTTP)
+	h.ServeUnix(cfg.PluginGroup, cfg.PluginName)
+}
+
+// reloadOnSighup reloads the config file when the process receives SIGHUP
+func reloadOnSighup(ctx *cli.Context, d *drivers.Driver) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		cfg, err := loadConfig(ctx)
+		if err != nil {
+			logrus.Errorf("Error reloading config. Err: %v", err)
+			continue
+		}
+		if err := d.Reload(cfg); err != nil {
+			logrus.Errorf("Error reloading config. Err: %v", err)
+		}
+	}
 }
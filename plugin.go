@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var errPipeListenerClosed = errors.New("pipe listener closed")
+
+// pluginServer is a plugin helper handler, served on a listener
+type pluginServer interface {
+	Serve(l net.Listener) error
+}
+
+// pluginMux dispatches the requests of the plugin socket to the handlers of
+// the plugin helpers by the prefix of their path, like /NetworkDriver.
+type pluginMux struct {
+	handlers map[string]http.Handler
+}
+
+func newPluginMux() *pluginMux {
+	return &pluginMux{handlers: map[string]http.Handler{}}
+}
+
+// handle serves the requests whose path starts with prefix by the helper.
+// The helpers do not expose their mux, so each one is served on an in
+// process listener the requests are proxied to.
+func (m *pluginMux) handle(prefix string, s pluginServer) {
+	l := newPipeListener()
+	go func() {
+		if err := s.Serve(l); err != nil && err != errPipeListenerClosed {
+			logrus.Errorf("Plugin handler %s stopped: %v", prefix, err)
+		}
+	}()
+	m.handlers[prefix] = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = "plugin"
+		},
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) { return l.dial() },
+		},
+	}
+}
+
+func (m *pluginMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for prefix, h := range m.handlers {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			h.ServeHTTP(w, r)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// pipeListener hands the connections dialed by the proxy to the helper
+type pipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, errPipeListenerClosed
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errPipeListenerClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,28 @@
+package appctl
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var appctlPath = "ovs-appctl"
+
+// Raw calls ovs-appctl with the given args and returns its combined output
+func Raw(args ...string) ([]byte, error) {
+	logrus.Debugf("%s, %v", appctlPath, args)
+	output, err := exec.Command(appctlPath, args...).CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("ovs-appctl failed: ovs-appctl %v: %s (%s)", strings.Join(args, " "), output, err)
+	}
+	return output, nil
+}
+
+// BondShow returns the bond/show status of the bond port, its members,
+// which one is active and the lacp negotiation
+func BondShow(port string) (string, error) {
+	output, err := Raw("bond/show", port)
+	return string(output), err
+}
@@ -0,0 +1,69 @@
+package iptables
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Action is the iptables operation on a rule
+type Action string
+
+const (
+	// Append appends a rule to the chain
+	Append Action = "-A"
+	// Insert inserts a rule at the top of the chain
+	Insert Action = "-I"
+	// Delete deletes a rule from the chain
+	Delete Action = "-D"
+
+	// Nat is the nat table
+	Nat = "nat"
+	// Filter is the filter table
+	Filter = "filter"
+)
+
+var iptablesPath = "iptables"
+
+// Raw calls iptables with the given args and returns its combined output
+func Raw(args ...string) ([]byte, error) {
+	logrus.Debugf("%s, %v", iptablesPath, args)
+	output, err := exec.Command(iptablesPath, append([]string{"--wait"}, args...)...).CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("iptables failed: iptables %v: %s (%s)", strings.Join(args, " "), output, err)
+	}
+	return output, nil
+}
+
+// Exists checks if a rule exists in the chain of the table
+func Exists(table, chain string, rule ...string) bool {
+	_, err := Raw(append([]string{"-t", table, "-C", chain}, rule...)...)
+	return err == nil
+}
+
+// ProgramRule adds or deletes a rule. Adding an existing rule or deleting a
+// missing one is not an error.
+func ProgramRule(table, chain string, action Action, rule ...string) error {
+	exists := Exists(table, chain, rule...)
+	if (action == Delete && !exists) || (action != Delete && exists) {
+		return nil
+	}
+	_, err := Raw(append([]string{"-t", table, string(action), chain}, rule...)...)
+	return err
+}
+
+// EnsureChain creates the chain in the table if it does not exist
+func EnsureChain(table, chain string) error {
+	if _, err := Raw("-t", table, "-n", "-L", chain); err == nil {
+		return nil
+	}
+	_, err := Raw("-t", table, "-N", chain)
+	return err
+}
+
+// EnsureJump inserts a jump from the parent chain to the chain
+func EnsureJump(table, parent, chain string, rule ...string) error {
+	return ProgramRule(table, parent, Insert, append(rule, "-j", chain)...)
+}
@@ -2,6 +2,7 @@ package netutils
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -22,11 +23,15 @@ func genMAC(ip net.IP) net.HardwareAddr {
 	// Since this address is locally administered, we can do whatever we want as long as
 	// it doesn't conflict with other addresses.
 	hw[1] = 0x42
-	// Fill the remaining 4 bytes based on the input
-	if ip == nil {
+	// Fill the remaining 4 bytes based on the input, the last 4 bytes of
+	// an IPv6 address
+	switch {
+	case ip == nil:
 		rand.Read(hw[2:])
-	} else {
+	case ip.To4() != nil:
 		copy(hw[2:], ip.To4())
+	default:
+		copy(hw[2:], ip.To16()[12:])
 	}
 	return hw
 }
@@ -37,11 +42,22 @@ func GenerateRandomMAC() net.HardwareAddr {
 }
 
 // GenerateMACFromIP returns a locally administered MAC address where the 4 least
-// significant bytes are derived from the IPv4 address.
+// significant bytes are derived from the IPv4 address, or from the 4 least
+// significant bytes of the IPv6 address.
 func GenerateMACFromIP(ip net.IP) net.HardwareAddr {
 	return genMAC(ip)
 }
 
+// GenerateMACFromID returns a locally administered unicast MAC address derived
+// from a hash of the id, the same id always gets the same address.
+func GenerateMACFromID(id string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(id))
+	hw := make(net.HardwareAddr, 6)
+	copy(hw, sum[:6])
+	hw[0] = hw[0]&0xfc | 0x02
+	return hw
+}
+
 // GenerateRandomName returns a new name joined with a prefix.  This size
 // specified is used to truncate the randomly generated value
 func GenerateRandomName(prefix string, size int) (string, error) {
@@ -150,3 +166,57 @@ func SetLinkUp(name string) error {
 	}
 	return netlink.LinkSetUp(iface)
 }
+
+// ParseCIDR returns the IP address and mask of a CIDR string. Unlike
+// net.ParseCIDR the host part of the address is kept.
+func ParseCIDR(cidr string) (*net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	ipNet.IP = ip
+	return ipNet, nil
+}
+
+// LinkExists checks if a link with the given name exists
+func LinkExists(name string) bool {
+	_, err := netlink.LinkByName(name)
+	return err == nil
+}
+
+// CreateVlanLink creates a vlan sub interface of the parent link
+func CreateVlanLink(name, parent string, vlanID int) error {
+	logrus.Infof("Creating vlan link with name: %s, parent: %s, vlan: %d", name, parent, vlanID)
+
+	parentLink, err := netlink.LinkByName(parent)
+	if err != nil {
+		return fmt.Errorf("parent interface %s not found: %v", parent, err)
+	}
+	vlan := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: parentLink.Attrs().Index,
+		},
+		VlanId: vlanID,
+	}
+	if err := netlink.LinkAdd(vlan); err != nil {
+		logrus.Errorf("error creating vlan link: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteLink deletes the link with the given name
+func DeleteLink(name string) error {
+	logrus.Infof("Deleting link with name: %s", name)
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
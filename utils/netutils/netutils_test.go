@@ -22,6 +22,18 @@ func TestGenerateMacFromIP(t *testing.T) {
 	assert.Equal(t, mac1.String(), mac2.String())
 	assert.NotEqual(t, mac1.String(), mac3.String())
 
+	mac4 := GenerateMACFromIP(net.ParseIP("fd00::c0a8:102"))
+	assert.Equal(t, mac1.String(), mac4.String())
+}
+
+func TestGenerateMACFromID(t *testing.T) {
+	mac1 := GenerateMACFromID("0123456789ab")
+	mac2 := GenerateMACFromID("0123456789ab")
+	mac3 := GenerateMACFromID("0123456789ac")
+	assert.Equal(t, mac1.String(), mac2.String())
+	assert.NotEqual(t, mac1.String(), mac3.String())
+	// locally administered unicast
+	assert.Equal(t, byte(0x02), mac1[0]&0x03)
 }
 
 func TestGenerateRandomName(t *testing.T) {
@@ -52,3 +64,14 @@ func TestCreateVethPair(t *testing.T) {
 	err = DeleteVethPair(name1, name2)
 	assert.Nil(t, err)
 }
+
+func TestParseCIDR(t *testing.T) {
+	addr, err := ParseCIDR("192.168.1.2/24")
+	assert.Nil(t, err)
+	assert.Equal(t, "192.168.1.2/24", addr.String())
+	addr, err = ParseCIDR("fd00::2/64")
+	assert.Nil(t, err)
+	assert.Equal(t, "fd00::2/64", addr.String())
+	_, err = ParseCIDR("192.168.1.2")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,58 @@
+package ofctl
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var ofctlPath = "ovs-ofctl"
+
+// Raw calls ovs-ofctl with the given args and stdin and returns its combined
+// output
+func Raw(stdin string, args ...string) ([]byte, error) {
+	logrus.Debugf("%s, %v", ofctlPath, args)
+	cmd := exec.Command(ofctlPath, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("ovs-ofctl failed: ovs-ofctl %v: %s (%s)", strings.Join(args, " "), output, err)
+	}
+	return output, nil
+}
+
+// AddFlows adds the flows to the bridge, a flow with the same match and
+// priority as an existing one replaces it
+func AddFlows(bridge string, flows []string) error {
+	if len(flows) == 0 {
+		return nil
+	}
+	_, err := Raw(strings.Join(flows, "\n")+"\n", "add-flows", bridge, "-")
+	return err
+}
+
+// DelFlowsByCookie deletes the flows of the bridge having the cookie
+func DelFlowsByCookie(bridge string, cookie uint64) error {
+	_, err := Raw("", "del-flows", bridge, fmt.Sprintf("cookie=%#x/-1", cookie))
+	return err
+}
+
+// DumpFlowsByCookie returns the flows of the bridge having the cookie, one
+// per line as printed by ovs-ofctl
+func DumpFlowsByCookie(bridge string, cookie uint64) ([]string, error) {
+	output, err := Raw("", "dump-flows", bridge, fmt.Sprintf("cookie=%#x/-1", cookie))
+	if err != nil {
+		return nil, err
+	}
+	flows := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "cookie=") {
+			flows = append(flows, line)
+		}
+	}
+	return flows, nil
+}